@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"go-database-json/storage"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiKeysPath = "auth/apikeys.json"
+
+	// apiKeyPrefix tells API keys apart from session tokens in the
+	// Authorization header
+	apiKeyPrefix = "dbk_"
+
+	// lastUsedInterval limits how often the last use of a key is written
+	lastUsedInterval = time.Minute
+)
+
+// RoleAPIKey is the role of requests authenticated with an API key
+const RoleAPIKey = "apikey"
+
+// API key operations, they match the record routes
+const (
+	OperationList   = "list"
+	OperationView   = "view"
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+var (
+	errAPIKeyNotFound = errors.New("api key not found")
+	errAPIKeyExists   = errors.New("api key name already in use")
+)
+
+// apiKeysMu guards read-modify-write cycles on the API key store
+var apiKeysMu sync.Mutex
+
+// APIKey grants a service access to records within its scope. Clients
+// receive "dbk_<id>_<secret>", only the SHA-256 hash of the secret is
+// stored. The secret is random, so a slow hash is not needed.
+type APIKey struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Hash      string      `json:"hash"`
+	Scope     APIKeyScope `json:"scope"`
+	CreatedBy string      `json:"createdBy"`
+	Created   time.Time   `json:"created"`
+	Expires   *time.Time  `json:"expires"`
+	LastUsed  *time.Time  `json:"lastUsed"`
+}
+
+// APIKeyScope restricts what a key can do. Empty lists mean no restriction,
+// except that the customers collection has to be listed to be reachable.
+type APIKeyScope struct {
+	ReadOnly    bool     `json:"readOnly"`
+	Collections []string `json:"collections"`
+	Operations  []string `json:"operations"`
+}
+
+func (s APIKeyScope) allows(collection, operation string) bool {
+	// customer accounts are only open to keys naming their collection
+	if collection == CustomersCollection && !contains(s.Collections, collection) {
+		return false
+	}
+	if s.ReadOnly && operation != OperationList && operation != OperationView {
+		return false
+	}
+	if len(s.Collections) > 0 && !contains(s.Collections, collection) {
+		return false
+	}
+	if len(s.Operations) > 0 && !contains(s.Operations, operation) {
+		return false
+	}
+	return true
+}
+
+// creatorAllows reports whether the superuser who created the key still
+// holds the record permission the operation needs. A key never does more
+// than its creator currently may.
+func (k APIKey) creatorAllows(collection, operation string) (bool, error) {
+	user, ok, err := lookupSuperUser(k.CreatedBy)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	permission := "records:write:" + collection
+	if operation == OperationList || operation == OperationView {
+		permission = "records:read:" + collection
+	}
+	granted, _ := rolePermissions(user.Role)
+	return permits(granted, permission), nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (k APIKey) expired(now time.Time) bool {
+	return k.Expires != nil && !now.Before(*k.Expires)
+}
+
+func loadAPIKeys() ([]APIKey, error) {
+	data, err := os.ReadFile(apiKeysPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func saveAPIKeys(keys []APIKey) error {
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(apiKeysPath, data, 0600)
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAPIKey stores a new key and returns it with the plain key
+func createAPIKey(name string, scope APIKeyScope, expires *time.Time, createdBy string) (string, APIKey, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", APIKey{}, err
+	}
+	secret := hex.EncodeToString(buf)
+
+	key := APIKey{
+		ID:        strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Name:      name,
+		Hash:      hashAPIKeySecret(secret),
+		Scope:     scope,
+		CreatedBy: createdBy,
+		Created:   time.Now().UTC(),
+		Expires:   expires,
+	}
+
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	for _, k := range keys {
+		if k.Name == name {
+			return "", APIKey{}, errAPIKeyExists
+		}
+	}
+
+	if err := saveAPIKeys(append(keys, key)); err != nil {
+		return "", APIKey{}, err
+	}
+	return apiKeyPrefix + key.ID + "_" + secret, key, nil
+}
+
+// verifyAPIKey returns the key a plain API key belongs to and records its use
+func verifyAPIKey(plain string) (*APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(plain, apiKeyPrefix), "_")
+	if !strings.HasPrefix(plain, apiKeyPrefix) || !ok || id == "" || secret == "" {
+		return nil, errInvalidToken
+	}
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, key := range keys {
+		if key.ID != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKeySecret(secret))) != 1 || key.expired(now) {
+			return nil, errInvalidToken
+		}
+		// keys die with the superuser who created them
+		if _, ok, err := lookupSuperUser(key.CreatedBy); err != nil || !ok {
+			if err != nil {
+				return nil, err
+			}
+			return nil, errInvalidToken
+		}
+
+		if key.LastUsed == nil || now.Sub(*key.LastUsed) >= lastUsedInterval {
+			key.LastUsed = &now
+			if err := touchAPIKey(key.ID, now); err != nil {
+				log.Printf("failed to update last use of api key %s: %v", key.ID, err)
+			}
+		}
+		return &key, nil
+	}
+	return nil, errInvalidToken
+}
+
+func touchAPIKey(id string, now time.Time) error {
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if keys[i].ID == id {
+			keys[i].LastUsed = &now
+			return saveAPIKeys(keys)
+		}
+	}
+	return nil
+}
+
+func revokeAPIKey(id string) error {
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if key.ID == id {
+			return saveAPIKeys(append(keys[:i], keys[i+1:]...))
+		}
+	}
+	return errAPIKeyNotFound
+}
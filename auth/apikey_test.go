@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"testing"
+)
+
+func TestAPIKeyCreator(t *testing.T) {
+	resetAuth(t)
+	users := map[string]SuperUser{
+		"ed": {Identity: "ed", Role: RoleEditor},
+	}
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, _, err := createAPIKey("service", APIKeyScope{}, nil, "ed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestEngine(t)
+	r.Use(RequireAuth(), CheckAPIKeyScope())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/:collection", ok)
+	r.POST("/:collection", ok)
+
+	check := func(step, method string, want int) {
+		t.Helper()
+		w, _ := serve(r, testRequest{method: method, path: "/notes", header: map[string]string{"X-API-Key": plain}})
+		if w.Code != want {
+			t.Errorf("%s: %s got %d, want %d", step, method, w.Code, want)
+		}
+	}
+
+	check("editor", "GET", http.StatusOK)
+	check("editor", "POST", http.StatusOK)
+
+	users["ed"] = SuperUser{Identity: "ed", Role: RoleViewer}
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		t.Fatal(err)
+	}
+	check("demoted to viewer", "GET", http.StatusOK)
+	check("demoted to viewer", "POST", http.StatusForbidden)
+
+	delete(users, "ed")
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		t.Fatal(err)
+	}
+	check("creator deleted", "GET", http.StatusUnauthorized)
+}
+
+func TestAPIKeyCustomers(t *testing.T) {
+	resetAuth(t)
+	if err := saveSuperUsers(superUsersPath, map[string]SuperUser{"root": {Identity: "root", Role: RoleOwner}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestEngine(t)
+	r.Use(RequireAuth(), CheckAPIKeyScope())
+	r.GET("/:collection", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		scope APIKeyScope
+		path  string
+		code  int
+	}{
+		{APIKeyScope{}, "/notes", http.StatusOK},
+		{APIKeyScope{}, "/customers", http.StatusForbidden},
+		{APIKeyScope{Collections: []string{"notes"}}, "/customers", http.StatusForbidden},
+		{APIKeyScope{Collections: []string{"customers"}}, "/customers", http.StatusOK},
+		{APIKeyScope{Collections: []string{"customers"}}, "/notes", http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		plain, _, err := createAPIKey(fmt.Sprintf("key%d", i), tt.scope, nil, "root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, _ := serve(r, testRequest{method: "GET", path: tt.path, header: map[string]string{"Authorization": "Bearer " + plain}})
+		if w.Code != tt.code {
+			t.Errorf("scope %+v on %s: got %d, want %d", tt.scope, tt.path, w.Code, tt.code)
+		}
+	}
+}
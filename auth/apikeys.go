@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+func apiKeyView(key APIKey) gin.H {
+	return gin.H{
+		"id":        key.ID,
+		"name":      key.Name,
+		"scope":     key.Scope,
+		"createdBy": key.CreatedBy,
+		"created":   key.Created,
+		"expires":   key.Expires,
+		"lastUsed":  key.LastUsed,
+	}
+}
+
+// CreateAPIKeyHandler mints a named API key. The plain key is only part of
+// this response and can't be shown again.
+func CreateAPIKeyHandler(c *gin.Context) {
+	var req struct {
+		Name    string      `json:"name"`
+		Expires *time.Time  `json:"expires"`
+		Scope   APIKeyScope `json:"scope"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON: %v", err)})
+		return
+	}
+
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name required"})
+		return
+	}
+	if req.Expires != nil && !req.Expires.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires must be in the future"})
+		return
+	}
+	for _, operation := range req.Scope.Operations {
+		switch operation {
+		case OperationList, OperationView, OperationCreate, OperationUpdate, OperationDelete:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown operation '%s'", operation)})
+			return
+		}
+	}
+
+	// a key can't grant more record access than its creator has
+	collections := req.Scope.Collections
+	if len(collections) == 0 {
+		collections = []string{"*"}
+	}
+	readOnly := req.Scope.ReadOnly ||
+		(len(req.Scope.Operations) > 0 && allOf(req.Scope.Operations, OperationList, OperationView))
+	for _, collection := range collections {
+		required := []string{"records:read:" + collection}
+		if !readOnly {
+			required = append(required, "records:write:"+collection)
+		}
+		for _, permission := range required {
+			allowed, err := hasPermission(c, permission)
+			if err != nil {
+				log.Printf("failed to load superusers: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+				return
+			}
+			if !allowed {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permission + " for this scope"})
+				return
+			}
+		}
+	}
+
+	plain, key, err := createAPIKey(req.Name, req.Scope, req.Expires, c.GetString("username"))
+	if errors.Is(err, errAPIKeyExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "An API key with this name already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to create api key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	audit(c, EventAPIKeyCreate, key.Name, RoleAPIKey, OutcomeSuccess)
+	c.JSON(http.StatusCreated, gin.H{
+		"key":    plain,
+		"apiKey": apiKeyView(key),
+	})
+}
+
+// ListAPIKeysHandler lists all API keys without their secrets
+func ListAPIKeysHandler(c *gin.Context) {
+	keys, err := loadAPIKeys()
+	if err != nil {
+		log.Printf("failed to load api keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	items := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, apiKeyView(key))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(items),
+		"items": items,
+	})
+}
+
+func RevokeAPIKeyHandler(c *gin.Context) {
+	err := revokeAPIKey(c.Param("id"))
+	if errors.Is(err, errAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to revoke api key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	audit(c, EventAPIKeyRevoke, c.Param("id"), RoleAPIKey, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
+// allOf reports whether every item of list is one of values
+func allOf(list []string, values ...string) bool {
+	for _, item := range list {
+		if !contains(values, item) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const auditPath = "auth/audit.log"
+
+// audit events
+const (
+	EventLogin          = "login"
+	EventTokenCheck     = "token_check"
+	EventRegister       = "register"
+	EventLogout         = "logout"
+	EventPasswordChange = "password_change"
+	EventAPIKeyCreate   = "apikey_create"
+	EventAPIKeyRevoke   = "apikey_revoke"
+	EventMFAEnroll      = "mfa_enroll"
+	EventMFADisable     = "mfa_disable"
+	EventPasswordReset  = "password_reset"
+	EventVerifyEmail    = "verify_email"
+	EventOAuthLogin     = "oauth_login"
+	EventOAuthLink      = "oauth_link"
+	EventOAuthUnlink    = "oauth_unlink"
+)
+
+// audit outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeLocked  = "locked"
+	// OutcomeChallenge is a correct password still waiting for the second factor
+	OutcomeChallenge = "challenge"
+	// OutcomeRequested is a mail with a token that was sent out
+	OutcomeRequested = "requested"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Identity  string    `json:"identity"`
+	Role      string    `json:"role"`
+	Outcome   string    `json:"outcome"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+}
+
+var auditMu sync.Mutex
+
+// audit appends an entry to the audit log. The log is only ever appended
+// to, one JSON object per line. A failing write is logged and does not fail
+// the request.
+func audit(c *gin.Context, event, identity, role, outcome string) {
+	from := clientOf(c)
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Event:     event,
+		Identity:  identity,
+		Role:      role,
+		Outcome:   outcome,
+		IP:        from.IP,
+		UserAgent: from.UserAgent,
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("failed to write audit log: %v", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	file, err := os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("failed to write audit log: %v", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("failed to write audit log: %v", err)
+	}
+}
+
+// AuditHandler lists audit log entries, newest first. The entries can be
+// filtered by identity, role, event and outcome and limited to a time range
+// with from and to as RFC 3339 timestamps.
+func AuditHandler(c *gin.Context) {
+	var from, to time.Time
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + ", expected an RFC 3339 timestamp"})
+			return
+		}
+		*target = parsed
+	}
+
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+
+	filters := map[string]string{
+		"identity": c.Query("identity"),
+		"role":     c.Query("role"),
+		"event":    c.Query("event"),
+		"outcome":  c.Query("outcome"),
+	}
+
+	entries, err := readAuditLog(func(e AuditEntry) bool {
+		fields := map[string]string{"identity": e.Identity, "role": e.Role, "event": e.Event, "outcome": e.Outcome}
+		for name, want := range filters {
+			if want != "" && fields[name] != want {
+				return false
+			}
+		}
+		if !from.IsZero() && e.Time.Before(from) {
+			return false
+		}
+		if !to.IsZero() && e.Time.After(to) {
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("failed to read audit log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	// newest first
+	items := make([]AuditEntry, 0, limit)
+	for i := len(entries) - 1; i >= 0 && len(items) < limit; i-- {
+		items = append(items, entries[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":      len(items),
+		"totalItems": len(entries),
+		"items":      items,
+	})
+}
+
+// readAuditLog returns the entries matching keep in the order they were written
+func readAuditLog(keep func(AuditEntry) bool) ([]AuditEntry, error) {
+	auditMu.Lock()
+	file, err := os.Open(auditPath)
+	auditMu.Unlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		// a line cut short by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if keep(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAuditHandler(t *testing.T) {
+	resetAuth(t)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []AuditEntry{
+		{Event: EventLogin, Identity: "alice", Role: RoleCustomer, Outcome: OutcomeFailure},
+		{Event: EventLogin, Identity: "alice", Role: RoleCustomer, Outcome: OutcomeSuccess},
+		{Event: EventLogin, Identity: "root", Role: RoleSuperuser, Outcome: OutcomeSuccess},
+		{Event: EventLogout, Identity: "alice", Role: RoleCustomer, Outcome: OutcomeSuccess},
+		{Event: EventLogin, Identity: "alice", Role: RoleSuperuser, Outcome: OutcomeLocked},
+	}
+	var log []byte
+	for i, entry := range entries {
+		entry.Time = start.Add(time.Duration(i) * time.Hour)
+		line, _ := json.Marshal(entry)
+		log = append(append(log, line...), '\n')
+	}
+	// a line cut short by a crash
+	log = append(log, `{"time": "2024-05-01T18:00:00Z", "event": "lo`...)
+	if err := os.WriteFile(auditPath, log, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestEngine(t)
+	r.GET("/audit", AuditHandler)
+
+	tests := []struct {
+		query string
+		// hours of the expected entries, newest first
+		hours []int
+		total int
+	}{
+		{"", []int{4, 3, 2, 1, 0}, 5},
+		{"identity=alice", []int{4, 3, 1, 0}, 4},
+		{"identity=alice&role=customer", []int{3, 1, 0}, 3},
+		{"event=login&outcome=success", []int{2, 1}, 2},
+		{"outcome=locked", []int{4}, 1},
+		{"identity=nobody", []int{}, 0},
+		{"from=2024-05-01T13:00:00Z&to=2024-05-01T15:00:00Z", []int{3, 2, 1}, 3},
+		{"from=2024-05-01T14:30:00%2B02:00", []int{4, 3, 2, 1}, 4},
+		{"limit=2", []int{4, 3}, 5},
+		{"identity=alice&limit=1", []int{4}, 4},
+	}
+	for _, tt := range tests {
+		w, body := serve(r, testRequest{method: "GET", path: "/audit?" + tt.query})
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: %d %s", tt.query, w.Code, w.Body)
+			continue
+		}
+		items, _ := body["items"].([]interface{})
+		if body["totalItems"] != float64(tt.total) || body["count"] != float64(len(tt.hours)) || len(items) != len(tt.hours) {
+			t.Errorf("%q: %v", tt.query, body)
+			continue
+		}
+		for i, hour := range tt.hours {
+			want := start.Add(time.Duration(hour) * time.Hour).Format(time.RFC3339)
+			if got := items[i].(map[string]interface{})["time"]; got != want {
+				t.Errorf("%q: item %d at %v, want %s", tt.query, i, got, want)
+			}
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "limit=ten", "from=yesterday", "to=2024-05-01"} {
+		if w, _ := serve(r, testRequest{method: "GET", path: "/audit?" + query}); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: %d", query, w.Code)
+		}
+	}
+}
+
+func TestAuditLogins(t *testing.T) {
+	resetAuth(t)
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+
+	r := newTestEngine(t)
+	r.POST("/login", CustomerHandler)
+	for _, password := range []string{"wrong", "Str0ng!Passw0rd#x"} {
+		serve(r, testRequest{method: "POST", path: "/login", body: `{"identity": "alice", "password": "` + password + `"}`, header: map[string]string{"User-Agent": "test"}})
+	}
+
+	entries, err := readAuditLog(func(AuditEntry) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("audit log: %+v", entries)
+	}
+	for i, outcome := range []string{OutcomeFailure, OutcomeSuccess} {
+		e := entries[i]
+		if e.Event != EventLogin || e.Identity != "alice" || e.Role != RoleCustomer || e.Outcome != outcome || e.UserAgent != "test" || time.Since(e.Time) > time.Minute {
+			t.Errorf("entry %d: %+v", i, e)
+		}
+	}
+}
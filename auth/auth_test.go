@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go-database-json/storage"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs the tests in a scratch directory, the auth files are kept
+// under relative paths
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "auth-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "auth"), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// resetAuth removes all auth files and gives the test an empty in-memory
+// storage
+func resetAuth(t *testing.T) {
+	t.Helper()
+	entries, err := os.ReadDir("auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := os.Remove(filepath.Join("auth", entry.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	superUsersCacheMu.Lock()
+	superUsersCache = nil
+	superUsersCacheMu.Unlock()
+
+	failuresMu.Lock()
+	failures = make(map[string]*failedLogins)
+	failuresMu.Unlock()
+
+	tokenAccountsMu.Lock()
+	tokenAccounts = make(map[string]tokenAccount)
+	tokenAccountsMu.Unlock()
+
+	previous := storage.Default
+	storage.Default = storage.NewMemoryStorage()
+	t.Cleanup(func() { storage.Default = previous })
+	if err := EnsureCustomersCollection(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestEngine returns an engine trusting no proxies, like the server
+// without trustedProxies in its config
+func newTestEngine(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := r.SetTrustedProxies(nil); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+type testRequest struct {
+	method, path string
+	body         string
+	header       map[string]string
+	// remoteAddr defaults to the one of httptest
+	remoteAddr string
+}
+
+func serve(r *gin.Engine, req testRequest) (*httptest.ResponseRecorder, map[string]interface{}) {
+	httpReq := httptest.NewRequest(req.method, req.path, bytes.NewBufferString(req.body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	for key, value := range req.header {
+		httpReq.Header.Set(key, value)
+	}
+	if req.remoteAddr != "" {
+		httpReq.RemoteAddr = req.remoteAddr
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httpReq)
+
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w, body
+}
+
+func TestCreateSuperUser(t *testing.T) {
+	resetAuth(t)
+	const password = "Str0ng!Passw0rd#x"
+
+	if err := CreateSuperUser("admin", "Admin", password, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateSuperUser("second", "", password, false); err != ErrSuperUsersExist {
+		t.Fatalf("second owner without force: %v", err)
+	}
+	if err := CreateSuperUser("admin", "", password, true); err != ErrSuperUserExists {
+		t.Fatalf("existing identity: %v", err)
+	}
+	if err := CreateSuperUser("second", "", password, true); err != nil {
+		t.Fatalf("second owner with force: %v", err)
+	}
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["admin"].Role != RoleOwner || users["second"].Role != RoleOwner {
+		t.Fatalf("superusers: %+v", users)
+	}
+	if users["admin"].Password == password {
+		t.Fatal("password stored in plain text")
+	}
+}
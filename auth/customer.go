@@ -1,22 +1,18 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"go-database-json/schema"
+	"go-database-json/storage"
 	"log"
 	"net/http"
+	"time"
 )
 
 func CustomerHandler(c *gin.Context) {
-	users, err := loadSuperUsers("auth/superusers.json")
-	if err != nil {
-		log.Printf("failed to load superusers: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-		return
-	}
-
 	var req struct {
 		Identity string `json:"identity"`
 		Password string `json:"password"`
@@ -26,56 +22,40 @@ func CustomerHandler(c *gin.Context) {
 		return
 	}
 
-	user, ok := users[req.Identity]
-	if !ok || user.Password != req.Password {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+	customer, err := authenticateCustomer(req.Identity, req.Password)
+	if errors.Is(err, errAccountLocked) {
+		audit(c, EventLogin, req.Identity, RoleCustomer, OutcomeLocked)
+		respondLocked(c, req.Identity, RoleCustomer)
 		return
 	}
-
-	// generate a new random token (plain)
-	secretToken := []byte(uuid.NewString())
-
-	// hash the token for storage
-	hashed, err := bcrypt.GenerateFromPassword(secretToken, bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("failed to hash token: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+	if errors.Is(err, errInvalidCredentials) {
+		audit(c, EventLogin, req.Identity, RoleCustomer, OutcomeFailure)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
 		return
 	}
-
-	// load existing tokens
-	tokens, err := loadTokens("auth/token.json")
 	if err != nil {
-		log.Printf("failed to load tokens: %v", err)
+		log.Printf("failed to load customers: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return
 	}
 
-	// append the new hashed token for this user
-	userTokens := tokens[user.Identity]
-
-	// limit to max 5 tokens, drop oldest if needed
-	if len(userTokens) >= 5 {
-		userTokens = userTokens[1:] // drop the oldest token
-	}
-	userTokens = append(userTokens, string(hashed))
-	tokens[user.Identity] = userTokens
-
-	// save updated tokens back to file
-	if err := saveTokens("auth/token.json", tokens); err != nil {
-		log.Printf("failed to save tokens: %v", err)
+	// issue a new token, only its hash is stored
+	token, _, err := issueToken(req.Identity, RoleCustomer, clientOf(c))
+	if err != nil {
+		log.Printf("failed to issue token: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return
 	}
 
-	fmt.Printf("New token for user %s: %s\n", user.Identity, hashed)
+	audit(c, EventLogin, req.Identity, RoleCustomer, OutcomeSuccess)
 
 	// return the plain token (client uses this to authenticate later)
 	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
-		"token":  string(secretToken),
-		"user":   user.Identity,
-		"name":   user.Name,
+		"token":  token,
+		"user":   req.Identity,
+		"id":     customer.ID,
+		"name":   customer.Data["name"],
 	})
 }
 
@@ -89,36 +69,153 @@ func CustomerCheckHandler(c *gin.Context) {
 		return
 	}
 
-	tokens, err := loadTokens("auth/token.json")
+	// check that the token was issued to this customer
+	session, err := verifyToken(req.Token)
+	if errors.Is(err, errInvalidToken) || (err == nil && (session.Identity != req.Username || session.Role != RoleCustomer)) {
+		audit(c, EventTokenCheck, req.Username, RoleCustomer, OutcomeFailure)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+		return
+	}
 	if err != nil {
 		log.Printf("failed to load tokens: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return
 	}
 
-	userTokens, ok := tokens[req.Username]
-	if !ok || len(userTokens) == 0 {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+	audit(c, EventTokenCheck, req.Username, RoleCustomer, OutcomeSuccess)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"user":   req.Username,
+	})
+}
+
+// CustomerRegisterHandler creates a customer account. Besides identity and
+// password the body may carry profile fields, which are checked against the
+// schema of the customers collection if it has one.
+func CustomerRegisterHandler(c *gin.Context) {
+	var body map[string]interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON: %v", err)})
 		return
 	}
 
-	// check if any stored hashed token matches the provided plain token
-	authenticated := false
-	for _, hashedToken := range userTokens {
-		err := bcrypt.CompareHashAndPassword([]byte(hashedToken), []byte(req.Token))
-		if err == nil {
-			authenticated = true
-			break
+	identity, _ := body["identity"].(string)
+	password, _ := body["password"].(string)
+	if identity == "" || password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identity and Password required"})
+		return
+	}
+
+	if err := checkPasswordPolicy(password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, field := range append([]string{tokenVersionField, verifiedField}, storage.SystemFields...) {
+		if _, ok := body[field]; ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Field '%s' is reserved and can't be modified", field)})
+			return
 		}
 	}
 
-	if !authenticated {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+	unlock := storage.Locks.LockCollection(CustomersCollection)
+	defer unlock()
+
+	// check if customer already exists
+	err := CheckUniqueCustomer("", body)
+	if errors.Is(err, ErrCustomerExists) {
+		audit(c, EventRegister, identity, RoleCustomer, OutcomeFailure)
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load customers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	// validate the profile fields
+	errs, err := validateProfile(body)
+	if err != nil {
+		log.Printf("failed to load customers collection: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "errors": errs})
 		return
 	}
 
+	// hash the password
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		log.Printf("failed to hash password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	body["password"] = hashedPassword
+	id := stampCustomer(body, identity)
+
+	if err := storage.Default.PutRecord(CustomersCollection, id, body); err != nil {
+		log.Printf("failed to save customer: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save user"})
+		return
+	}
+
+	audit(c, EventRegister, identity, RoleCustomer, OutcomeSuccess)
+
+	// ask new customers to confirm their email address right away
+	if email := customerEmail(body); email != "" {
+		customer := &storage.Record{ID: id, Data: body}
+		if err := sendCustomerMail(purposeVerifyEmail, customer, email, verifyEmailTTL); err != nil {
+			log.Printf("failed to send verification mail: %v", err)
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"status": "ok",
-		"user":   req.Username,
+		"status": "created",
+		"user":   identity,
+		"id":     id,
 	})
 }
+
+// validateProfile checks the fields of a new customer against the schema of
+// the customers collection, if it has one
+func validateProfile(body map[string]interface{}) ([]schema.FieldError, error) {
+	config, err := storage.Default.GetCollection(CustomersCollection)
+	if err != nil {
+		return nil, err
+	}
+	profileSchema, ok := config["schema"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	profile := make(map[string]interface{}, len(body))
+	for key, value := range body {
+		profile[key] = value
+	}
+	for _, field := range CustomerAuthFields {
+		delete(profile, field)
+	}
+	return schema.Validate(profileSchema, profile), nil
+}
+
+// stampCustomer fills in the system fields of a new customer record and
+// returns its id
+func stampCustomer(body map[string]interface{}, identity string) string {
+	id := uuid.NewString()
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	body["id"] = id
+	body["collectionId"] = CustomersCollection
+	body["created"] = now
+	body["updated"] = now
+	body["createdBy"] = identity
+	body["updatedBy"] = identity
+	body["revision"] = 1
+	body[verifiedField] = false
+	return id
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-database-json/config"
+	"go-database-json/mail"
+	"go-database-json/storage"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// verifiedField tells whether a customer confirmed their email address
+const verifiedField = "verified"
+
+// customerEmail returns where mails to a customer go, the email field or
+// the identity if it is an email address
+func customerEmail(data map[string]interface{}) string {
+	if email, ok := data["email"].(string); ok && email != "" {
+		return email
+	}
+	if identity, _ := data["identity"].(string); strings.Contains(identity, "@") {
+		return identity
+	}
+	return ""
+}
+
+// findCustomerByLogin looks up a customer by identity or email address.
+// The caller must hold a lock on the customers collection.
+func findCustomerByLogin(login string) (*storage.Record, error) {
+	customer, err := findCustomer(login)
+	if !errors.Is(err, errCustomerNotFound) {
+		return customer, err
+	}
+	return findCustomerByEmail(login)
+}
+
+// findCustomerByEmail looks up a customer by email address, ignoring case.
+// The caller must hold a lock on the customers collection.
+func findCustomerByEmail(email string) (*storage.Record, error) {
+	records, err := storage.Default.ListRecords(CustomersCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if address := customerEmail(record.Data); address != "" && strings.EqualFold(address, email) {
+			return &record, nil
+		}
+	}
+	return nil, errCustomerNotFound
+}
+
+// sendCustomerMail issues a token and mails it to the customer
+func sendCustomerMail(purpose string, customer *storage.Record, email string, ttl time.Duration) error {
+	token, err := issueMailToken(purpose, customer.ID, email, ttl)
+	if err != nil {
+		return err
+	}
+
+	name, _ := customer.Data["name"].(string)
+	identity, _ := customer.Data["identity"].(string)
+	if name == "" {
+		name = identity
+	}
+	msg, err := mail.Render(purpose, email, map[string]interface{}{
+		"Name":     name,
+		"Identity": identity,
+		"Token":    token,
+		"AppURL":   strings.TrimSuffix(config.Current.Mail.AppURL, "/"),
+		"ValidFor": validFor(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	return mail.Default.Send(msg)
+}
+
+// validFor writes a token lifetime for humans, e.g. "24 hours"
+func validFor(ttl time.Duration) string {
+	if ttl >= time.Hour && ttl%time.Hour == 0 {
+		if ttl == time.Hour {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", ttl/time.Hour)
+	}
+	return fmt.Sprintf("%d minutes", ttl/time.Minute)
+}
+
+// PasswordResetRequestHandler mails a password reset link to a customer.
+// The answer is the same whether the account exists or not.
+func PasswordResetRequestHandler(c *gin.Context) {
+	var req struct {
+		Identity string `json:"identity"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Identity == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identity or email required"})
+		return
+	}
+
+	unlock := storage.Locks.RLockCollection(CustomersCollection)
+	customer, err := findCustomerByLogin(req.Identity)
+	unlock()
+	if err != nil && !errors.Is(err, errCustomerNotFound) {
+		log.Printf("failed to load customers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	if customer != nil {
+		if email := customerEmail(customer.Data); email != "" {
+			audit(c, EventPasswordReset, req.Identity, RoleCustomer, OutcomeRequested)
+			// sent in the background, so the response time doesn't tell
+			// whether the account exists
+			go func() {
+				if err := sendCustomerMail(purposePasswordReset, customer, email, passwordResetTTL); err != nil {
+					log.Printf("failed to send password reset mail: %v", err)
+				}
+			}()
+		}
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "If the account exists, a mail with a reset link was sent"})
+}
+
+// PasswordResetConfirmHandler sets a new password with the token from the
+// reset mail. All sessions of the customer are revoked. Tokens sent to an
+// address the customer changed since don't work anymore.
+func PasswordResetConfirmHandler(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON: %v", err)})
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token and password required"})
+		return
+	}
+	if err := checkPasswordPolicy(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hashed, err := hashPassword(req.Password)
+	if err != nil {
+		log.Printf("failed to hash password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	token, err := useMailToken(purposePasswordReset, req.Token)
+	if errors.Is(err, errInvalidMailToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load mail tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	identity, version, unlinked, err := resetCustomerPassword(token, hashed)
+	if errors.Is(err, errInvalidMailToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to save password of customer %s: %v", token.CustomerID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save password"})
+		return
+	}
+	setTokenVersion(identity, RoleCustomer, version)
+	if err := revokeUserSessions(identity, RoleCustomer); err != nil {
+		log.Printf("failed to revoke sessions of %s: %v", identity, err)
+	}
+	resetFailures(identity, RoleCustomer)
+
+	if unlinked {
+		audit(c, EventOAuthUnlink, identity, RoleCustomer, OutcomeSuccess)
+	}
+	audit(c, EventPasswordReset, identity, RoleCustomer, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{"status": "password changed"})
+}
+
+// resetCustomerPassword stores a new password hash for the customer a reset
+// token was sent to and raises the token version. Tokens sent to an address
+// the customer changed since are rejected with errInvalidMailToken.
+//
+// An account with an unverified address may have been set up by someone
+// else, their external logins are dropped and unlinked reports that.
+func resetCustomerPassword(token *mailToken, hashed string) (identity string, version int, unlinked bool, err error) {
+	unlock := storage.Locks.LockRecord(CustomersCollection, token.CustomerID)
+	defer unlock()
+
+	data, err := storage.Default.GetRecord(CustomersCollection, token.CustomerID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", 0, false, errInvalidMailToken
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	if !strings.EqualFold(customerEmail(data), token.Email) {
+		return "", 0, false, errInvalidMailToken
+	}
+
+	if verified, _ := data[verifiedField].(bool); !verified {
+		unlinked, err = unlinkCustomerOAuth(token.CustomerID)
+		if err != nil {
+			return "", 0, false, err
+		}
+	}
+
+	identity, _ = data["identity"].(string)
+	version = customerTokenVersion(data) + 1
+	data["password"] = hashed
+	data[tokenVersionField] = version
+	if err := storage.Default.PutRecord(CustomersCollection, token.CustomerID, data); err != nil {
+		return "", 0, false, err
+	}
+	return identity, version, unlinked, nil
+}
+
+// VerifyEmailRequestHandler mails a verification link to the email address
+// of the calling customer
+func VerifyEmailRequestHandler(c *gin.Context) {
+	identity := c.GetString("username")
+
+	unlock := storage.Locks.RLockCollection(CustomersCollection)
+	customer, err := findCustomer(identity)
+	unlock()
+	if errors.Is(err, errCustomerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load customers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	email := customerEmail(customer.Data)
+	if email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The account has no email address"})
+		return
+	}
+	if verified, _ := customer.Data[verifiedField].(bool); verified {
+		c.JSON(http.StatusConflict, gin.H{"error": "The email address is already verified"})
+		return
+	}
+
+	if err := sendCustomerMail(purposeVerifyEmail, customer, email, verifyEmailTTL); err != nil {
+		log.Printf("failed to send verification mail: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send mail"})
+		return
+	}
+
+	audit(c, EventVerifyEmail, identity, RoleCustomer, OutcomeRequested)
+	c.JSON(http.StatusAccepted, gin.H{"status": "A mail with a verification link was sent"})
+}
+
+// VerifyEmailConfirmHandler marks the email address as verified with the
+// token from the verification mail. Tokens sent to an address the customer
+// changed since don't work anymore.
+func VerifyEmailConfirmHandler(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token required"})
+		return
+	}
+
+	token, err := useMailToken(purposeVerifyEmail, req.Token)
+	if errors.Is(err, errInvalidMailToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load mail tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	unlock := storage.Locks.LockRecord(CustomersCollection, token.CustomerID)
+	defer unlock()
+
+	data, err := storage.Default.GetRecord(CustomersCollection, token.CustomerID)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && !strings.EqualFold(customerEmail(data), token.Email)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load customer: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	data[verifiedField] = true
+	if err := storage.Default.PutRecord(CustomersCollection, token.CustomerID, data); err != nil {
+		log.Printf("failed to save customer: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save user"})
+		return
+	}
+
+	identity, _ := data["identity"].(string)
+	audit(c, EventVerifyEmail, identity, RoleCustomer, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{"status": "verified", "email": token.Email})
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-database-json/mail"
+	"go-database-json/storage"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// captureMailer hands sent mails to the test
+type captureMailer chan mail.Message
+
+func (m captureMailer) Send(msg mail.Message) error {
+	m <- msg
+	return nil
+}
+
+func captureMails(t *testing.T) captureMailer {
+	t.Helper()
+	mails := make(captureMailer, 10)
+	previous := mail.Default
+	mail.Default = mails
+	t.Cleanup(func() { mail.Default = previous })
+	return mails
+}
+
+var mailTokenPattern = regexp.MustCompile(`token=([0-9a-f]+)`)
+
+// nextMail waits for a mail and returns the token of its link
+func (m captureMailer) nextMail(t *testing.T, to string) string {
+	t.Helper()
+	select {
+	case msg := <-m:
+		if msg.To != to {
+			t.Fatalf("mail to %s, want %s", msg.To, to)
+		}
+		match := mailTokenPattern.FindStringSubmatch(msg.Text)
+		if match == nil {
+			t.Fatalf("no token in mail: %s", msg.Text)
+		}
+		return match[1]
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no mail to %s", to)
+	}
+	return ""
+}
+
+func (m captureMailer) none(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-m:
+		t.Fatalf("unexpected mail to %s: %s", msg.To, msg.Subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// putCustomer stores a customer with a password and returns its record id
+func putCustomer(t *testing.T, identity, email, password string) string {
+	t.Helper()
+	hashed, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]interface{}{"identity": identity, "password": hashed}
+	if email != "" {
+		data["email"] = email
+	}
+	id := stampCustomer(data, identity)
+	if err := storage.Default.PutRecord(CustomersCollection, id, data); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestPasswordReset(t *testing.T) {
+	resetAuth(t)
+	mails := captureMails(t)
+	const oldPassword, newPassword = "Old!Passw0rd#long", "New!Passw0rd#long"
+	id := putCustomer(t, "alice", "alice@example.com", oldPassword)
+	putCustomer(t, "nomail", "", oldPassword)
+
+	r := newTestEngine(t)
+	r.POST("/reset", PasswordResetRequestHandler)
+	r.POST("/reset/confirm", PasswordResetConfirmHandler)
+
+	// the answer does not tell which accounts exist
+	var answer string
+	for _, login := range []string{"alice", "ALICE@example.com", "nobody", "nobody@example.com", "nomail"} {
+		w, _ := serve(r, testRequest{method: "POST", path: "/reset", body: `{"identity": "` + login + `"}`})
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("request for %s: %d %s", login, w.Code, w.Body)
+		}
+		if answer == "" {
+			answer = w.Body.String()
+		} else if w.Body.String() != answer {
+			t.Errorf("request for %s answered %s, not %s", login, w.Body, answer)
+		}
+	}
+	mails.nextMail(t, "alice@example.com")
+	token := mails.nextMail(t, "alice@example.com")
+	mails.none(t)
+
+	session, _, err := issueToken("alice", RoleCustomer, client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirm := func(token, password string) int {
+		w, _ := serve(r, testRequest{method: "POST", path: "/reset/confirm", body: fmt.Sprintf(`{"token": %q, "password": %q}`, token, password)})
+		return w.Code
+	}
+	if code := confirm(token, "short"); code != http.StatusBadRequest {
+		t.Fatalf("weak password: %d", code)
+	}
+	if code := confirm(token, newPassword); code != http.StatusOK {
+		t.Fatalf("confirm: %d", code)
+	}
+	if _, err := authenticateCustomer("alice", newPassword); err != nil {
+		t.Fatalf("login with new password: %v", err)
+	}
+	if _, err := verifyToken(session); err == nil {
+		t.Fatal("session survived the password reset")
+	}
+
+	// tokens work once
+	if code := confirm(token, oldPassword); code != http.StatusBadRequest {
+		t.Fatalf("reused token: %d", code)
+	}
+
+	// expired tokens don't work
+	expired, err := issueMailToken(purposePasswordReset, id, "alice@example.com", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := confirm(expired, oldPassword); code != http.StatusBadRequest {
+		t.Fatalf("expired token: %d", code)
+	}
+
+	// neither do tokens sent to an address the customer changed since
+	stale, err := issueMailToken(purposePasswordReset, id, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := storage.Default.GetRecord(CustomersCollection, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data["email"] = "alice@example.org"
+	if err := storage.Default.PutRecord(CustomersCollection, id, data); err != nil {
+		t.Fatal(err)
+	}
+	if code := confirm(stale, oldPassword); code != http.StatusBadRequest {
+		t.Fatalf("token for old address: %d", code)
+	}
+
+	// verification tokens are no reset tokens
+	verify, err := issueMailToken(purposeVerifyEmail, id, "alice@example.org", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := confirm(verify, oldPassword); code != http.StatusBadRequest {
+		t.Fatalf("verification token: %d", code)
+	}
+
+	if _, err := authenticateCustomer("alice", newPassword); err != nil {
+		t.Fatalf("password changed by a rejected token: %v", err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	resetAuth(t)
+	mails := captureMails(t)
+	id := putCustomer(t, "alice", "alice@example.com", "Old!Passw0rd#long")
+
+	r := newTestEngine(t)
+	r.POST("/verify", func(c *gin.Context) { c.Set("username", c.GetHeader("X-Test-User")) }, VerifyEmailRequestHandler)
+	r.POST("/verify/confirm", VerifyEmailConfirmHandler)
+	alice := map[string]string{"X-Test-User": "alice"}
+
+	verified := func() bool {
+		t.Helper()
+		data, err := storage.Default.GetRecord(CustomersCollection, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := data[verifiedField].(bool)
+		return value
+	}
+	confirm := func(token string) int {
+		w, _ := serve(r, testRequest{method: "POST", path: "/verify/confirm", body: `{"token": "` + token + `"}`})
+		return w.Code
+	}
+
+	if w, _ := serve(r, testRequest{method: "POST", path: "/verify", header: alice}); w.Code != http.StatusAccepted {
+		t.Fatalf("request: %d %s", w.Code, w.Body)
+	}
+	token := mails.nextMail(t, "alice@example.com")
+
+	// a second request replaces the first token
+	if w, _ := serve(r, testRequest{method: "POST", path: "/verify", header: alice}); w.Code != http.StatusAccepted {
+		t.Fatalf("second request: %d %s", w.Code, w.Body)
+	}
+	if code := confirm(token); code != http.StatusBadRequest {
+		t.Fatalf("replaced token: %d", code)
+	}
+	token = mails.nextMail(t, "alice@example.com")
+
+	if code := confirm(token); code != http.StatusOK || !verified() {
+		t.Fatalf("confirm: %d, verified %v", code, verified())
+	}
+	if code := confirm(token); code != http.StatusBadRequest {
+		t.Fatalf("reused token: %d", code)
+	}
+	if w, _ := serve(r, testRequest{method: "POST", path: "/verify", header: alice}); w.Code != http.StatusConflict {
+		t.Fatalf("already verified: %d", w.Code)
+	}
+
+	// a new address has to be verified again, old tokens don't do it
+	data, err := storage.Default.GetRecord(CustomersCollection, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data["email"] = "alice@example.org"
+	data[verifiedField] = false
+	if err := storage.Default.PutRecord(CustomersCollection, id, data); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := issueMailToken(purposeVerifyEmail, id, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := confirm(stale); code != http.StatusBadRequest || verified() {
+		t.Fatalf("token for old address: %d, verified %v", code, verified())
+	}
+
+	expired, err := issueMailToken(purposeVerifyEmail, id, "alice@example.org", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := confirm(expired); code != http.StatusBadRequest || verified() {
+		t.Fatalf("expired token: %d, verified %v", code, verified())
+	}
+	mails.none(t)
+}
@@ -0,0 +1,393 @@
+package auth
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go-database-json/config"
+	"go-database-json/storage"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errOAuthEmailTaken     = errors.New("email address belongs to another account")
+	errOAuthSignupDisabled = errors.New("signup with oauth provider disabled")
+)
+
+// OAuthProvidersHandler lists the providers customers can log in with
+func OAuthProvidersHandler(c *gin.Context) {
+	providers := []string{}
+	for name := range config.Current.OAuth.Providers {
+		providers = append(providers, name)
+	}
+	sort.Strings(providers)
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
+
+// OAuthStartHandler starts a login with a provider and returns the address
+// to send the customer to. When a customer is logged in, the provider is
+// linked to their account instead. The login is bound to the browser with
+// an HttpOnly cookie, the callback has to come with it.
+func OAuthStartHandler(c *gin.Context) {
+	p, ok := resolveOAuthProvider(c)
+	if !ok {
+		return
+	}
+
+	link := ""
+	if c.GetString("role") == RoleCustomer {
+		link = c.GetString("username")
+	}
+
+	// logins started in parallel in the same browser share the cookie
+	binding, err := c.Cookie(oauthBindingCookie)
+	if err != nil || len(binding) < 32 {
+		if binding, err = randomString(); err != nil {
+			log.Printf("failed to start oauth login: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
+	}
+
+	state, authURL, err := startOAuth(p, link, binding)
+	if err != nil {
+		log.Printf("failed to start oauth login: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	// the callback route is next to this one, the provider sends the
+	// customer back with a top-level GET, which SameSite=Lax allows
+	maxAge := int(time.Duration(config.Current.OAuth.StateTTL) / time.Second)
+	secure := strings.HasPrefix(p.RedirectURL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oauthBindingCookie, binding, maxAge, path.Dir(c.Request.URL.Path), "", secure, true)
+
+	c.JSON(http.StatusOK, gin.H{
+		"provider": p.Name,
+		"authUrl":  authURL,
+		"state":    state,
+	})
+}
+
+// OAuthCallbackHandler finishes a login with the code and state the
+// provider sent back. They are read from the query on GET, so the redirect
+// URL may point here directly, and from the JSON body on POST.
+func OAuthCallbackHandler(c *gin.Context) {
+	var req struct {
+		Code             string `json:"code" form:"code"`
+		State            string `json:"state" form:"state"`
+		Error            string `json:"error" form:"error"`
+		ErrorDescription string `json:"error_description" form:"error_description"`
+	}
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	name := c.Param("provider")
+
+	binding, _ := c.Cookie(oauthBindingCookie)
+	state, err := useOAuthState(req.State, name, binding)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired state, please start the login again"})
+		return
+	}
+	if req.Error != "" || req.Code == "" {
+		audit(c, EventOAuthLogin, state.Link, RoleCustomer, OutcomeFailure)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login was not completed", "reason": strings.TrimSpace(req.Error + " " + req.ErrorDescription)})
+		return
+	}
+
+	p, ok := resolveOAuthProvider(c)
+	if !ok {
+		return
+	}
+
+	tokens, err := exchangeOAuthCode(p, req.Code, state.Verifier)
+	if err == nil {
+		var external *externalIdentity
+		external, err = fetchExternalIdentity(p, tokens, state.Nonce)
+		if err == nil {
+			if state.Link != "" {
+				linkExternalIdentity(c, p, external, state.Link)
+			} else {
+				loginExternalIdentity(c, p, external)
+			}
+			return
+		}
+	}
+
+	log.Printf("oauth login with %s failed: %v", name, err)
+	audit(c, EventOAuthLogin, state.Link, RoleCustomer, OutcomeFailure)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Login with " + name + " failed"})
+}
+
+// resolveOAuthProvider looks up the provider of the route, answering with
+// an error if it can't be used
+func resolveOAuthProvider(c *gin.Context) (*oauthProvider, bool) {
+	p, err := lookupOAuthProvider(c.Param("provider"))
+	if errors.Is(err, errOAuthProviderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown provider"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("failed to set up oauth provider %s: %v", c.Param("provider"), err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Provider is not available"})
+		return nil, false
+	}
+	return p, true
+}
+
+// loginExternalIdentity issues a token for the customer linked to the
+// external identity, creating the account on first login if allowed
+func loginExternalIdentity(c *gin.Context, p *oauthProvider, external *externalIdentity) {
+	customer, created, err := customerForExternal(p, external)
+	switch {
+	case errors.Is(err, errOAuthEmailTaken):
+		audit(c, EventOAuthLogin, external.Email, RoleCustomer, OutcomeFailure)
+		c.JSON(http.StatusConflict, gin.H{"error": "An account with this email address exists, log in and link " + p.Name + " to it"})
+		return
+	case errors.Is(err, errOAuthSignupDisabled):
+		audit(c, EventOAuthLogin, external.Email, RoleCustomer, OutcomeFailure)
+		c.JSON(http.StatusForbidden, gin.H{"error": "No account is linked to this " + p.Name + " login"})
+		return
+	case err != nil:
+		log.Printf("failed to log in customer with %s: %v", p.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	identity, _ := customer.Data["identity"].(string)
+	token, _, err := issueToken(identity, RoleCustomer, clientOf(c))
+	if err != nil {
+		log.Printf("failed to issue token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	if created {
+		audit(c, EventRegister, identity, RoleCustomer, OutcomeSuccess)
+	}
+	audit(c, EventOAuthLogin, identity, RoleCustomer, OutcomeSuccess)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "ok",
+		"token":    token,
+		"user":     identity,
+		"id":       customer.ID,
+		"name":     customer.Data["name"],
+		"provider": p.Name,
+		"created":  created,
+	})
+}
+
+// customerForExternal finds the customer linked to an external identity.
+// Unknown identities are linked to the account with the same email address
+// if both sides verified it, otherwise a new account is created.
+func customerForExternal(p *oauthProvider, external *externalIdentity) (*storage.Record, bool, error) {
+	unlock := storage.Locks.LockCollection(CustomersCollection)
+	defer unlock()
+
+	link, err := findOAuthLink(p.Name, external.Subject)
+	if err == nil {
+		data, err := storage.Default.GetRecord(CustomersCollection, link.CustomerID)
+		if err == nil {
+			return &storage.Record{ID: link.CustomerID, Data: data}, false, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return nil, false, err
+		}
+		// the customer was deleted, the identity is treated as unknown
+		if err := unlinkOAuth(p.Name, external.Subject, ""); err != nil && !errors.Is(err, errOAuthLinkNotFound) {
+			return nil, false, err
+		}
+	} else if !errors.Is(err, errOAuthLinkNotFound) {
+		return nil, false, err
+	}
+
+	if external.Email != "" {
+		customer, err := findCustomerByEmail(external.Email)
+		if err == nil {
+			// linking on an unverified address would hand the account to
+			// whoever registered it first
+			if verified, _ := customer.Data[verifiedField].(bool); !verified || !external.EmailVerified {
+				return nil, false, errOAuthEmailTaken
+			}
+			if err := linkOAuth(oauthLink{Provider: p.Name, Subject: external.Subject, CustomerID: customer.ID, Email: external.Email}); err != nil {
+				return nil, false, err
+			}
+			return customer, false, nil
+		}
+		if !errors.Is(err, errCustomerNotFound) {
+			return nil, false, err
+		}
+	}
+
+	if !p.AllowSignup {
+		return nil, false, errOAuthSignupDisabled
+	}
+
+	customer, err := createExternalCustomer(p, external)
+	if err != nil {
+		return nil, false, err
+	}
+	return customer, true, nil
+}
+
+// createExternalCustomer creates an account without password for an
+// external identity. The caller must hold a lock on the customers collection.
+func createExternalCustomer(p *oauthProvider, external *externalIdentity) (*storage.Record, error) {
+	// an unverified address could belong to anybody, claiming it would keep
+	// its owner from registering
+	email := ""
+	if external.EmailVerified {
+		email = external.Email
+	}
+
+	// the email address is the identity unless it is taken
+	identity := email
+	if identity == "" {
+		identity = p.Name + "_" + external.Subject
+	} else if _, err := findCustomer(identity); err == nil {
+		identity = p.Name + "_" + external.Subject
+	} else if !errors.Is(err, errCustomerNotFound) {
+		return nil, err
+	}
+
+	body := map[string]interface{}{"identity": identity}
+	if email != "" {
+		body["email"] = email
+	}
+	if external.Name != "" {
+		body["name"] = external.Name
+	}
+
+	errs, err := validateProfile(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errOAuthSignupDisabled
+	}
+
+	id := stampCustomer(body, identity)
+	body[verifiedField] = email != ""
+
+	if err := storage.Default.PutRecord(CustomersCollection, id, body); err != nil {
+		return nil, err
+	}
+	if err := linkOAuth(oauthLink{Provider: p.Name, Subject: external.Subject, CustomerID: id, Email: email}); err != nil {
+		return nil, err
+	}
+	return &storage.Record{ID: id, Data: body}, nil
+}
+
+// linkExternalIdentity links an external identity to the customer who
+// started the login
+func linkExternalIdentity(c *gin.Context, p *oauthProvider, external *externalIdentity, identity string) {
+	unlock := storage.Locks.RLockCollection(CustomersCollection)
+	customer, err := findCustomer(identity)
+	unlock()
+	if errors.Is(err, errCustomerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load customers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	err = linkOAuth(oauthLink{Provider: p.Name, Subject: external.Subject, CustomerID: customer.ID, Email: external.Email})
+	if errors.Is(err, errOAuthLinked) {
+		audit(c, EventOAuthLink, identity, RoleCustomer, OutcomeFailure)
+		c.JSON(http.StatusConflict, gin.H{"error": "This " + p.Name + " login is linked to another account"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to save oauth link: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	audit(c, EventOAuthLink, identity, RoleCustomer, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{"status": "linked", "provider": p.Name, "user": identity})
+}
+
+// OAuthLinksHandler lists the providers linked to the calling customer
+func OAuthLinksHandler(c *gin.Context) {
+	customer, ok := currentCustomer(c)
+	if !ok {
+		return
+	}
+
+	links, err := customerOAuthLinks(customer.ID)
+	if err != nil {
+		log.Printf("failed to load oauth links: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	views := make([]gin.H, 0, len(links))
+	for _, link := range links {
+		views = append(views, gin.H{"provider": link.Provider, "email": link.Email, "created": link.Created})
+	}
+	c.JSON(http.StatusOK, gin.H{"links": views})
+}
+
+// OAuthUnlinkHandler removes a provider from the calling customer. The last
+// provider of an account without password can't be removed.
+func OAuthUnlinkHandler(c *gin.Context) {
+	customer, ok := currentCustomer(c)
+	if !ok {
+		return
+	}
+	provider := c.Param("provider")
+
+	links, err := customerOAuthLinks(customer.ID)
+	if err != nil {
+		log.Printf("failed to load oauth links: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if password, _ := customer.Data["password"].(string); password == "" && len(links) == 1 && links[0].Provider == provider {
+		c.JSON(http.StatusConflict, gin.H{"error": "Set a password before removing the last login provider"})
+		return
+	}
+
+	err = unlinkOAuth(provider, "", customer.ID)
+	if errors.Is(err, errOAuthLinkNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provider is not linked"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to save oauth links: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	audit(c, EventOAuthUnlink, c.GetString("username"), RoleCustomer, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{"status": "unlinked", "provider": provider})
+}
+
+// currentCustomer loads the record of the calling customer, answering with
+// an error if that fails
+func currentCustomer(c *gin.Context) (*storage.Record, bool) {
+	unlock := storage.Locks.RLockCollection(CustomersCollection)
+	customer, err := findCustomer(c.GetString("username"))
+	unlock()
+	if errors.Is(err, errCustomerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("failed to load customers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return nil, false
+	}
+	return customer, true
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"errors"
+	"go-database-json/storage"
+	"log"
+	"strings"
+	"time"
+)
+
+// CustomersCollection is the auth collection holding customer accounts.
+// Every customer is a record with an identity, a bcrypt password hash and
+// any custom profile fields allowed by the collection schema.
+const CustomersCollection = "customers"
+
+// CustomerAuthFields are kept out of record responses and can't be written
+// through the record handlers
+var CustomerAuthFields = []string{"password", tokenVersionField}
+
+// CustomerReadOnlyFields are shown in record responses but are only set by
+// the customer endpoints
+var CustomerReadOnlyFields = []string{verifiedField}
+
+var errCustomerNotFound = errors.New("customer not found")
+
+// ErrCustomerExists is returned when a customer would share the identity or
+// email address of another account
+var ErrCustomerExists = errors.New("identity or email address already in use")
+
+// EnsureCustomersCollection creates the customers collection on first start.
+// By default customers can view their own account and nothing else.
+func EnsureCustomersCollection() error {
+	unlock := storage.Locks.LockCollection(CustomersCollection)
+	defer unlock()
+
+	_, err := storage.Default.GetCollection(CustomersCollection)
+	if !errors.Is(err, storage.ErrCollectionNotFound) {
+		return err
+	}
+
+	return storage.Default.CreateCollection(CustomersCollection, map[string]interface{}{
+		"name":     CustomersCollection,
+		"type":     "auth",
+		"created":  time.Now().Format("02.01.2006 15:04"),
+		"viewRule": `@request.auth.role = "customer" && identity = @request.auth.id`,
+	})
+}
+
+// findCustomer looks up the customer record with the given identity.
+// The caller must hold a lock on the customers collection.
+func findCustomer(identity string) (*storage.Record, error) {
+	records, err := storage.Default.ListRecords(CustomersCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if value, _ := record.Data["identity"].(string); value == identity {
+			return &record, nil
+		}
+	}
+	return nil, errCustomerNotFound
+}
+
+// CheckUniqueCustomer returns ErrCustomerExists when a customer other than
+// the one with the given id has the identity or email address of data.
+// The caller must hold an exclusive lock on the customers collection.
+func CheckUniqueCustomer(id string, data map[string]interface{}) error {
+	identity, _ := data["identity"].(string)
+	email := customerEmail(data)
+	if identity == "" && email == "" {
+		return nil
+	}
+
+	records, err := storage.Default.ListRecords(CustomersCollection)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.ID == id {
+			continue
+		}
+		if other, _ := record.Data["identity"].(string); identity != "" && other == identity {
+			return ErrCustomerExists
+		}
+		if other := customerEmail(record.Data); email != "" && strings.EqualFold(other, email) {
+			return ErrCustomerExists
+		}
+	}
+	return nil
+}
+
+// authenticateCustomer verifies the credentials of a customer and replaces
+// a legacy plaintext password with its hash on the first successful login.
+// Locked accounts get errAccountLocked without the password being checked.
+func authenticateCustomer(identity, password string) (*storage.Record, error) {
+	if _, locked := lockedUntil(identity, RoleCustomer); locked {
+		return nil, errAccountLocked
+	}
+
+	unlock := storage.Locks.RLockCollection(CustomersCollection)
+	customer, err := findCustomer(identity)
+	unlock()
+	if errors.Is(err, errCustomerNotFound) {
+		recordFailure(identity, RoleCustomer)
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stored, _ := customer.Data["password"].(string)
+	valid, needsRehash := verifyPassword(stored, password)
+	if !valid {
+		recordFailure(identity, RoleCustomer)
+		return nil, errInvalidCredentials
+	}
+	resetFailures(identity, RoleCustomer)
+
+	if needsRehash {
+		if err := rehashCustomer(customer.ID, password); err != nil {
+			log.Printf("failed to rehash password of %s: %v", identity, err)
+		}
+	}
+	return customer, nil
+}
+
+func rehashCustomer(id, password string) error {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	unlock := storage.Locks.LockRecord(CustomersCollection, id)
+	defer unlock()
+
+	data, err := storage.Default.GetRecord(CustomersCollection, id)
+	if err != nil {
+		return err
+	}
+	data["password"] = hashed
+	return storage.Default.PutRecord(CustomersCollection, id, data)
+}
+
+// setCustomerPassword stores a new password hash and raises the token version
+func setCustomerPassword(identity, hashed string) (int, error) {
+	unlock := storage.Locks.RLockCollection(CustomersCollection)
+	customer, err := findCustomer(identity)
+	unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	unlock = storage.Locks.LockRecord(CustomersCollection, customer.ID)
+	defer unlock()
+
+	data, err := storage.Default.GetRecord(CustomersCollection, customer.ID)
+	if err != nil {
+		return 0, err
+	}
+	version := customerTokenVersion(data) + 1
+	data["password"] = hashed
+	data[tokenVersionField] = version
+	return version, storage.Default.PutRecord(CustomersCollection, customer.ID, data)
+}
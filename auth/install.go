@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+var ErrSuperUserExists = errors.New("superuser already exists")
+
+// ErrSuperUsersExist is returned by CreateSuperUser when it is not forced to
+// add another owner next to the existing superusers
+var ErrSuperUsersExist = errors.New("superusers already exist, use --force to add another owner")
+
+var (
+	// installToken allows creating the first superuser, it only lives in
+	// memory and is cleared once a superuser exists
+	installToken   string
+	installTokenMu sync.Mutex
+)
+
+// PrepareInstall returns a one-time installer token when no superuser exists
+// yet and an empty string otherwise. A new token is generated on every start.
+func PrepareInstall() (string, error) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		return "", err
+	}
+	if len(users) > 0 {
+		return "", nil
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	installTokenMu.Lock()
+	defer installTokenMu.Unlock()
+	installToken = hex.EncodeToString(buf)
+	return installToken, nil
+}
+
+func checkInstallToken(token string) bool {
+	installTokenMu.Lock()
+	defer installTokenMu.Unlock()
+
+	return installToken != "" && subtle.ConstantTimeCompare([]byte(installToken), []byte(token)) == 1
+}
+
+// CreateSuperUser adds an owner without any authentication, it backs the
+// "superuser create" command. Once superusers exist it only adds another
+// owner if force is set.
+func CreateSuperUser(identity, name, password string, force bool) error {
+	if identity == "" || password == "" {
+		return errors.New("identity and password required")
+	}
+	if err := checkPasswordPolicy(password); err != nil {
+		return err
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 && !force {
+		return ErrSuperUsersExist
+	}
+	return addSuperUser(users, identity, name, password, RoleOwner)
+}
+
+// addSuperUser hashes the password and saves the new superuser, usersMu must
+// be held. The installer token is used up by the first superuser.
+func addSuperUser(users map[string]SuperUser, identity, name, password, role string) error {
+	if _, exists := users[identity]; exists {
+		return ErrSuperUserExists
+	}
+
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	users[identity] = SuperUser{
+		Identity: identity,
+		Name:     name,
+		Password: hashed,
+		Role:     role,
+	}
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		return err
+	}
+
+	installTokenMu.Lock()
+	installToken = ""
+	installTokenMu.Unlock()
+	return nil
+}
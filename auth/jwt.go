@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/google/uuid"
+	"go-database-json/config"
+	"go-database-json/storage"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const revokedPath = "auth/revoked.json"
+
+// the header is the same for every token we sign
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type jwtClaims struct {
+	ID       string `json:"jti"`
+	Subject  string `json:"sub"`
+	Role     string `json:"role"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+	// Version is the token version of the user when the token was issued
+	Version int `json:"ver"`
+	// Account is the record id of a customer
+	Account string `json:"uid,omitempty"`
+}
+
+var (
+	// revokedTokens maps the ids of logged out signed tokens to their expiry,
+	// it is read from disk once and kept in memory
+	revokedTokens     map[string]time.Time
+	revokedTokensErr  error
+	revokedTokensOnce sync.Once
+	revokedTokensMu   sync.RWMutex
+)
+
+func signJWT(claims jwtClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + jwtSignature(unsigned), nil
+}
+
+func jwtSignature(unsigned string) string {
+	mac := hmac.New(sha256.New, []byte(config.Current.Sessions.JWT.Secret))
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseJWT checks the signature and expiry of a token and returns its claims
+func parseJWT(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	// only accept the header we sign with, this rules out "alg": "none"
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(header, &h) != nil || h.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	expected := jwtSignature(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if claims.Subject == "" || time.Now().Unix() >= claims.Expires {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
+
+// issueJWT signs a token for the user, nothing is written to disk
+func issueJWT(identity, role string) (string, Session, error) {
+	account, err := lookupTokenAccount(identity, role)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	session := Session{
+		ID:        uuid.NewString(),
+		Identity:  identity,
+		Role:      role,
+		Created:   now,
+		Expires:   now.Add(time.Duration(config.Current.Sessions.TTL)),
+		Stateless: true,
+	}
+
+	token, err := signJWT(jwtClaims{
+		ID:       session.ID,
+		Subject:  identity,
+		Role:     role,
+		IssuedAt: session.Created.Unix(),
+		Expires:  session.Expires.Unix(),
+		Version:  account.Version,
+		Account:  account.ID,
+	})
+	if err != nil {
+		return "", Session{}, err
+	}
+	return token, session, nil
+}
+
+// verifyJWT returns the session of a signed token. Tokens issued before the
+// last password change of the user carry an outdated version and are rejected,
+// as are tokens of deleted accounts.
+func verifyJWT(token string) (*Session, error) {
+	claims, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := lookupTokenAccount(claims.Subject, claims.Role)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Version != account.Version || claims.Account != account.ID {
+		return nil, errInvalidToken
+	}
+
+	revoked, err := isRevokedJWT(claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errInvalidToken
+	}
+
+	return &Session{
+		ID:        claims.ID,
+		Identity:  claims.Subject,
+		Role:      claims.Role,
+		Created:   time.Unix(claims.IssuedAt, 0).UTC(),
+		Expires:   time.Unix(claims.Expires, 0).UTC(),
+		Stateless: true,
+	}, nil
+}
+
+func loadRevokedTokens() error {
+	revokedTokensOnce.Do(func() {
+		revokedTokens = make(map[string]time.Time)
+		data, err := os.ReadFile(revokedPath)
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			revokedTokensErr = err
+			return
+		}
+		revokedTokensErr = json.Unmarshal(data, &revokedTokens)
+	})
+	return revokedTokensErr
+}
+
+func isRevokedJWT(id string) (bool, error) {
+	if err := loadRevokedTokens(); err != nil {
+		return false, err
+	}
+
+	revokedTokensMu.RLock()
+	defer revokedTokensMu.RUnlock()
+	_, ok := revokedTokens[id]
+	return ok, nil
+}
+
+// revokeJWT remembers a logged out signed token until it expires anyway
+func revokeJWT(session *Session) error {
+	if err := loadRevokedTokens(); err != nil {
+		return err
+	}
+
+	revokedTokensMu.Lock()
+	defer revokedTokensMu.Unlock()
+
+	now := time.Now()
+	for id, expires := range revokedTokens {
+		if !now.Before(expires) {
+			delete(revokedTokens, id)
+		}
+	}
+	revokedTokens[session.ID] = session.Expires
+
+	data, err := json.MarshalIndent(revokedTokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(revokedPath, data, 0644)
+}
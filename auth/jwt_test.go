@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"go-database-json/config"
+	"go-database-json/storage"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+func enableJWT(t *testing.T) {
+	t.Helper()
+	config.Current.Sessions.JWT = config.JWT{Enabled: true, Secret: testJWTSecret}
+	t.Cleanup(func() { config.Current = config.Default() })
+}
+
+// jwtPayload replaces the payload of a token, keeping header and signature
+func jwtPayload(t *testing.T, token string, change func(claims map[string]interface{})) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	change(claims)
+	payload, _ = json.Marshal(claims)
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+}
+
+func TestJWTSignature(t *testing.T) {
+	resetAuth(t)
+	enableJWT(t)
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+	putCustomer(t, "bob", "", "Str0ng!Passw0rd#x")
+
+	token, issued, err := issueToken("alice", RoleCustomer, client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(token, ".") != 2 || !issued.Stateless {
+		t.Fatalf("issued %q %+v", token, issued)
+	}
+	session, err := verifyToken(token)
+	if err != nil || session.Identity != "alice" || session.Role != RoleCustomer || session.ID != issued.ID {
+		t.Fatalf("verify: %+v %v", session, err)
+	}
+
+	config.Current.Sessions.JWT.Secret = strings.Repeat("x", 32)
+	foreign, _, err := issueToken("alice", RoleCustomer, client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Current.Sessions.JWT.Secret = testJWTSecret
+
+	parts := strings.Split(token, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other subject", jwtPayload(t, token, func(c map[string]interface{}) { c["sub"] = "bob" })},
+		{"other role", jwtPayload(t, token, func(c map[string]interface{}) { c["role"] = RoleSuperuser })},
+		{"longer expiry", jwtPayload(t, token, func(c map[string]interface{}) { c["exp"] = time.Now().Add(24 * time.Hour).Unix() })},
+		{"other secret", foreign},
+		{"alg none", none + "." + parts[1] + "."},
+		{"alg none with signature", none + "." + parts[1] + "." + parts[2]},
+		{"no signature", parts[0] + "." + parts[1] + "."},
+		{"two parts", parts[0] + "." + parts[1]},
+		{"four parts", token + "." + parts[2]},
+	}
+	for _, tt := range tests {
+		if _, err := verifyToken(tt.token); err != errInvalidToken {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// signed tokens are not accepted once they are switched off
+	config.Current.Sessions.JWT.Enabled = false
+	if _, err := verifyToken(token); err != errInvalidToken {
+		t.Errorf("with signed tokens disabled: %v", err)
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	resetAuth(t)
+	enableJWT(t)
+	id := putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		expires int64
+		valid   bool
+	}{
+		{"valid", now + 60, true},
+		{"expired", now - 1, false},
+		{"expires now", now, false},
+	}
+	for _, tt := range tests {
+		token, err := signJWT(jwtClaims{ID: tt.name, Subject: "alice", Role: RoleCustomer, IssuedAt: now - 3600, Expires: tt.expires, Account: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyToken(token); (err == nil) != tt.valid {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestJWTVersion(t *testing.T) {
+	resetAuth(t)
+	enableJWT(t)
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+	if err := CreateSuperUser("root", "Root", "Str0ng!Passw0rd#x", false); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestEngine(t)
+	r.POST("/password", RequireAuth(), ChangePasswordHandler)
+
+	for _, role := range []string{RoleCustomer, RoleSuperuser} {
+		identity := map[string]string{RoleCustomer: "alice", RoleSuperuser: "root"}[role]
+		old, _, err := issueToken(identity, role, client{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, _, _ := issueToken(identity, role, client{})
+		if _, err := verifyToken(old); err != nil {
+			t.Fatalf("%s before password change: %v", role, err)
+		}
+
+		w, _ := serve(r, testRequest{method: "POST", path: "/password", body: `{"password": "Str0ng!Passw0rd#x", "newPassword": "N3w!Passw0rd#long"}`, header: map[string]string{"Authorization": "Bearer " + old}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s password change: %d %s", role, w.Code, w.Body)
+		}
+
+		for _, token := range []string{old, other} {
+			if _, err := verifyToken(token); err != errInvalidToken {
+				t.Errorf("%s token from before the password change: %v", role, err)
+			}
+		}
+		fresh, _, err := issueToken(identity, role, client{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyToken(fresh); err != nil {
+			t.Errorf("%s token from after the password change: %v", role, err)
+		}
+	}
+}
+
+func TestJWTRevoked(t *testing.T) {
+	resetAuth(t)
+	enableJWT(t)
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+
+	r := newTestEngine(t)
+	r.POST("/logout", RequireAuth(), LogoutHandler)
+
+	token, _, _ := issueToken("alice", RoleCustomer, client{})
+	other, _, _ := issueToken("alice", RoleCustomer, client{})
+
+	w, _ := serve(r, testRequest{method: "POST", path: "/logout", header: map[string]string{"Authorization": "Bearer " + token}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("logout: %d %s", w.Code, w.Body)
+	}
+	if _, err := verifyToken(token); err != errInvalidToken {
+		t.Errorf("logged out token: %v", err)
+	}
+	if _, err := verifyToken(other); err != nil {
+		t.Errorf("other token: %v", err)
+	}
+
+	// the revoked list survives a restart
+	revokedTokensMu.Lock()
+	revokedTokensOnce = sync.Once{}
+	revokedTokens = nil
+	revokedTokensMu.Unlock()
+	if _, err := verifyToken(token); err != errInvalidToken {
+		t.Errorf("logged out token after reload: %v", err)
+	}
+}
+
+func TestDeletedAccountTokens(t *testing.T) {
+	for _, signed := range []bool{false, true} {
+		resetAuth(t)
+		if signed {
+			enableJWT(t)
+		}
+		id := putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+		token, _, err := issueToken("alice", RoleCustomer, client{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyToken(token); err != nil {
+			t.Fatalf("signed %v: before delete: %v", signed, err)
+		}
+
+		data, _ := storage.Default.GetRecord(CustomersCollection, id)
+		if err := storage.Default.DeleteRecord(CustomersCollection, id); err != nil {
+			t.Fatal(err)
+		}
+		ForgetCustomer(data)
+		if _, err := verifyToken(token); err != errInvalidToken {
+			t.Errorf("signed %v: token of deleted account: %v", signed, err)
+		}
+
+		// a new account with the same identity doesn't inherit the tokens
+		putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+		if _, err := verifyToken(token); err != errInvalidToken {
+			t.Errorf("signed %v: token of deleted account after new registration: %v", signed, err)
+		}
+	}
+
+	// stored sessions are checked against the account even if it vanished
+	// without being forgotten, like after a restart
+	resetAuth(t)
+	config.Current = config.Default()
+	id := putCustomer(t, "carol", "", "Str0ng!Passw0rd#x")
+	token, _, _ := issueToken("carol", RoleCustomer, client{})
+	storage.Default.DeleteRecord(CustomersCollection, id)
+	if _, err := verifyToken(token); err != errInvalidToken {
+		t.Errorf("stored session of vanished account: %v", err)
+	}
+}
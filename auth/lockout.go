@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go-database-json/config"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errAccountLocked = errors.New("account locked")
+
+type failedLogins struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+var (
+	// failures counts failed logins in a row per account. Identities without
+	// an account are counted as well, so a lockout reveals nothing.
+	failures   = make(map[string]*failedLogins)
+	failuresMu sync.Mutex
+)
+
+// lockedUntil reports whether an account is locked and until when
+func lockedUntil(identity, role string) (time.Time, bool) {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	f, ok := failures[accountKey(identity, role)]
+	if !ok || !time.Now().Before(f.lockedUntil) {
+		return time.Time{}, false
+	}
+	return f.lockedUntil, true
+}
+
+// recordFailure counts a failed login and locks the account once too many
+// failed in a row. Failures older than the lockout duration are forgotten.
+func recordFailure(identity, role string) {
+	lockout := config.Current.Lockout
+	if lockout.MaxFailures == 0 {
+		return
+	}
+	duration := time.Duration(lockout.Duration)
+
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	now := time.Now()
+	// drop counters nobody added to for a while, so the map can't grow forever
+	for key, f := range failures {
+		if now.Sub(f.lastFailure) > duration && !now.Before(f.lockedUntil) {
+			delete(failures, key)
+		}
+	}
+
+	key := accountKey(identity, role)
+	f, ok := failures[key]
+	if !ok {
+		f = &failedLogins{}
+		failures[key] = f
+	}
+	f.count++
+	f.lastFailure = now
+	if f.count >= lockout.MaxFailures {
+		f.lockedUntil = now.Add(duration)
+		f.count = 0
+	}
+}
+
+func resetFailures(identity, role string) {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	delete(failures, accountKey(identity, role))
+}
+
+// respondLocked answers a login attempt on a locked account
+func respondLocked(c *gin.Context, identity, role string) {
+	until, _ := lockedUntil(identity, role)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Account is temporarily locked after too many failed logins"})
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"go-database-json/config"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	resetAuth(t)
+	config.Current.Lockout = config.Lockout{MaxFailures: 3, Duration: config.Duration(time.Minute)}
+	t.Cleanup(func() { config.Current = config.Default() })
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+
+	r := newTestEngine(t)
+	r.POST("/login", CustomerHandler)
+	login := func(identity, password string) int {
+		w, _ := serve(r, testRequest{method: "POST", path: "/login", body: `{"identity": "` + identity + `", "password": "` + password + `"}`})
+		return w.Code
+	}
+	expect := func(step, identity, password string, code int) {
+		t.Helper()
+		if got := login(identity, password); got != code {
+			t.Fatalf("%s: got %d, want %d", step, got, code)
+		}
+	}
+
+	// a successful login starts the count again
+	expect("first failure", "alice", "wrong", http.StatusForbidden)
+	expect("second failure", "alice", "wrong", http.StatusForbidden)
+	expect("login", "alice", "Str0ng!Passw0rd#x", http.StatusOK)
+	expect("failure after login", "alice", "wrong", http.StatusForbidden)
+	expect("second failure after login", "alice", "wrong", http.StatusForbidden)
+	expect("third failure locks", "alice", "wrong", http.StatusForbidden)
+
+	// locked accounts don't get their password checked
+	w, _ := serve(r, testRequest{method: "POST", path: "/login", body: `{"identity": "alice", "password": "Str0ng!Passw0rd#x"}`})
+	retry, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	if w.Code != http.StatusTooManyRequests || retry < 1 || retry > 60 {
+		t.Fatalf("locked login: %d, retry after %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// other accounts are not affected
+	if _, locked := lockedUntil("alice", RoleSuperuser); locked {
+		t.Errorf("superuser alice locked by customer logins")
+	}
+
+	// the lock ends after the lockout duration
+	failuresMu.Lock()
+	failures[accountKey("alice", RoleCustomer)].lockedUntil = time.Now().Add(-time.Second)
+	failuresMu.Unlock()
+	expect("login after the lock", "alice", "Str0ng!Passw0rd#x", http.StatusOK)
+
+	// failures are forgotten once they are older than the lockout duration
+	expect("old failure", "alice", "wrong", http.StatusForbidden)
+	expect("old failure", "alice", "wrong", http.StatusForbidden)
+	failuresMu.Lock()
+	failures[accountKey("alice", RoleCustomer)].lastFailure = time.Now().Add(-2 * time.Minute)
+	failuresMu.Unlock()
+	expect("new failure", "alice", "wrong", http.StatusForbidden)
+	expect("not locked", "alice", "Str0ng!Passw0rd#x", http.StatusOK)
+
+	// unknown identities lock the same way, so a lock reveals nothing
+	for i := 0; i < 3; i++ {
+		expect("unknown identity", "ghost", "wrong", http.StatusForbidden)
+	}
+	expect("unknown identity locked", "ghost", "wrong", http.StatusTooManyRequests)
+
+	// without a maximum nothing is locked
+	config.Current.Lockout.MaxFailures = 0
+	for i := 0; i < 5; i++ {
+		expect("lockout disabled", "bob", "wrong", http.StatusForbidden)
+	}
+}
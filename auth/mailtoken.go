@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-database-json/storage"
+	"os"
+	"sync"
+	"time"
+)
+
+const mailTokensPath = "auth/mailtokens.json"
+
+// purposes of tokens sent by mail and how long they are valid
+const (
+	purposePasswordReset = "password_reset"
+	purposeVerifyEmail   = "verify_email"
+
+	passwordResetTTL = time.Hour
+	verifyEmailTTL   = 24 * time.Hour
+)
+
+var errInvalidMailToken = errors.New("invalid or expired token")
+
+// mailToken is a single-use token sent to a customer, only its SHA-256 hash
+// is stored
+type mailToken struct {
+	Hash       string    `json:"hash"`
+	Purpose    string    `json:"purpose"`
+	CustomerID string    `json:"customerId"`
+	Email      string    `json:"email"`
+	Expires    time.Time `json:"expires"`
+}
+
+var mailTokensMu sync.Mutex
+
+func loadMailTokens() ([]mailToken, error) {
+	data, err := os.ReadFile(mailTokensPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []mailToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func saveMailTokens(tokens []mailToken) error {
+	if tokens == nil {
+		tokens = []mailToken{}
+	}
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(mailTokensPath, data, 0600)
+}
+
+func hashMailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueMailToken creates a token for the customer. Older tokens of the same
+// purpose stop working.
+func issueMailToken(purpose, customerID, email string, ttl time.Duration) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	mailTokensMu.Lock()
+	defer mailTokensMu.Unlock()
+
+	tokens, err := loadMailTokens()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	kept := tokens[:0]
+	for _, t := range tokens {
+		if now.Before(t.Expires) && (t.Purpose != purpose || t.CustomerID != customerID) {
+			kept = append(kept, t)
+		}
+	}
+	kept = append(kept, mailToken{
+		Hash:       hashMailToken(token),
+		Purpose:    purpose,
+		CustomerID: customerID,
+		Email:      email,
+		Expires:    now.Add(ttl),
+	})
+
+	if err := saveMailTokens(kept); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// useMailToken consumes a token and returns what it was issued for
+func useMailToken(purpose, token string) (*mailToken, error) {
+	mailTokensMu.Lock()
+	defer mailTokensMu.Unlock()
+
+	tokens, err := loadMailTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hashMailToken(token)
+	now := time.Now().UTC()
+	for i, t := range tokens {
+		if t.Hash != hash || t.Purpose != purpose {
+			continue
+		}
+		if err := saveMailTokens(append(tokens[:i], tokens[i+1:]...)); err != nil {
+			return nil, err
+		}
+		if !now.Before(t.Expires) {
+			return nil, errInvalidMailToken
+		}
+		return &t, nil
+	}
+	return nil, errInvalidMailToken
+}
@@ -0,0 +1,497 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-database-json/config"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	mfaChallengeTTL = 5 * time.Minute
+	// maxMFAAttempts is how many wrong codes a challenge takes
+	maxMFAAttempts = 5
+)
+
+var (
+	errInvalidCode       = errors.New("invalid code")
+	errNoEnrollment      = errors.New("no mfa enrollment pending")
+	errEnrollmentDropped = errors.New("too many invalid codes, enrollment dropped")
+)
+
+// MFA is the second factor of a superuser. Secret is set on enrollment and
+// the MFA is enabled once a first code was confirmed.
+type MFA struct {
+	Secret  string `json:"secret"`
+	Enabled bool   `json:"enabled"`
+	// LastStep is the time step of the last accepted code
+	LastStep int64 `json:"lastStep,omitempty"`
+	// RecoveryCodes are bcrypt hashes, each code works once
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	// Attempts counts wrong codes while the enrollment is pending
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// mfaChallenge is handed out after the password step of a login. With an
+// enrollSecret the user has no MFA yet and enrolls by answering it.
+type mfaChallenge struct {
+	identity     string
+	expires      time.Time
+	attempts     int
+	enrollSecret string
+}
+
+var (
+	challenges   = make(map[string]*mfaChallenge)
+	challengesMu sync.Mutex
+)
+
+func newChallenge(identity, enrollSecret string) (string, time.Time, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(mfaChallengeTTL)
+
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+
+	// forget expired challenges, nobody can answer them anymore
+	for key, challenge := range challenges {
+		if time.Now().After(challenge.expires) {
+			delete(challenges, key)
+		}
+	}
+	challenges[token] = &mfaChallenge{identity: identity, expires: expires, enrollSecret: enrollSecret}
+	return token, expires, nil
+}
+
+func getChallenge(token string) (mfaChallenge, bool) {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+
+	challenge, ok := challenges[token]
+	if !ok || time.Now().After(challenge.expires) {
+		return mfaChallenge{}, false
+	}
+	return *challenge, true
+}
+
+// failChallenge counts a wrong answer, the challenge is dropped after too many
+func failChallenge(token string) {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+
+	if challenge, ok := challenges[token]; ok {
+		challenge.attempts++
+		if challenge.attempts >= maxMFAAttempts {
+			delete(challenges, token)
+		}
+	}
+}
+
+func dropChallenge(token string) {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	delete(challenges, token)
+}
+
+// verifySecondFactor checks a TOTP code or a recovery code of a superuser
+// and saves the used step or removes the used recovery code
+func verifySecondFactor(identity, code, recoveryCode string) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		return err
+	}
+	user, ok := users[identity]
+	if !ok || user.MFA == nil || !user.MFA.Enabled {
+		return errInvalidCode
+	}
+
+	switch {
+	case code != "":
+		step, ok := verifyTOTP(user.MFA.Secret, code, user.MFA.LastStep, time.Now())
+		if !ok {
+			return errInvalidCode
+		}
+		user.MFA.LastStep = step
+	case recoveryCode != "":
+		used := -1
+		for i, hashed := range user.MFA.RecoveryCodes {
+			if valid, _ := verifyPassword(hashed, recoveryCode); valid {
+				used = i
+				break
+			}
+		}
+		if used < 0 {
+			return errInvalidCode
+		}
+		user.MFA.RecoveryCodes = append(user.MFA.RecoveryCodes[:used], user.MFA.RecoveryCodes[used+1:]...)
+	default:
+		return errInvalidCode
+	}
+
+	users[identity] = user
+	return saveSuperUsers(superUsersPath, users)
+}
+
+// checkEnrollmentCode verifies a code for the pending enrollment of a
+// superuser and returns the secret and step. Wrong codes are counted, after
+// maxMFAAttempts of them the enrollment is dropped and has to be started
+// over with a new secret.
+func checkEnrollmentCode(identity, code string) (string, int64, error) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		return "", 0, err
+	}
+	user, ok := users[identity]
+	if !ok || user.MFA == nil || user.MFA.Enabled {
+		return "", 0, errNoEnrollment
+	}
+
+	if step, ok := verifyTOTP(user.MFA.Secret, code, 0, time.Now()); ok {
+		return user.MFA.Secret, step, nil
+	}
+
+	failure := errInvalidCode
+	user.MFA.Attempts++
+	if user.MFA.Attempts >= maxMFAAttempts {
+		user.MFA = nil
+		failure = errEnrollmentDropped
+	}
+	users[identity] = user
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		return "", 0, err
+	}
+	return "", 0, failure
+}
+
+// enableMFA turns on MFA with a confirmed secret and returns new recovery codes
+func enableMFA(identity, secret string, step int64) ([]string, error) {
+	plain, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := users[identity]
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	user.MFA = &MFA{
+		Secret:        secret,
+		Enabled:       true,
+		LastStep:      step,
+		RecoveryCodes: hashes,
+	}
+	users[identity] = user
+	return plain, saveSuperUsers(superUsersPath, users)
+}
+
+// startMFALogin answers the password step of a login when a second factor
+// is needed and returns false otherwise
+func startMFALogin(c *gin.Context, user *SuperUser) bool {
+	if user.MFA != nil && user.MFA.Enabled {
+		token, expires, err := newChallenge(user.Identity, "")
+		if err != nil {
+			log.Printf("failed to create mfa challenge: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return true
+		}
+		audit(c, EventLogin, user.Identity, RoleSuperuser, OutcomeChallenge)
+		c.JSON(http.StatusOK, gin.H{
+			"status":   "mfa_required",
+			"mfaToken": token,
+			"expires":  expires.UTC(),
+		})
+		return true
+	}
+
+	if config.Current.MFA.Policy != "required" {
+		return false
+	}
+
+	// MFA is required but not set up yet, the user enrolls by answering
+	// the challenge with a code for the new secret
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Printf("failed to create mfa secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return true
+	}
+	token, expires, err := newChallenge(user.Identity, secret)
+	if err != nil {
+		log.Printf("failed to create mfa challenge: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return true
+	}
+	audit(c, EventLogin, user.Identity, RoleSuperuser, OutcomeChallenge)
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "mfa_enrollment_required",
+		"mfaToken":   token,
+		"expires":    expires.UTC(),
+		"secret":     secret,
+		"otpauthUri": otpauthURI(config.Current.MFA.Issuer, user.Identity, secret),
+	})
+	return true
+}
+
+// MFALoginHandler completes a login with the mfaToken of the password step
+// and a TOTP code or a recovery code
+func MFALoginHandler(c *gin.Context) {
+	var req struct {
+		MFAToken     string `json:"mfaToken"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON: %v", err)})
+		return
+	}
+
+	challenge, ok := getChallenge(req.MFAToken)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "MFA challenge expired, please log in again"})
+		return
+	}
+	identity := challenge.identity
+
+	if _, locked := lockedUntil(identity, RoleSuperuser); locked {
+		audit(c, EventLogin, identity, RoleSuperuser, OutcomeLocked)
+		respondLocked(c, identity, RoleSuperuser)
+		return
+	}
+
+	var recoveryCodes []string
+	var err error
+	if challenge.enrollSecret != "" {
+		step, valid := verifyTOTP(challenge.enrollSecret, req.Code, 0, time.Now())
+		if valid {
+			recoveryCodes, err = enableMFA(identity, challenge.enrollSecret, step)
+		} else {
+			err = errInvalidCode
+		}
+	} else {
+		err = verifySecondFactor(identity, req.Code, req.RecoveryCode)
+	}
+	if errors.Is(err, errInvalidCode) {
+		failChallenge(req.MFAToken)
+		recordFailure(identity, RoleSuperuser)
+		audit(c, EventLogin, identity, RoleSuperuser, OutcomeFailure)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid code"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to verify mfa of %s: %v", identity, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	dropChallenge(req.MFAToken)
+	resetFailures(identity, RoleSuperuser)
+
+	user, ok, err := lookupSuperUser(identity)
+	if err != nil || !ok {
+		log.Printf("failed to load superuser %s: %v", identity, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	token, _, err := issueToken(user.Identity, RoleSuperuser, clientOf(c))
+	if err != nil {
+		log.Printf("failed to issue token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	audit(c, EventLogin, user.Identity, RoleSuperuser, OutcomeSuccess)
+	response := gin.H{
+		"status": "ok",
+		"token":  token,
+		"user":   user.Identity,
+		"name":   user.Name,
+	}
+	if recoveryCodes != nil {
+		response["recoveryCodes"] = recoveryCodes
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// MFAEnrollHandler creates a new TOTP secret for the caller. MFA is only
+// turned on once a code for it was confirmed with MFAConfirmHandler.
+func MFAEnrollHandler(c *gin.Context) {
+	identity := c.GetString("username")
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Printf("failed to create mfa secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		log.Printf("failed to load superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read users"})
+		return
+	}
+	user, ok := users[identity]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.MFA != nil && user.MFA.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA is already enabled"})
+		return
+	}
+
+	user.MFA = &MFA{Secret: secret}
+	users[identity] = user
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		log.Printf("failed to save superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secret,
+		"otpauthUri": otpauthURI(config.Current.MFA.Issuer, identity, secret),
+	})
+}
+
+// MFAConfirmHandler turns on MFA after checking a code for the enrolled
+// secret and returns the recovery codes. They are not shown again. After
+// too many wrong codes the enrollment is dropped.
+func MFAConfirmHandler(c *gin.Context) {
+	identity := c.GetString("username")
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON: %v", err)})
+		return
+	}
+
+	secret, step, err := checkEnrollmentCode(identity, req.Code)
+	if errors.Is(err, errNoEnrollment) {
+		c.JSON(http.StatusConflict, gin.H{"error": "No MFA enrollment pending"})
+		return
+	}
+	if errors.Is(err, errInvalidCode) || errors.Is(err, errEnrollmentDropped) {
+		audit(c, EventMFAEnroll, identity, RoleSuperuser, OutcomeFailure)
+		message := "Invalid code"
+		if errors.Is(err, errEnrollmentDropped) {
+			message = "Too many invalid codes, start the enrollment again"
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": message})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to verify mfa enrollment of %s: %v", identity, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read users"})
+		return
+	}
+
+	recoveryCodes, err := enableMFA(identity, secret, step)
+	if err != nil {
+		log.Printf("failed to enable mfa of %s: %v", identity, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save user"})
+		return
+	}
+
+	audit(c, EventMFAEnroll, identity, RoleSuperuser, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{
+		"status":        "enabled",
+		"recoveryCodes": recoveryCodes,
+	})
+}
+
+// MFADisableHandler turns off MFA of the caller, it takes the password and a
+// code or recovery code. Not possible while the policy requires MFA.
+func MFADisableHandler(c *gin.Context) {
+	identity := c.GetString("username")
+
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON: %v", err)})
+		return
+	}
+
+	if config.Current.MFA.Policy == "required" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "MFA is required for superusers"})
+		return
+	}
+
+	_, err := authenticateSuperUser(identity, req.Password)
+	if errors.Is(err, errAccountLocked) {
+		respondLocked(c, identity, RoleSuperuser)
+		return
+	}
+	if err == nil {
+		err = verifySecondFactor(identity, req.Code, req.RecoveryCode)
+		if errors.Is(err, errInvalidCode) {
+			recordFailure(identity, RoleSuperuser)
+		}
+	}
+	if errors.Is(err, errInvalidCredentials) || errors.Is(err, errInvalidCode) {
+		audit(c, EventMFADisable, identity, RoleSuperuser, OutcomeFailure)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid password or code"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to verify mfa of %s: %v", identity, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		log.Printf("failed to load superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read users"})
+		return
+	}
+	user, ok := users[identity]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	user.MFA = nil
+	users[identity] = user
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		log.Printf("failed to save superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save user"})
+		return
+	}
+
+	audit(c, EventMFADisable, identity, RoleSuperuser, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{"status": "disabled"})
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMFAConfirmAttempts(t *testing.T) {
+	resetAuth(t)
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]SuperUser{"root": {Identity: "root", MFA: &MFA{Secret: secret}}}
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestEngine(t)
+	r.Use(func(c *gin.Context) { c.Set("username", "root"); c.Set("role", RoleSuperuser) })
+	r.POST("/confirm", MFAConfirmHandler)
+
+	// a code of none of the accepted steps
+	valid := make(map[string]bool)
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew - 1; step <= current+totpSkew+1; step++ {
+		code, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid[code] = true
+	}
+	wrong := "000000"
+	for valid[wrong] {
+		wrong = wrong[1:] + "1"
+	}
+
+	for i := 1; i <= maxMFAAttempts; i++ {
+		w, body := serve(r, testRequest{method: "POST", path: "/confirm", body: `{"code": "` + wrong + `"}`})
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("attempt %d: %d %s", i, w.Code, w.Body)
+		}
+		if i == maxMFAAttempts && body["error"] != "Too many invalid codes, start the enrollment again" {
+			t.Fatalf("attempt %d: %v", i, body["error"])
+		}
+	}
+
+	// the secret is gone, even the right code does not enable it anymore
+	code, err := totpCode(secret, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := serve(r, testRequest{method: "POST", path: "/confirm", body: `{"code": "` + code + `"}`}); w.Code != http.StatusConflict {
+		t.Fatalf("after dropped enrollment: %d %s", w.Code, w.Body)
+	}
+	loaded, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded["root"].MFA != nil {
+		t.Fatalf("enrollment kept: %+v", loaded["root"].MFA)
+	}
+
+	// a new enrollment starts with a fresh count
+	users["root"] = SuperUser{Identity: "root", MFA: &MFA{Secret: secret}}
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := serve(r, testRequest{method: "POST", path: "/confirm", body: `{"code": "` + wrong + `"}`}); w.Code != http.StatusForbidden {
+		t.Fatalf("wrong code: %d %s", w.Code, w.Body)
+	}
+	w, body := serve(r, testRequest{method: "POST", path: "/confirm", body: `{"code": "` + code + `"}`})
+	if w.Code != http.StatusOK {
+		t.Fatalf("right code: %d %s", w.Code, w.Body)
+	}
+	if codes, _ := body["recoveryCodes"].([]interface{}); len(codes) != recoveryCodeCount {
+		t.Fatalf("recovery codes: %v", body["recoveryCodes"])
+	}
+	loaded, err = loadSuperUsers(superUsersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mfa := loaded["root"].MFA; mfa == nil || !mfa.Enabled || mfa.Attempts != 0 {
+		t.Fatalf("mfa after confirm: %+v", mfa)
+	}
+}
@@ -1,14 +1,10 @@
 package auth
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 )
 
@@ -19,60 +15,174 @@ type User struct {
 	Token    string `json:"token"`
 }
 
-func CheckAuth(c *gin.Context) (string, bool) {
-	users, err := loadUsers("auth/superusers.json")
-	if err != nil {
-		log.Printf("failed to load users: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-		return "", false
+// RequireAuth validates the bearer token issued by AdminHandler or
+// CustomerHandler and stores the caller in the context as "username" and
+// "role". Requests without a valid token are rejected with 401.
+//
+// Routes listed in public, written as "METHOD /full/route/:param", are let
+// through without a token but still get the caller set if one is presented.
+func RequireAuth(public ...string) gin.HandlerFunc {
+	skip := make(map[string]bool, len(public))
+	for _, route := range public {
+		skip[route] = true
 	}
 
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header missing"})
-		return "", false
-	}
+	return func(c *gin.Context) {
+		session, err := authenticate(c)
+		if err != nil {
+			log.Printf("failed to verify token: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
 
-	username, password, err := parseAuthHeader(authHeader)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		return "", false
+		if session == nil && !skip[c.Request.Method+" "+c.FullPath()] {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
 	}
+}
 
-	user, ok := users[username]
-	fmt.Println(user)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
-		return "", false
+// OptionalAuth sets the caller like RequireAuth but never rejects a request
+func OptionalAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := authenticate(c); err != nil {
+			log.Printf("failed to verify token: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
+		c.Next()
 	}
+}
 
-	// compare bcrypt hash
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
-		return "", false
+// authenticate resolves the bearer token or API key of the request. It
+// returns a nil session without error when no or an invalid token was
+// presented. Requests with an API key get a stateless session of role
+// RoleAPIKey and the key as "apiKey".
+func authenticate(c *gin.Context) (*Session, error) {
+	token := bearerToken(c.GetHeader("Authorization"))
+	if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+		token = apiKey
+	}
+	if token == "" {
+		return nil, nil
 	}
 
-	c.Set("username", user.Identity)
-	return user.Identity, true
-}
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		key, err := verifyAPIKey(token)
+		if errors.Is(err, errInvalidToken) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
 
-func loadUsers(path string) (map[string]User, error) {
-	bytes, err := os.ReadFile(path)
+		session := &Session{
+			ID:        key.ID,
+			Identity:  "apikey:" + key.Name,
+			Role:      RoleAPIKey,
+			Created:   key.Created,
+			Stateless: true,
+		}
+		c.Set("username", session.Identity)
+		c.Set("role", session.Role)
+		c.Set("session", session)
+		c.Set("apiKey", key)
+		return session, nil
+	}
+
+	session, err := verifyToken(token)
+	if errors.Is(err, errInvalidToken) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	users := make(map[string]User)
-	if err := json.Unmarshal(bytes, &users); err != nil {
-		return nil, err
+
+	c.Set("username", session.Identity)
+	c.Set("role", session.Role)
+	c.Set("session", session)
+	return session, nil
+}
+
+func bearerToken(header string) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// RequireSuperuser rejects callers not authenticated as superuser with 403.
+// It has to run after RequireAuth.
+func RequireSuperuser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("role") != RoleSuperuser {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Superuser access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireCustomer rejects callers not authenticated as customer with 403.
+// It has to run after RequireAuth.
+func RequireCustomer() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("role") != RoleCustomer {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Customer access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CheckAPIKeyScope rejects requests made with an API key outside of its
+// scope, or beyond the current permissions of the superuser who created the
+// key, with 403. It is meant for the record routes and has to run after
+// OptionalAuth or RequireAuth.
+func CheckAPIKeyScope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get("apiKey")
+		if !ok {
+			c.Next()
+			return
+		}
+
+		key := value.(*APIKey)
+		collection, operation := c.Param("collection"), recordOperation(c)
+		if !key.Scope.allows(collection, operation) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "The API key does not allow this request"})
+			return
+		}
+
+		allowed, err := key.creatorAllows(collection, operation)
+		if err != nil {
+			log.Printf("failed to load superusers: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
+		if !allowed {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "The creator of the API key is no longer allowed to do this"})
+			return
+		}
+		c.Next()
 	}
-	return users, nil
 }
 
-func parseAuthHeader(header string) (string, string, error) {
-	// Expect "username:password"
-	parts := strings.SplitN(header, ":", 2)
-	if len(parts) != 2 {
-		return "", "", errors.New("Invalid Authorization format. Expected username:password")
+func recordOperation(c *gin.Context) string {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		if c.Param("id") != "" {
+			return OperationView
+		}
+		return OperationList
+	case http.MethodPost:
+		return OperationCreate
+	case http.MethodDelete:
+		return OperationDelete
+	default:
+		return OperationUpdate
 	}
-	return parts[0], parts[1], nil
 }
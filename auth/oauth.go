@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-database-json/config"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errOAuthProviderNotFound = errors.New("oauth provider not found")
+	errInvalidOAuthState     = errors.New("invalid or expired oauth state")
+)
+
+// oauthPresets fill in what is known about common providers
+var oauthPresets = map[string]config.OAuthProvider{
+	"google": {
+		Issuer: "https://accounts.google.com",
+		Scopes: []string{"openid", "email", "profile"},
+	},
+	"gitlab": {
+		Issuer: "https://gitlab.com",
+		Scopes: []string{"openid", "email", "profile"},
+	},
+	// GitHub doesn't speak OpenID Connect, the account is read from its API
+	"github": {
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+	},
+}
+
+// oauthProvider is a configured provider with its endpoints resolved
+type oauthProvider struct {
+	Name string
+	config.OAuthProvider
+	// JWKSURL is set for OpenID Connect providers, their ID tokens are
+	// verified with the keys found there
+	JWKSURL string
+	// BasicAuth sends the client credentials in the Authorization header
+	// for providers that don't take them in the form
+	BasicAuth bool
+}
+
+// lookupOAuthProvider resolves a provider from the config, using the preset
+// and discovery for everything not set explicitly
+func lookupOAuthProvider(name string) (*oauthProvider, error) {
+	cfg, ok := config.Current.OAuth.Providers[name]
+	if !ok {
+		return nil, errOAuthProviderNotFound
+	}
+
+	p := &oauthProvider{Name: name, OAuthProvider: cfg}
+	if preset, ok := oauthPresets[cfg.Preset]; ok {
+		if p.Issuer == "" {
+			p.Issuer = preset.Issuer
+		}
+		if p.AuthURL == "" {
+			p.AuthURL = preset.AuthURL
+		}
+		if p.TokenURL == "" {
+			p.TokenURL = preset.TokenURL
+		}
+		if p.UserInfoURL == "" {
+			p.UserInfoURL = preset.UserInfoURL
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = preset.Scopes
+		}
+	}
+
+	if p.Issuer != "" {
+		doc, err := discover(p.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		if p.AuthURL == "" {
+			p.AuthURL = doc.AuthorizationEndpoint
+		}
+		if p.TokenURL == "" {
+			p.TokenURL = doc.TokenEndpoint
+		}
+		if p.UserInfoURL == "" {
+			p.UserInfoURL = doc.UserInfoEndpoint
+		}
+		p.JWKSURL = doc.JWKSURI
+		p.BasicAuth = len(doc.TokenAuthMethods) > 0 && !contains(doc.TokenAuthMethods, "client_secret_post")
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+	}
+	return p, nil
+}
+
+// oauthBindingCookie holds a random value of the browser that started a
+// login. The state only works together with it, so nobody can make a
+// victim finish a login or link started by somebody else.
+const oauthBindingCookie = "oauth_binding"
+
+// oauthState is a login waiting for the customer to come back from the
+// provider. States only live in memory, logins pending during a restart
+// have to be started again.
+type oauthState struct {
+	Provider string
+	// Verifier is the PKCE code verifier
+	Verifier string
+	Nonce    string
+	// Link is the customer who started the login to link the provider to
+	// their account, empty for logins
+	Link string
+	// Binding is the SHA-256 hash of the binding cookie
+	Binding string
+	Expires time.Time
+}
+
+func hashBinding(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+var (
+	oauthStates   = make(map[string]oauthState)
+	oauthStatesMu sync.Mutex
+)
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// startOAuth remembers a new login of the browser with the binding and
+// returns its state and the address the customer has to be sent to
+func startOAuth(p *oauthProvider, link, binding string) (string, string, error) {
+	state, errState := randomString()
+	verifier, errVerifier := randomString()
+	nonce, errNonce := randomString()
+	if err := errors.Join(errState, errVerifier, errNonce); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.JWKSURL != "" {
+		query.Set("nonce", nonce)
+	}
+
+	authURL := p.AuthURL
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + query.Encode()
+	} else {
+		authURL += "?" + query.Encode()
+	}
+
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+
+	now := time.Now()
+	for key, s := range oauthStates {
+		if !now.Before(s.Expires) {
+			delete(oauthStates, key)
+		}
+	}
+	oauthStates[state] = oauthState{
+		Provider: p.Name,
+		Verifier: verifier,
+		Nonce:    nonce,
+		Link:     link,
+		Binding:  hashBinding(binding),
+		Expires:  now.Add(time.Duration(config.Current.OAuth.StateTTL)),
+	}
+	return state, authURL, nil
+}
+
+// useOAuthState returns a pending login and forgets it, a state can only be
+// used once and only by the browser that started the login
+func useOAuthState(state, provider, binding string) (*oauthState, error) {
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+
+	s, ok := oauthStates[state]
+	if !ok {
+		return nil, errInvalidOAuthState
+	}
+	delete(oauthStates, state)
+	if s.Provider != provider || !time.Now().Before(s.Expires) {
+		return nil, errInvalidOAuthState
+	}
+	if binding == "" || subtle.ConstantTimeCompare([]byte(s.Binding), []byte(hashBinding(binding))) != 1 {
+		return nil, errInvalidOAuthState
+	}
+	return &s, nil
+}
+
+type oauthTokens struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchangeOAuthCode trades the authorization code for the tokens
+func exchangeOAuthCode(p *oauthProvider, code, verifier string) (*oauthTokens, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if !p.BasicAuth {
+		form.Set("client_id", p.ClientID)
+		if p.ClientSecret != "" {
+			form.Set("client_secret", p.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.BasicAuth {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tokens oauthTokens
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint answered %s: %w", resp.Status, err)
+	}
+	if tokens.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint answered %s without access token", resp.Status)
+	}
+	return &tokens, nil
+}
+
+// externalIdentity is the account of a customer at a provider
+type externalIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// fetchExternalIdentity reads the account from the ID token of OpenID
+// Connect providers and from the user info endpoint of others
+func fetchExternalIdentity(p *oauthProvider, tokens *oauthTokens, nonce string) (*externalIdentity, error) {
+	if p.JWKSURL != "" {
+		if tokens.IDToken == "" {
+			return nil, errInvalidIDToken
+		}
+		claims, err := verifyIDToken(tokens.IDToken, p.Issuer, p.JWKSURL, p.ClientID, nonce)
+		if err != nil {
+			return nil, err
+		}
+		return &externalIdentity{
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: isTrue(claims.EmailVerified),
+			Name:          claims.Name,
+		}, nil
+	}
+
+	header := http.Header{"Authorization": {"Bearer " + tokens.AccessToken}}
+	var info map[string]interface{}
+	if err := getJSON(p.UserInfoURL, header, &info); err != nil {
+		return nil, err
+	}
+
+	identity := &externalIdentity{}
+	identity.Email, _ = info["email"].(string)
+	identity.Name, _ = info["name"].(string)
+	identity.EmailVerified = isTrue(info["email_verified"])
+
+	switch p.Preset {
+	case "github":
+		// the numeric id is stable, the login can be renamed
+		if id, ok := info["id"].(float64); ok {
+			identity.Subject = strconv.FormatInt(int64(id), 10)
+		}
+		if identity.Name == "" {
+			identity.Name, _ = info["login"].(string)
+		}
+		identity.Email, identity.EmailVerified = githubPrimaryEmail(header)
+	default:
+		identity.Subject, _ = info["sub"].(string)
+	}
+
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("user info of %s has no subject", p.Name)
+	}
+	return identity, nil
+}
+
+// githubPrimaryEmail looks up the primary address, the one in the profile
+// is only the public one and may not be verified
+func githubPrimaryEmail(header http.Header) (string, bool) {
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON("https://api.github.com/user/emails", header, &emails); err != nil {
+		return "", false
+	}
+	for _, e := range emails {
+		if e.Primary {
+			return e.Email, e.Verified
+		}
+	}
+	return "", false
+}
+
+// isTrue reads boolean claims, some providers send them as strings
+func isTrue(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
@@ -0,0 +1,531 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-database-json/config"
+	"go-database-json/storage"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockProvider is an OpenID Connect provider with discovery, key set and
+// token endpoint. Codes are handed out by the test with grant.
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu        sync.Mutex
+	published map[string]crypto.Signer
+	jwksHits  int
+	grants    map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	idToken   string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	m := &mockProvider{t: t, published: make(map[string]crypto.Signer), grants: make(map[string]mockGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", m.serveJWKS)
+	mux.HandleFunc("/token", m.serveToken)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	config.Current.OAuth.Providers = map[string]config.OAuthProvider{
+		"mock": {Issuer: m.server.URL, ClientID: "client", ClientSecret: "secret", RedirectURL: "https://app.example.com/callback", AllowSignup: true},
+	}
+	t.Cleanup(func() { config.Current = config.Default() })
+	return m
+}
+
+func (m *mockProvider) publish(keys map[string]crypto.Signer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.published = keys
+}
+
+func (m *mockProvider) hits() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jwksHits
+}
+
+func (m *mockProvider) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jwksHits++
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	keys := []map[string]string{}
+	for kid, signer := range m.published {
+		switch key := signer.Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{"kid": kid, "kty": "RSA", "use": "sig", "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			keys = append(keys, map[string]string{"kid": kid, "kty": "EC", "crv": "P-256", "x": encode(key.X.FillBytes(make([]byte, 32))), "y": encode(key.Y.FillBytes(make([]byte, 32)))})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (m *mockProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	grant, ok := m.grants[r.PostForm.Get("code")]
+	delete(m.grants, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge ||
+		r.PostForm.Get("client_id") != "client" || r.PostForm.Get("client_secret") != "secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "id_token": grant.idToken})
+}
+
+// grant lets the token endpoint answer the code of a started login with
+// the ID token
+func (m *mockProvider) grant(code, authURL, idToken string) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.grants[code] = mockGrant{challenge: parsed.Query().Get("code_challenge"), idToken: idToken}
+}
+
+// claims returns valid ID token claims for a started login
+func (m *mockProvider) claims(authURL, subject, email string, verified bool) map[string]interface{} {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            m.server.URL,
+		"sub":            subject,
+		"aud":            "client",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          parsed.Query().Get("nonce"),
+		"email":          email,
+		"email_verified": verified,
+	}
+}
+
+// signToken encodes an ID token with alg in its header. It is signed with
+// key, except for "none" and "HS256" which uses the public key as secret.
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch {
+	case alg == "none":
+	case alg == "HS256":
+		mac := hmac.New(sha256.New, []byte(fmt.Sprint(key.Public())))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	default:
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+			break
+		}
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newOAuthEngine serves the OAuth routes, callers authenticate through the
+// X-Test-User header as customers
+func newOAuthEngine(t *testing.T) *gin.Engine {
+	r := newTestEngine(t)
+	r.Use(func(c *gin.Context) {
+		if user := c.GetHeader("X-Test-User"); user != "" {
+			c.Set("username", user)
+			c.Set("role", RoleCustomer)
+		}
+	})
+	r.GET("/oauth/:provider", OAuthStartHandler)
+	r.GET("/oauth/:provider/callback", OAuthCallbackHandler)
+	r.POST("/oauth/:provider/callback", OAuthCallbackHandler)
+	return r
+}
+
+// startLogin starts a login and returns the state, the binding cookie and
+// the address of the provider
+func startLogin(t *testing.T, r *gin.Engine, header map[string]string) (string, string, string) {
+	t.Helper()
+	w, body := serve(r, testRequest{method: "GET", path: "/oauth/mock", header: header})
+	if w.Code != http.StatusOK {
+		t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oauthBindingCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.Path != "/oauth" || cookie.SameSite != http.SameSiteLaxMode || !cookie.Secure {
+		t.Fatalf("binding cookie: %+v", cookie)
+	}
+	state, _ := body["state"].(string)
+	authURL, _ := body["authUrl"].(string)
+	return state, cookie.Name + "=" + cookie.Value, authURL
+}
+
+func callback(r *gin.Engine, code, state, cookie string) (int, map[string]interface{}) {
+	header := map[string]string{}
+	if cookie != "" {
+		header["Cookie"] = cookie
+	}
+	w, body := serve(r, testRequest{method: "GET", path: "/oauth/mock/callback?" + url.Values{"code": {code}, "state": {state}}.Encode(), header: header})
+	return w.Code, body
+}
+
+func TestOAuthIDToken(t *testing.T) {
+	resetAuth(t)
+	m := newMockProvider(t)
+	rsaKey, ecKey := newRSAKey(t), newECKey(t)
+	m.publish(map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey})
+	r := newOAuthEngine(t)
+
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		key    crypto.Signer
+		change func(claims map[string]interface{})
+		code   int
+	}{
+		{"RS256", "RS256", "rsa", rsaKey, nil, http.StatusOK},
+		{"ES256", "ES256", "ec", ecKey, nil, http.StatusOK},
+		{"several audiences with azp", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["aud"] = []string{"client", "other"}; c["azp"] = "client" }, http.StatusOK},
+		{"alg none", "none", "rsa", rsaKey, nil, http.StatusUnauthorized},
+		{"HS256 with the public key", "HS256", "rsa", rsaKey, nil, http.StatusUnauthorized},
+		{"RS256 header on EC key", "RS256", "ec", ecKey, nil, http.StatusUnauthorized},
+		{"signed by another key", "RS256", "rsa", newRSAKey(t), nil, http.StatusUnauthorized},
+		{"unknown key", "RS256", "other", rsaKey, nil, http.StatusUnauthorized},
+		{"wrong issuer", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, http.StatusUnauthorized},
+		{"wrong audience", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["aud"] = "other" }, http.StatusUnauthorized},
+		{"several audiences without azp", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["aud"] = []string{"client", "other"} }, http.StatusUnauthorized},
+		{"wrong azp", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["azp"] = "other" }, http.StatusUnauthorized},
+		{"wrong nonce", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["nonce"] = "other" }, http.StatusUnauthorized},
+		{"no nonce", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { delete(c, "nonce") }, http.StatusUnauthorized},
+		{"expired", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, http.StatusUnauthorized},
+		{"issued in the future", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() }, http.StatusUnauthorized},
+		{"no subject", "RS256", "rsa", rsaKey, func(c map[string]interface{}) { c["sub"] = "" }, http.StatusUnauthorized},
+	}
+
+	for i, tt := range tests {
+		state, cookie, authURL := startLogin(t, r, nil)
+		claims := m.claims(authURL, "subject-1", "", false)
+		if tt.change != nil {
+			tt.change(claims)
+		}
+		code := fmt.Sprintf("code-%d", i)
+		m.grant(code, authURL, signToken(t, tt.alg, tt.kid, tt.key, claims))
+
+		status, body := callback(r, code, state, cookie)
+		if status != tt.code {
+			t.Errorf("%s: got %d, want %d: %v", tt.name, status, tt.code, body)
+		}
+		if status == http.StatusOK && body["token"] == "" {
+			t.Errorf("%s: no token issued", tt.name)
+		}
+	}
+}
+
+func TestOAuthKeyRotation(t *testing.T) {
+	resetAuth(t)
+	m := newMockProvider(t)
+	oldKey, newKey := newRSAKey(t), newRSAKey(t)
+	m.publish(map[string]crypto.Signer{"old": oldKey})
+	r := newOAuthEngine(t)
+
+	login := func(kid string, key crypto.Signer) int {
+		t.Helper()
+		state, cookie, authURL := startLogin(t, r, nil)
+		m.grant("code", authURL, signToken(t, "RS256", kid, key, m.claims(authURL, "subject-1", "", false)))
+		status, _ := callback(r, "code", state, cookie)
+		return status
+	}
+
+	if status := login("old", oldKey); status != http.StatusOK || m.hits() != 1 {
+		t.Fatalf("old key: %d after %d fetches", status, m.hits())
+	}
+
+	// unknown key ids don't make every request fetch the keys again
+	m.publish(map[string]crypto.Signer{"new": newKey})
+	if status := login("new", newKey); status != http.StatusUnauthorized || m.hits() != 1 {
+		t.Fatalf("new key right after a fetch: %d after %d fetches", status, m.hits())
+	}
+
+	keySetsMu.Lock()
+	keySets[m.server.URL+"/jwks"].fetched = time.Now().Add(-2 * jwksRefetchInterval)
+	keySetsMu.Unlock()
+
+	if status := login("new", newKey); status != http.StatusOK || m.hits() != 2 {
+		t.Fatalf("rotated key: %d after %d fetches", status, m.hits())
+	}
+	if status := login("old", oldKey); status != http.StatusUnauthorized {
+		t.Fatalf("retired key: %d", status)
+	}
+}
+
+func TestOAuthState(t *testing.T) {
+	resetAuth(t)
+	m := newMockProvider(t)
+	key := newRSAKey(t)
+	m.publish(map[string]crypto.Signer{"rsa": key})
+	r := newOAuthEngine(t)
+
+	grant := func(code, authURL string) {
+		m.grant(code, authURL, signToken(t, "RS256", "rsa", key, m.claims(authURL, "subject-1", "", false)))
+	}
+
+	// a state works once
+	state, cookie, authURL := startLogin(t, r, nil)
+	grant("first", authURL)
+	if status, body := callback(r, "first", state, cookie); status != http.StatusOK {
+		t.Fatalf("first use: %d %v", status, body)
+	}
+	grant("again", authURL)
+	if status, _ := callback(r, "again", state, cookie); status != http.StatusBadRequest {
+		t.Fatalf("reused state: %d", status)
+	}
+
+	// and only in the browser that started the login
+	state, _, authURL = startLogin(t, r, nil)
+	grant("no-cookie", authURL)
+	if status, _ := callback(r, "no-cookie", state, ""); status != http.StatusBadRequest {
+		t.Fatalf("without cookie: %d", status)
+	}
+
+	attackerState, _, authURL := startLogin(t, r, nil)
+	_, victimCookie, _ := startLogin(t, r, nil)
+	grant("foreign", authURL)
+	if status, _ := callback(r, "foreign", attackerState, victimCookie); status != http.StatusBadRequest {
+		t.Fatalf("state of another browser: %d", status)
+	}
+
+	// logins started in parallel in the same browser keep working
+	first, cookie, firstURL := startLogin(t, r, nil)
+	second, _, secondURL := startLogin(t, r, map[string]string{"Cookie": cookie})
+	grant("parallel-1", firstURL)
+	grant("parallel-2", secondURL)
+	for _, login := range []struct{ code, state string }{{"parallel-2", second}, {"parallel-1", first}} {
+		if status, body := callback(r, login.code, login.state, cookie); status != http.StatusOK {
+			t.Fatalf("parallel login %s: %d %v", login.code, status, body)
+		}
+	}
+
+	// linking needs the browser of the customer as well
+	putCustomer(t, "victim", "victim@example.com", "Str0ng!Passw0rd#x")
+	state, _, authURL = startLogin(t, r, map[string]string{"X-Test-User": "victim"})
+	m.grant("link", authURL, signToken(t, "RS256", "rsa", key, m.claims(authURL, "attacker", "", false)))
+	if status, _ := callback(r, "link", state, victimCookie); status != http.StatusBadRequest {
+		t.Fatalf("link from another browser: %d", status)
+	}
+	state, cookie, authURL = startLogin(t, r, map[string]string{"X-Test-User": "victim"})
+	m.grant("link", authURL, signToken(t, "RS256", "rsa", key, m.claims(authURL, "subject-2", "", false)))
+	if status, body := callback(r, "link", state, cookie); status != http.StatusOK || body["status"] != "linked" {
+		t.Fatalf("link: %d %v", status, body)
+	}
+}
+
+func TestOAuthEmailLinking(t *testing.T) {
+	resetAuth(t)
+	m := newMockProvider(t)
+	key := newRSAKey(t)
+	m.publish(map[string]crypto.Signer{"rsa": key})
+	r := newOAuthEngine(t)
+
+	verifiedID := putCustomer(t, "ann", "ann@example.com", "Str0ng!Passw0rd#x")
+	data, err := storage.Default.GetRecord(CustomersCollection, verifiedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[verifiedField] = true
+	if err := storage.Default.PutRecord(CustomersCollection, verifiedID, data); err != nil {
+		t.Fatal(err)
+	}
+	putCustomer(t, "bob", "bob@example.com", "Str0ng!Passw0rd#x")
+
+	tests := []struct {
+		name     string
+		subject  string
+		email    string
+		verified bool
+		code     int
+		id       string
+	}{
+		{"unverified at the provider", "s1", "ANN@example.com", false, http.StatusConflict, ""},
+		{"unverified here", "s2", "bob@example.com", true, http.StatusConflict, ""},
+		{"verified on both sides", "s3", "ANN@example.com", true, http.StatusOK, verifiedID},
+		{"linked before", "s3", "changed@example.com", false, http.StatusOK, verifiedID},
+		{"new address", "s4", "new@example.com", true, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		state, cookie, authURL := startLogin(t, r, nil)
+		m.grant("code", authURL, signToken(t, "RS256", "rsa", key, m.claims(authURL, tt.subject, tt.email, tt.verified)))
+		status, body := callback(r, "code", state, cookie)
+		if status != tt.code {
+			t.Errorf("%s: got %d, want %d: %v", tt.name, status, tt.code, body)
+			continue
+		}
+		if tt.id != "" && body["id"] != tt.id {
+			t.Errorf("%s: logged in as %v, want %s", tt.name, body["id"], tt.id)
+		}
+		if tt.id == "" && status == http.StatusOK && (body["id"] == verifiedID || body["user"] != tt.email) {
+			t.Errorf("%s: got account %v (%v)", tt.name, body["id"], body["user"])
+		}
+	}
+
+	// conflicts don't leave links behind
+	links, err := loadOAuthLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	for _, link := range links {
+		subjects = append(subjects, link.Subject)
+	}
+	if strings.Join(subjects, ",") != "s3,s4" {
+		t.Errorf("links: %v", subjects)
+	}
+}
+
+func TestOAuthUnverifiedEmailTakeover(t *testing.T) {
+	resetAuth(t)
+	mails := captureMails(t)
+	m := newMockProvider(t)
+	key := newRSAKey(t)
+	m.publish(map[string]crypto.Signer{"rsa": key})
+	r := newOAuthEngine(t)
+	r.POST("/register", CustomerRegisterHandler)
+	r.POST("/reset", PasswordResetRequestHandler)
+	r.POST("/reset/confirm", PasswordResetConfirmHandler)
+
+	login := func(subject, email string, header map[string]string) (int, map[string]interface{}) {
+		t.Helper()
+		state, cookie, authURL := startLogin(t, r, header)
+		m.grant("code", authURL, signToken(t, "RS256", "rsa", key, m.claims(authURL, subject, email, false)))
+		return callback(r, "code", state, cookie)
+	}
+
+	// a sign up with somebody else's unverified address doesn't claim it
+	status, body := login("attacker", "victim@example.com", nil)
+	if status != http.StatusOK || body["user"] != "mock_attacker" {
+		t.Fatalf("sign up: %d %v", status, body)
+	}
+	data, err := storage.Default.GetRecord(CustomersCollection, body["id"].(string))
+	if err != nil || data["email"] != nil || data[verifiedField] != false {
+		t.Fatalf("created account %v: %v", data, err)
+	}
+	w, _ := serve(r, testRequest{method: "POST", path: "/register", body: `{"identity": "victim", "email": "victim@example.com", "password": "Str0ng!Passw0rd#x"}`})
+	if w.Code != http.StatusCreated && w.Code != http.StatusOK {
+		t.Fatalf("victim registration: %d %s", w.Code, w.Body)
+	}
+	mails.nextMail(t, "victim@example.com")
+
+	// an account registered on an unverified address loses the external
+	// logins of whoever set it up once its owner resets the password
+	squatted := putCustomer(t, "squatter", "owner@example.com", "Str0ng!Passw0rd#x")
+	if status, body := login("squatter", "", map[string]string{"X-Test-User": "squatter"}); status != http.StatusOK || body["status"] != "linked" {
+		t.Fatalf("link: %d %v", status, body)
+	}
+
+	serve(r, testRequest{method: "POST", path: "/reset", body: `{"identity": "owner@example.com"}`})
+	token := mails.nextMail(t, "owner@example.com")
+	w, _ = serve(r, testRequest{method: "POST", path: "/reset/confirm", body: fmt.Sprintf(`{"token": %q, "password": "An0ther!Passw0rd#"}`, token)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("reset: %d %s", w.Code, w.Body)
+	}
+
+	if links, err := customerOAuthLinks(squatted); err != nil || len(links) != 0 {
+		t.Errorf("links after reset: %v %v", links, err)
+	}
+	if status, body := login("squatter", "", nil); status != http.StatusOK || body["id"] == squatted {
+		t.Errorf("login after reset: %d %v", status, body)
+	}
+
+	// verified accounts keep their links
+	kept := putCustomer(t, "kept", "kept@example.com", "Str0ng!Passw0rd#x")
+	data, _ = storage.Default.GetRecord(CustomersCollection, kept)
+	data[verifiedField] = true
+	storage.Default.PutRecord(CustomersCollection, kept, data)
+	login("kept", "", map[string]string{"X-Test-User": "kept"})
+
+	serve(r, testRequest{method: "POST", path: "/reset", body: `{"identity": "kept"}`})
+	token = mails.nextMail(t, "kept@example.com")
+	serve(r, testRequest{method: "POST", path: "/reset/confirm", body: fmt.Sprintf(`{"token": %q, "password": "An0ther!Passw0rd#"}`, token)})
+	if links, err := customerOAuthLinks(kept); err != nil || len(links) != 1 {
+		t.Errorf("links of verified account after reset: %v %v", links, err)
+	}
+}
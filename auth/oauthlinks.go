@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"go-database-json/storage"
+	"os"
+	"sync"
+	"time"
+)
+
+const oauthLinksPath = "auth/oauthlinks.json"
+
+var (
+	errOAuthLinkNotFound = errors.New("oauth link not found")
+	errOAuthLinked       = errors.New("external identity is linked to another customer")
+)
+
+// oauthLink ties the account of a customer at a provider to their customer
+// record. A customer has at most one link per provider.
+type oauthLink struct {
+	Provider   string    `json:"provider"`
+	Subject    string    `json:"subject"`
+	CustomerID string    `json:"customerId"`
+	Email      string    `json:"email"`
+	Created    time.Time `json:"created"`
+}
+
+// oauthLinksMu guards read-modify-write cycles on the link store
+var oauthLinksMu sync.Mutex
+
+func loadOAuthLinks() ([]oauthLink, error) {
+	data, err := os.ReadFile(oauthLinksPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var links []oauthLink
+	if err := json.Unmarshal(data, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func saveOAuthLinks(links []oauthLink) error {
+	if links == nil {
+		links = []oauthLink{}
+	}
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(oauthLinksPath, data, 0600)
+}
+
+// findOAuthLink returns the link of an external identity
+func findOAuthLink(provider, subject string) (*oauthLink, error) {
+	links, err := loadOAuthLinks()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if link.Provider == provider && link.Subject == subject {
+			return &link, nil
+		}
+	}
+	return nil, errOAuthLinkNotFound
+}
+
+// customerOAuthLinks returns the links of a customer
+func customerOAuthLinks(customerID string) ([]oauthLink, error) {
+	links, err := loadOAuthLinks()
+	if err != nil {
+		return nil, err
+	}
+	owned := []oauthLink{}
+	for _, link := range links {
+		if link.CustomerID == customerID {
+			owned = append(owned, link)
+		}
+	}
+	return owned, nil
+}
+
+// linkOAuth stores a link, replacing an older link of the customer to the
+// same provider
+func linkOAuth(link oauthLink) error {
+	oauthLinksMu.Lock()
+	defer oauthLinksMu.Unlock()
+
+	links, err := loadOAuthLinks()
+	if err != nil {
+		return err
+	}
+
+	kept := links[:0]
+	for _, l := range links {
+		if l.Provider == link.Provider && l.Subject == link.Subject && l.CustomerID != link.CustomerID {
+			return errOAuthLinked
+		}
+		if l.Provider == link.Provider && l.CustomerID == link.CustomerID {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	link.Created = time.Now().UTC()
+	return saveOAuthLinks(append(kept, link))
+}
+
+// unlinkOAuth removes the links of a customer to a provider, an empty
+// customer id removes a link regardless of whom it belongs to
+func unlinkOAuth(provider, subject, customerID string) error {
+	oauthLinksMu.Lock()
+	defer oauthLinksMu.Unlock()
+
+	links, err := loadOAuthLinks()
+	if err != nil {
+		return err
+	}
+
+	kept := links[:0]
+	for _, l := range links {
+		if l.Provider == provider && (subject == "" || l.Subject == subject) && (customerID == "" || l.CustomerID == customerID) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	if len(kept) == len(links) {
+		return errOAuthLinkNotFound
+	}
+	return saveOAuthLinks(kept)
+}
+
+// unlinkCustomerOAuth removes every link of a customer and reports whether
+// there were any
+func unlinkCustomerOAuth(customerID string) (bool, error) {
+	oauthLinksMu.Lock()
+	defer oauthLinksMu.Unlock()
+
+	links, err := loadOAuthLinks()
+	if err != nil {
+		return false, err
+	}
+
+	kept := links[:0]
+	for _, l := range links {
+		if l.CustomerID != customerID {
+			kept = append(kept, l)
+		}
+	}
+	if len(kept) == len(links) {
+		return false, nil
+	}
+	return true, saveOAuthLinks(kept)
+}
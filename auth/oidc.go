@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// discoveryTTL is how long discovery documents are cached
+	discoveryTTL = 24 * time.Hour
+	// jwksRefetchInterval limits how often keys are fetched for unknown key ids
+	jwksRefetchInterval = time.Minute
+	// idTokenLeeway allows for clocks of providers running a bit off
+	idTokenLeeway = time.Minute
+)
+
+var errInvalidIDToken = errors.New("invalid id token")
+
+// oauthHTTPClient talks to the providers
+var oauthHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcDiscovery is the part of the OpenID Connect discovery document we use
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserInfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+
+	fetched time.Time
+}
+
+type jwks struct {
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var (
+	discoveries   = make(map[string]*oidcDiscovery)
+	discoveriesMu sync.Mutex
+
+	keySets   = make(map[string]*jwks)
+	keySetsMu sync.Mutex
+)
+
+func getJSON(url string, header http.Header, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches the discovery document of an issuer
+func discover(issuer string) (*oidcDiscovery, error) {
+	discoveriesMu.Lock()
+	defer discoveriesMu.Unlock()
+
+	if doc, ok := discoveries[issuer]; ok && time.Since(doc.fetched) < discoveryTTL {
+		return doc, nil
+	}
+
+	var doc oidcDiscovery
+	if err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil, &doc); err != nil {
+		return nil, err
+	}
+	// the issuer has to match exactly, or a provider could speak for another
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document of %s names issuer %s", issuer, doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s is missing endpoints", issuer)
+	}
+	doc.fetched = time.Now()
+	discoveries[issuer] = &doc
+	return &doc, nil
+}
+
+// signingKey returns the key with the given id from a key set, fetching the
+// set again when the provider rotated its keys
+func signingKey(url, kid string) (crypto.PublicKey, error) {
+	keySetsMu.Lock()
+	defer keySetsMu.Unlock()
+
+	set, ok := keySets[url]
+	if ok {
+		if key, ok := set.keys[kid]; ok {
+			return key, nil
+		}
+		if time.Since(set.fetched) < jwksRefetchInterval {
+			return nil, errInvalidIDToken
+		}
+	}
+
+	var doc struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(url, nil, &doc); err != nil {
+		return nil, err
+	}
+
+	set = &jwks{keys: make(map[string]crypto.PublicKey), fetched: time.Now()}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			set.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil || k.Crv != "P-256" {
+				continue
+			}
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !key.Curve.IsOnCurve(key.X, key.Y) {
+				continue
+			}
+			set.keys[k.Kid] = key
+		}
+	}
+	keySets[url] = set
+
+	key, ok := set.keys[kid]
+	if !ok {
+		return nil, errInvalidIDToken
+	}
+	return key, nil
+}
+
+// idTokenClaims are the claims of an ID token we check or use
+type idTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	AuthorizedBy  string          `json:"azp"`
+	Expires       int64           `json:"exp"`
+	IssuedAt      int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified interface{}     `json:"email_verified"`
+	Name          string          `json:"name"`
+}
+
+func (c idTokenClaims) audiences() []string {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return []string{single}
+	}
+	var list []string
+	json.Unmarshal(c.Audience, &list)
+	return list
+}
+
+// verifyIDToken checks the signature and claims of an ID token. Only RS256
+// and ES256 are accepted, which rules out "none" and keys used as HMAC
+// secrets.
+func verifyIDToken(token, issuer, jwksURL, clientID, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidIDToken
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if json.Unmarshal(header, &h) != nil || (h.Alg != "RS256" && h.Alg != "ES256") {
+		return nil, errInvalidIDToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+
+	key, err := signingKey(jwksURL, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if h.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errInvalidIDToken
+		}
+	case *ecdsa.PublicKey:
+		if h.Alg != "ES256" || len(signature) != 64 {
+			return nil, errInvalidIDToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, errInvalidIDToken
+		}
+	default:
+		return nil, errInvalidIDToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidIDToken
+	}
+
+	now := time.Now()
+	audiences := claims.audiences()
+	switch {
+	case claims.Issuer != issuer, claims.Subject == "", claims.Nonce != nonce:
+		return nil, errInvalidIDToken
+	case !contains(audiences, clientID):
+		return nil, errInvalidIDToken
+	case (len(audiences) > 1 || claims.AuthorizedBy != "") && claims.AuthorizedBy != clientID:
+		return nil, errInvalidIDToken
+	case !now.Before(time.Unix(claims.Expires, 0).Add(idTokenLeeway)):
+		return nil, errInvalidIDToken
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(idTokenLeeway)):
+		return nil, errInvalidIDToken
+	}
+	return &claims, nil
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-database-json/config"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//go:embed common-passwords.txt
+var commonPasswordList string
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+var (
+	commonPasswords     map[string]bool
+	commonPasswordsOnce sync.Once
+)
+
+// isBcryptHash tells bcrypt hashes apart from legacy plaintext passwords
+func isBcryptHash(stored string) bool {
+	return len(stored) == 60 && (strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$"))
+}
+
+// verifyPassword checks a password against the stored credential of an
+// account. Accounts created before passwords were hashed still hold the
+// plaintext, needsRehash tells the caller to replace it with a hash.
+func verifyPassword(stored, password string) (ok bool, needsRehash bool) {
+	if stored == "" {
+		return false, false
+	}
+	if isBcryptHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1 {
+		return true, true
+	}
+	return false, false
+}
+
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashed), err
+}
+
+// checkPasswordPolicy returns an error describing why a new password is rejected
+func checkPasswordPolicy(password string) error {
+	policy := config.Current.PasswordPolicy
+
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return fmt.Errorf("Password must be at least %d characters long", policy.MinLength)
+	}
+	// bcrypt ignores everything after 72 bytes
+	if len(password) > 72 {
+		return fmt.Errorf("Password must be at most 72 bytes long")
+	}
+
+	if policy.RejectCommon {
+		commonPasswordsOnce.Do(func() {
+			commonPasswords = make(map[string]bool)
+			for _, line := range strings.Split(commonPasswordList, "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					commonPasswords[strings.ToLower(line)] = true
+				}
+			}
+		})
+		if commonPasswords[strings.ToLower(password)] {
+			return fmt.Errorf("Password is too common, please choose another one")
+		}
+	}
+	return nil
+}
+
+// ChangePasswordHandler sets a new password for the caller after checking the
+// current one. Every token issued to the user before is revoked.
+func ChangePasswordHandler(c *gin.Context) {
+	session := c.MustGet("session").(*Session)
+
+	var req struct {
+		Password    string `json:"password"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON: %v", err)})
+		return
+	}
+	if req.Password == "" || req.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password and newPassword required"})
+		return
+	}
+	if err := checkPasswordPolicy(req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var err error
+	switch session.Role {
+	case RoleSuperuser:
+		_, err = authenticateSuperUser(session.Identity, req.Password)
+	case RoleCustomer:
+		_, err = authenticateCustomer(session.Identity, req.Password)
+	default:
+		err = errInvalidCredentials
+	}
+	if errors.Is(err, errAccountLocked) {
+		audit(c, EventPasswordChange, session.Identity, session.Role, OutcomeLocked)
+		respondLocked(c, session.Identity, session.Role)
+		return
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		audit(c, EventPasswordChange, session.Identity, session.Role, OutcomeFailure)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Current password is wrong"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to verify password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	hashed, err := hashPassword(req.NewPassword)
+	if err != nil {
+		log.Printf("failed to hash password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	var version int
+	if session.Role == RoleSuperuser {
+		version, err = setSuperUserPassword(session.Identity, hashed)
+	} else {
+		version, err = setCustomerPassword(session.Identity, hashed)
+	}
+	if err != nil {
+		log.Printf("failed to save password of %s: %v", session.Identity, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save password"})
+		return
+	}
+
+	// signed tokens carry the old version, stored ones are deleted
+	setTokenVersion(session.Identity, session.Role, version)
+	if err := revokeUserSessions(session.Identity, session.Role); err != nil {
+		log.Printf("failed to revoke sessions of %s: %v", session.Identity, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	audit(c, EventPasswordChange, session.Identity, session.Role, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{"status": "password changed"})
+}
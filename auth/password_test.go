@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"go-database-json/config"
+	"go-database-json/storage"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	hashed, err := hashPassword("Str0ng!Passw0rd#x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBcryptHash(hashed) {
+		t.Fatalf("%q is not recognized as hash", hashed)
+	}
+
+	tests := []struct {
+		name, stored, password string
+		valid, rehash          bool
+	}{
+		{"hash", hashed, "Str0ng!Passw0rd#x", true, false},
+		{"hash, wrong password", hashed, "Str0ng!Passw0rd#y", false, false},
+		{"hash as password", hashed, hashed, false, false},
+		{"legacy", "plain-secret", "plain-secret", true, true},
+		{"legacy, wrong password", "plain-secret", "plain-secreT", false, false},
+		{"legacy, prefix", "plain-secret", "plain", false, false},
+		{"no password", "", "", false, false},
+		{"no password, any input", "", "plain-secret", false, false},
+	}
+	for _, tt := range tests {
+		valid, rehash := verifyPassword(tt.stored, tt.password)
+		if valid != tt.valid || rehash != tt.rehash {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, valid, rehash, tt.valid, tt.rehash)
+		}
+	}
+}
+
+// TestLegacyPasswordRehash checks that plaintext passwords are replaced by
+// their hash on the first login and keep working afterwards
+func TestLegacyPasswordRehash(t *testing.T) {
+	resetAuth(t)
+	const password = "legacy-secret"
+
+	data := map[string]interface{}{"identity": "alice", "password": password}
+	id := stampCustomer(data, "alice")
+	if err := storage.Default.PutRecord(CustomersCollection, id, data); err != nil {
+		t.Fatal(err)
+	}
+	usersMu.Lock()
+	err := saveSuperUsers(superUsersPath, map[string]SuperUser{"root": {Identity: "root", Password: password}})
+	usersMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func(role string) string {
+		t.Helper()
+		if role == RoleSuperuser {
+			user, _, err := lookupSuperUser("root")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return user.Password
+		}
+		data, err := storage.Default.GetRecord(CustomersCollection, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data["password"].(string)
+	}
+	login := func(role, password string) error {
+		if role == RoleSuperuser {
+			_, err := authenticateSuperUser("root", password)
+			return err
+		}
+		_, err := authenticateCustomer("alice", password)
+		return err
+	}
+
+	for _, role := range []string{RoleCustomer, RoleSuperuser} {
+		// a failed login leaves the stored password alone
+		if err := login(role, "wrong"); err != errInvalidCredentials {
+			t.Errorf("%s with wrong password: %v", role, err)
+		}
+		if stored(role) != password {
+			t.Errorf("%s: rehashed after failed login", role)
+		}
+
+		if err := login(role, password); err != nil {
+			t.Fatalf("%s legacy login: %v", role, err)
+		}
+		hashed := stored(role)
+		if !isBcryptHash(hashed) {
+			t.Fatalf("%s: stored %q after login, want a hash", role, hashed)
+		}
+		if err := login(role, password); err != nil {
+			t.Errorf("%s login after rehash: %v", role, err)
+		}
+		if stored(role) != hashed {
+			t.Errorf("%s: rehashed again", role)
+		}
+		if err := login(role, hashed); err != errInvalidCredentials {
+			t.Errorf("%s login with the hash: %v", role, err)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	t.Cleanup(func() { config.Current = config.Default() })
+
+	tests := []struct {
+		name, password string
+		minLength      int
+		rejectCommon   bool
+		valid          bool
+	}{
+		{"strong", "Str0ng!Passw0rd#x", 8, true, true},
+		{"too short", "Sh0rt!", 8, true, false},
+		{"min length", "x7#kq9Lm", 8, true, true},
+		// the length is counted in characters, not bytes
+		{"multibyte too short", "äöüäöüä", 8, true, false},
+		{"multibyte", "äöüäöüäö", 8, true, true},
+		{"72 bytes", strings.Repeat("x", 72), 8, true, true},
+		{"73 bytes", strings.Repeat("x", 73), 8, true, false},
+		{"72 bytes multibyte", strings.Repeat("ä", 36), 8, true, true},
+		{"73 bytes multibyte", strings.Repeat("ä", 36) + "x", 8, true, false},
+		{"common", "password", 8, true, false},
+		{"common digits", "12345678", 8, true, false},
+		{"common, other case", "PassWord", 8, true, false},
+		{"common, surrounded by spaces", " password", 8, true, true},
+		{"common, allowed", "password", 8, false, true},
+		{"common, too short", "qwerty", 8, true, false},
+		{"longer min length", "Str0ng!Passw0rd#x", 20, true, false},
+	}
+	for _, tt := range tests {
+		config.Current.PasswordPolicy = config.PasswordPolicy{MinLength: tt.minLength, RejectCommon: tt.rejectCommon}
+		if err := checkPasswordPolicy(tt.password); (err == nil) != tt.valid {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// every entry of the bundled list is rejected
+	config.Current.PasswordPolicy = config.PasswordPolicy{RejectCommon: true}
+	for _, line := range strings.Split(commonPasswordList, "\n") {
+		if line = strings.TrimSpace(line); line != "" && checkPasswordPolicy(line) == nil {
+			t.Errorf("common password %q accepted", line)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-database-json/config"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// built-in superuser roles, more can be added in the config
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Permissions are written as colon separated segments, a "*" segment
+// matches any segment and, at the end, everything that follows.
+const (
+	PermissionCollectionsRead   = "collections:read"
+	PermissionCollectionsCreate = "collections:create"
+	PermissionCollectionsUpdate = "collections:update"
+	PermissionCollectionsDelete = "collections:delete"
+	PermissionUsersManage       = "users:manage"
+	PermissionAPIKeysManage     = "apikeys:manage"
+	PermissionAuditRead         = "audit:read"
+)
+
+// rolePermissions returns the permissions of a superuser role
+func rolePermissions(role string) ([]string, bool) {
+	if role == "" {
+		role = RoleOwner
+	}
+	permissions, ok := config.Current.Roles[role]
+	return permissions, ok
+}
+
+// matchPermission reports whether a granted permission pattern covers the
+// requested permission
+func matchPermission(pattern, permission string) bool {
+	granted := strings.Split(pattern, ":")
+	requested := strings.Split(permission, ":")
+
+	for i, segment := range granted {
+		if segment == "*" && i == len(granted)-1 {
+			return true
+		}
+		if i >= len(requested) || (segment != "*" && segment != requested[i]) {
+			return false
+		}
+	}
+	return len(granted) == len(requested)
+}
+
+func permits(granted []string, permission string) bool {
+	for _, pattern := range granted {
+		if matchPermission(pattern, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPermission reports whether the caller is a superuser with the permission
+func hasPermission(c *gin.Context, permission string) (bool, error) {
+	if c.GetString("role") != RoleSuperuser {
+		return false, nil
+	}
+
+	user, ok, err := lookupSuperUser(c.GetString("username"))
+	if err != nil || !ok {
+		return false, err
+	}
+	granted, _ := rolePermissions(user.Role)
+	return permits(granted, permission), nil
+}
+
+// RequirePermission rejects callers that are not superusers holding the
+// permission with 403. "{collection}" in the permission is replaced with
+// the collection of the route. It has to run after RequireAuth.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		required := strings.ReplaceAll(permission, "{collection}", c.Param("collection"))
+
+		ok, err := hasPermission(c, required)
+		if err != nil {
+			log.Printf("failed to load superusers: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing permission " + required})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireRecordPermission checks superusers on the record routes for
+// records:read:<collection> on reads and records:write:<collection> on
+// everything else. Other callers are left to the access rules.
+func RequireRecordPermission() gin.HandlerFunc {
+	read := RequirePermission("records:read:{collection}")
+	write := RequirePermission("records:write:{collection}")
+
+	return func(c *gin.Context) {
+		if c.GetString("role") != RoleSuperuser {
+			c.Next()
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead:
+			read(c)
+		default:
+			write(c)
+		}
+	}
+}
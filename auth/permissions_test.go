@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"go-database-json/config"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMatchPermission(t *testing.T) {
+	tests := []struct {
+		pattern, permission string
+		want                bool
+	}{
+		{"*", "users:manage", true},
+		{"*", "records:read:posts", true},
+		{"users:manage", "users:manage", true},
+		{"users:manage", "users:read", false},
+		{"users:manage", "users", false},
+		{"users", "users:manage", false},
+		{"users:manage:all", "users:manage", false},
+		{"records:*", "records:read:posts", true},
+		// a trailing "*" also matches nothing
+		{"records:*", "records", true},
+		{"records:read:*", "records:read:posts", true},
+		{"records:read:*", "records:write:posts", false},
+		{"records:*:posts", "records:write:posts", true},
+		{"records:*:posts", "records:write:tags", false},
+		{"records:*:posts", "records:write:posts:x", false},
+		{"collections:*", "collections:read", true},
+		{"collections:*", "collection:read", false},
+	}
+	for _, tt := range tests {
+		if got := matchPermission(tt.pattern, tt.permission); got != tt.want {
+			t.Errorf("matchPermission(%q, %q) = %v, want %v", tt.pattern, tt.permission, got, tt.want)
+		}
+	}
+}
+
+func TestPermits(t *testing.T) {
+	roles := config.Default().Roles
+	tests := []struct {
+		role, permission string
+		want             bool
+	}{
+		{RoleOwner, PermissionUsersManage, true},
+		{RoleOwner, "anything:at:all", true},
+		{RoleAdmin, PermissionCollectionsDelete, true},
+		{RoleAdmin, "records:write:posts", true},
+		{RoleAdmin, PermissionAuditRead, true},
+		{RoleAdmin, PermissionUsersManage, false},
+		{RoleEditor, PermissionCollectionsRead, true},
+		{RoleEditor, PermissionCollectionsCreate, false},
+		{RoleEditor, "records:write:posts", true},
+		{RoleEditor, PermissionAPIKeysManage, false},
+		{RoleViewer, "records:read:posts", true},
+		{RoleViewer, "records:write:posts", false},
+		{RoleViewer, PermissionAuditRead, false},
+	}
+	for _, tt := range tests {
+		if got := permits(roles[tt.role], tt.permission); got != tt.want {
+			t.Errorf("%s: permits %q = %v, want %v", tt.role, tt.permission, got, tt.want)
+		}
+	}
+	if permits(nil, PermissionCollectionsRead) {
+		t.Error("no permissions permit something")
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	resetAuth(t)
+	putSuperUser(t, "owner", RoleOwner)
+	putSuperUser(t, "admin", RoleAdmin)
+	putSuperUser(t, "editor", RoleEditor)
+	putSuperUser(t, "viewer", RoleViewer)
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+
+	r := newTestEngine(t)
+	authed := r.Group("", RequireAuth())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	authed.GET("/users", RequirePermission(PermissionUsersManage), ok)
+	authed.DELETE("/collections/:collection", RequirePermission(PermissionCollectionsDelete), ok)
+	authed.GET("/records/:collection", RequireRecordPermission(), ok)
+	authed.POST("/records/:collection", RequireRecordPermission(), ok)
+
+	tokens := make(map[string]string)
+	for _, identity := range []string{"owner", "admin", "editor", "viewer"} {
+		tokens[identity], _, _ = issueToken(identity, RoleSuperuser, client{})
+	}
+	tokens["alice"], _, _ = issueToken("alice", RoleCustomer, client{})
+
+	tests := []struct {
+		user, method, path string
+		want               int
+	}{
+		{"owner", "GET", "/users", http.StatusOK},
+		{"admin", "GET", "/users", http.StatusForbidden},
+		{"viewer", "GET", "/users", http.StatusForbidden},
+		{"alice", "GET", "/users", http.StatusForbidden},
+		{"", "GET", "/users", http.StatusUnauthorized},
+		{"admin", "DELETE", "/collections/posts", http.StatusOK},
+		{"editor", "DELETE", "/collections/posts", http.StatusForbidden},
+		{"editor", "GET", "/records/posts", http.StatusOK},
+		{"editor", "POST", "/records/posts", http.StatusOK},
+		{"viewer", "GET", "/records/posts", http.StatusOK},
+		{"viewer", "POST", "/records/posts", http.StatusForbidden},
+		// customers are left to the access rules
+		{"alice", "POST", "/records/posts", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := testRequest{method: tt.method, path: tt.path}
+		if tt.user != "" {
+			req.header = map[string]string{"Authorization": "Bearer " + tokens[tt.user]}
+		}
+		if w, _ := serve(r, req); w.Code != tt.want {
+			t.Errorf("%s %s %s: %d, want %d", tt.user, tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+
+	// a custom role narrowed to one collection
+	config.Current.Roles["posts"] = []string{"records:*:posts"}
+	t.Cleanup(func() { config.Current = config.Default() })
+	putSuperUser(t, "poster", "posts")
+	poster, _, _ := issueToken("poster", RoleSuperuser, client{})
+	for path, want := range map[string]int{"/records/posts": http.StatusOK, "/records/tags": http.StatusForbidden} {
+		w, _ := serve(r, testRequest{method: "POST", path: path, header: map[string]string{"Authorization": "Bearer " + poster}})
+		if w.Code != want {
+			t.Errorf("custom role on %s: %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+func TestGrantRoles(t *testing.T) {
+	resetAuth(t)
+	t.Cleanup(func() { config.Current = config.Default() })
+	// manager may add users but holds less than an editor
+	config.Current.Roles["manager"] = []string{PermissionUsersManage, "collections:read", "records:read:*"}
+	putSuperUser(t, "owner", RoleOwner)
+	putSuperUser(t, "manager", "manager")
+	putSuperUser(t, "admin", RoleAdmin)
+
+	r := newTestEngine(t)
+	r.POST("/register", OptionalAuth(), RegisterHandler)
+	authed := r.Group("", RequireAuth(), RequirePermission(PermissionUsersManage))
+	authed.PATCH("/users/:identity", UpdateSuperUserHandler)
+
+	tokens := make(map[string]string)
+	for _, identity := range []string{"owner", "manager", "admin"} {
+		tokens[identity], _, _ = issueToken(identity, RoleSuperuser, client{})
+	}
+	bearer := func(user string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + tokens[user]}
+	}
+
+	register := []struct {
+		user, identity, role string
+		want                 int
+	}{
+		{"manager", "v1", RoleViewer, http.StatusOK},
+		{"manager", "v2", "", http.StatusOK},
+		{"manager", "e1", RoleEditor, http.StatusForbidden},
+		{"manager", "a1", RoleAdmin, http.StatusForbidden},
+		{"manager", "o1", RoleOwner, http.StatusForbidden},
+		{"manager", "u1", "unknown", http.StatusBadRequest},
+		{"admin", "v3", RoleViewer, http.StatusForbidden},
+		{"", "v4", RoleViewer, http.StatusForbidden},
+		{"owner", "o2", RoleOwner, http.StatusOK},
+		{"owner", "e2", RoleEditor, http.StatusOK},
+	}
+	for _, tt := range register {
+		body := `{"identity": "` + tt.identity + `", "password": "Str0ng!Passw0rd#x", "role": "` + tt.role + `"}`
+		req := testRequest{method: "POST", path: "/register", body: body}
+		if tt.user != "" {
+			req.header = bearer(tt.user)
+		}
+		w, _ := serve(r, req)
+		if w.Code != tt.want {
+			t.Errorf("%s registering %s as %q: %d %s, want %d", tt.user, tt.identity, tt.role, w.Code, w.Body, tt.want)
+		}
+		_, exists, _ := lookupSuperUser(tt.identity)
+		if exists != (tt.want == http.StatusOK) {
+			t.Errorf("%s registering %s as %q: stored %v", tt.user, tt.identity, tt.role, exists)
+		}
+	}
+	if user, _, _ := lookupSuperUser("v2"); user.Role != RoleViewer {
+		t.Errorf("default role %q", user.Role)
+	}
+
+	update := []struct {
+		user, identity, role string
+		want                 int
+	}{
+		{"manager", "v1", RoleEditor, http.StatusForbidden},
+		{"manager", "manager", RoleOwner, http.StatusForbidden},
+		{"manager", "o2", RoleViewer, http.StatusForbidden},
+		{"manager", "e2", RoleViewer, http.StatusOK},
+		{"manager", "unknown", RoleViewer, http.StatusNotFound},
+		{"owner", "v1", "unknown", http.StatusBadRequest},
+		{"owner", "v1", RoleAdmin, http.StatusOK},
+		{"admin", "v2", RoleAdmin, http.StatusForbidden},
+		// with two owners one of them can step down, the last one can't
+		{"owner", "o2", RoleAdmin, http.StatusOK},
+		{"owner", "owner", RoleAdmin, http.StatusConflict},
+		{"owner", "owner", RoleOwner, http.StatusOK},
+	}
+	for _, tt := range update {
+		w, _ := serve(r, testRequest{method: "PATCH", path: "/users/" + tt.identity, body: `{"role": "` + tt.role + `"}`, header: bearer(tt.user)})
+		if w.Code != tt.want {
+			t.Errorf("%s giving %s role %q: %d %s, want %d", tt.user, tt.identity, tt.role, w.Code, w.Body, tt.want)
+		}
+	}
+
+	want := map[string]string{"owner": RoleOwner, "o2": RoleAdmin, "v1": RoleAdmin, "e2": RoleViewer, "manager": "manager"}
+	for identity, role := range want {
+		if user, _, _ := lookupSuperUser(identity); superUserView(user)["role"] != role {
+			t.Errorf("%s has role %q, want %q", identity, user.Role, role)
+		}
+	}
+}
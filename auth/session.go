@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"go-database-json/config"
+	"go-database-json/storage"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	tokensPath = "auth/token.json"
+
+	// maxSessionsPerUser limits the active tokens per user, the oldest is dropped
+	maxSessionsPerUser = 5
+
+	RoleSuperuser = "superuser"
+	RoleCustomer  = "customer"
+)
+
+var (
+	errInvalidToken    = errors.New("invalid token")
+	errSessionNotFound = errors.New("session not found")
+)
+
+// Session is an issued token. Clients receive "<id>.<secret>" and only the
+// bcrypt hash of the secret is stored.
+type Session struct {
+	ID       string    `json:"id"`
+	Identity string    `json:"identity"`
+	Role     string    `json:"role"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+	// Expires is zero for tokens issued before expiry was introduced,
+	// those expire one TTL after they were created
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	// Stateless marks signed tokens, they are not in the token store
+	Stateless bool `json:"-"`
+}
+
+func (s Session) expiry() time.Time {
+	if s.Expires.IsZero() {
+		return s.Created.Add(time.Duration(config.Current.Sessions.TTL))
+	}
+	return s.Expires
+}
+
+// client describes where a token was requested from
+type client struct {
+	IP        string
+	UserAgent string
+}
+
+// loadSessions reads the token store, tokensMu must be held by writers
+func loadSessions() ([]Session, error) {
+	data, err := os.ReadFile(tokensPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		// the old store mapped usernames to bare token hashes without ids,
+		// those tokens can't be looked up anymore and are dropped
+		var legacy map[string][]string
+		if json.Unmarshal(data, &legacy) == nil {
+			log.Printf("token store uses the old format, existing tokens were invalidated")
+			return nil, nil
+		}
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func saveSessions(sessions []Session) error {
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(tokensPath, data, 0644)
+}
+
+// issueToken creates a new session for the user and returns the plain token
+func issueToken(identity, role string, from client) (string, Session, error) {
+	if config.Current.Sessions.JWT.Enabled {
+		return issueJWT(identity, role)
+	}
+
+	secret := uuid.NewString()
+
+	// hash the secret for storage
+	hashed, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	now := time.Now().UTC()
+	session := Session{
+		ID:        uuid.NewString(),
+		Identity:  identity,
+		Role:      role,
+		Hash:      string(hashed),
+		Created:   now,
+		Expires:   now.Add(time.Duration(config.Current.Sessions.TTL)),
+		IP:        from.IP,
+		UserAgent: from.UserAgent,
+	}
+
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return "", Session{}, err
+	}
+	sessions = activeSessions(sessions, now)
+
+	// limit to max sessions per user, drop oldest if needed
+	count := 0
+	for _, s := range sessions {
+		if s.Identity == identity && s.Role == role {
+			count++
+		}
+	}
+	kept := sessions[:0]
+	for _, s := range sessions {
+		if count >= maxSessionsPerUser && s.Identity == identity && s.Role == role {
+			count--
+			continue
+		}
+		kept = append(kept, s)
+	}
+	kept = append(kept, session)
+
+	if err := saveSessions(kept); err != nil {
+		return "", Session{}, err
+	}
+	return session.ID + "." + secret, session, nil
+}
+
+// activeSessions filters out expired sessions in place
+func activeSessions(sessions []Session, now time.Time) []Session {
+	kept := sessions[:0]
+	for _, s := range sessions {
+		if now.Before(s.expiry()) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// verifyToken returns the session a plain token belongs to. With sliding
+// sessions the expiry is pushed back once less than half the TTL is left,
+// so the token store is not rewritten on every request.
+func verifyToken(token string) (*Session, error) {
+	if strings.Count(token, ".") == 2 {
+		if !config.Current.Sessions.JWT.Enabled {
+			return nil, errInvalidToken
+		}
+		return verifyJWT(token)
+	}
+
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, errInvalidToken
+	}
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, session := range sessions {
+		if session.ID != id {
+			continue
+		}
+		if !now.Before(session.expiry()) {
+			return nil, errInvalidToken
+		}
+		if bcrypt.CompareHashAndPassword([]byte(session.Hash), []byte(secret)) != nil {
+			return nil, errInvalidToken
+		}
+		// the account may have been removed without its sessions
+		if _, err := lookupTokenAccount(session.Identity, session.Role); err != nil {
+			return nil, err
+		}
+
+		ttl := time.Duration(config.Current.Sessions.TTL)
+		if config.Current.Sessions.Sliding && session.expiry().Sub(now) < ttl/2 {
+			session.Expires = now.Add(ttl)
+			if err := extendSession(session.ID, session.Expires); err != nil {
+				log.Printf("failed to extend session %s: %v", session.ID, err)
+			}
+		}
+		return &session, nil
+	}
+	return nil, errInvalidToken
+}
+
+func extendSession(id string, expires time.Time) error {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	for i := range sessions {
+		if sessions[i].ID == id {
+			sessions[i].Expires = expires
+			return saveSessions(activeSessions(sessions, time.Now().UTC()))
+		}
+	}
+	return nil
+}
+
+// listSessions returns the active sessions, only those of the given user
+// when identity is not empty
+func listSessions(identity, role string) ([]Session, error) {
+	sessions, err := loadSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Session{}
+	for _, s := range activeSessions(sessions, time.Now().UTC()) {
+		if identity != "" && (s.Identity != identity || s.Role != role) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// revokeSession deletes a session. With an identity only a session of that
+// user is revoked, other sessions are reported as not found.
+func revokeSession(id, identity, role string) error {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+
+	for i, s := range sessions {
+		if s.ID != id {
+			continue
+		}
+		if identity != "" && (s.Identity != identity || s.Role != role) {
+			break
+		}
+		sessions = append(sessions[:i], sessions[i+1:]...)
+		return saveSessions(activeSessions(sessions, time.Now().UTC()))
+	}
+	return errSessionNotFound
+}
+
+// revokeUserSessions deletes all stored sessions of a user
+func revokeUserSessions(identity, role string) error {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+
+	kept := sessions[:0]
+	for _, s := range sessions {
+		if s.Identity != identity || s.Role != role {
+			kept = append(kept, s)
+		}
+	}
+	return saveSessions(activeSessions(kept, time.Now().UTC()))
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+// clientOf describes the caller for sessions and the audit log. The IP is
+// only taken from X-Forwarded-For when the request came through one of the
+// trusted proxies the engine was set up with.
+func clientOf(c *gin.Context) client {
+	return client{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+}
+
+// LogoutHandler revokes the token the request was authenticated with
+func LogoutHandler(c *gin.Context) {
+	session := c.MustGet("session").(*Session)
+
+	var err error
+	if session.Stateless {
+		err = revokeJWT(session)
+	} else {
+		err = revokeSession(session.ID, "", "")
+	}
+	if err != nil && !errors.Is(err, errSessionNotFound) {
+		log.Printf("failed to revoke session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	audit(c, EventLogout, session.Identity, session.Role, OutcomeSuccess)
+	c.JSON(http.StatusOK, gin.H{"status": "logged out"})
+}
+
+// SessionsHandler lists the active sessions. Superusers allowed to manage
+// users see the sessions of everyone, all others only their own.
+//
+// Signed tokens (sessions.jwt) are not stored and don't show up here. They
+// can't be revoked by id either, only a logout with the token itself or a
+// password change ends them before they expire.
+func SessionsHandler(c *gin.Context) {
+	current := c.MustGet("session").(*Session)
+
+	identity, role, ok := sessionOwner(c, current)
+	if !ok {
+		return
+	}
+
+	sessions, err := listSessions(identity, role)
+	if err != nil {
+		log.Printf("failed to load tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	items := make([]gin.H, 0, len(sessions))
+	for _, s := range sessions {
+		items = append(items, gin.H{
+			"id":        s.ID,
+			"identity":  s.Identity,
+			"role":      s.Role,
+			"created":   s.Created,
+			"expires":   s.expiry(),
+			"ip":        s.IP,
+			"userAgent": s.UserAgent,
+			"current":   s.ID == current.ID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(items),
+		"items": items,
+	})
+}
+
+// RevokeSessionHandler revokes a session by its ID. Only superusers allowed
+// to manage users can revoke the sessions of others. Signed tokens are
+// unknown here and answered with 404.
+func RevokeSessionHandler(c *gin.Context) {
+	current := c.MustGet("session").(*Session)
+
+	identity, role, ok := sessionOwner(c, current)
+	if !ok {
+		return
+	}
+
+	err := revokeSession(c.Param("id"), identity, role)
+	if errors.Is(err, errSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to revoke session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
+// sessionOwner returns whose sessions the caller may manage, empty strings
+// stand for everyone
+func sessionOwner(c *gin.Context, current *Session) (string, string, bool) {
+	all, err := hasPermission(c, PermissionUsersManage)
+	if err != nil {
+		log.Printf("failed to load superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return "", "", false
+	}
+	if all {
+		return "", "", true
+	}
+	return current.Identity, current.Role, true
+}
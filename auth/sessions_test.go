@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"go-database-json/config"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		ip      string
+	}{
+		{"no trusted proxy", nil, "192.0.2.1"},
+		{"trusted proxy", []string{"192.0.2.1"}, "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		resetAuth(t)
+		r := newTestEngine(t)
+		if err := r.SetTrustedProxies(tt.trusted); err != nil {
+			t.Fatal(err)
+		}
+		r.POST("/register", CustomerRegisterHandler)
+		r.POST("/login", CustomerHandler)
+
+		header := map[string]string{"X-Forwarded-For": "203.0.113.7", "User-Agent": "test"}
+		for _, path := range []string{"/register", "/login"} {
+			w, _ := serve(r, testRequest{method: "POST", path: path, body: `{"identity": "alice", "password": "Str0ng!Passw0rd#x"}`, header: header, remoteAddr: "192.0.2.1:4711"})
+			if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+				t.Fatalf("%s: %s %d %s", tt.name, path, w.Code, w.Body)
+			}
+		}
+
+		entries, err := readAuditLog(func(AuditEntry) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("%s: %d audit entries", tt.name, len(entries))
+		}
+		for _, entry := range entries {
+			if entry.IP != tt.ip || entry.UserAgent != "test" {
+				t.Errorf("%s: %s logged from %s (%s), want %s", tt.name, entry.Event, entry.IP, entry.UserAgent, tt.ip)
+			}
+		}
+
+		sessions, err := loadSessions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 1 || sessions[0].IP != tt.ip {
+			t.Errorf("%s: sessions %+v, want one from %s", tt.name, sessions, tt.ip)
+		}
+	}
+}
+
+// storedSession returns a session from the token store
+func storedSession(t *testing.T, id string) (Session, bool) {
+	t.Helper()
+	sessions, err := loadSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sessions {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Session{}, false
+}
+
+// setExpiry changes the expiry of a stored session
+func setExpiry(t *testing.T, id string, expires time.Time) {
+	t.Helper()
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	sessions, err := loadSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sessions {
+		if sessions[i].ID == id {
+			sessions[i].Expires = expires
+		}
+	}
+	if err := saveSessions(sessions); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	resetAuth(t)
+	t.Cleanup(func() { config.Current = config.Default() })
+	config.Current.Sessions.TTL = config.Duration(time.Hour)
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+
+	tests := []struct {
+		name    string
+		sliding bool
+		left    time.Duration
+		// extended reports whether the expiry is pushed back to a full TTL
+		extended bool
+		valid    bool
+	}{
+		{"fresh", false, 50 * time.Minute, false, true},
+		{"fresh sliding", true, 50 * time.Minute, false, true},
+		{"old", false, 10 * time.Minute, false, true},
+		{"old sliding", true, 10 * time.Minute, true, true},
+		{"expired", false, -time.Second, false, false},
+		{"expired sliding", true, -time.Second, false, false},
+	}
+	for _, tt := range tests {
+		config.Current.Sessions.Sliding = tt.sliding
+		token, session, err := issueToken("alice", RoleCustomer, client{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := session.Expires.Sub(session.Created); ttl != time.Hour {
+			t.Fatalf("issued for %v", ttl)
+		}
+		expires := time.Now().UTC().Add(tt.left)
+		setExpiry(t, session.ID, expires)
+
+		_, err = verifyToken(token)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		stored, ok := storedSession(t, session.ID)
+		switch {
+		case !tt.valid:
+			// expired sessions are dropped with the next write
+			continue
+		case !ok:
+			t.Errorf("%s: session gone", tt.name)
+		case tt.extended && stored.Expires.Sub(time.Now()) < 59*time.Minute:
+			t.Errorf("%s: expires in %v, want an hour", tt.name, time.Until(stored.Expires))
+		case !tt.extended && !stored.Expires.Equal(expires):
+			t.Errorf("%s: expiry moved from %v to %v", tt.name, expires, stored.Expires)
+		}
+	}
+
+	// sessions from before expiry existed last one TTL from their creation
+	token, session, _ := issueToken("alice", RoleCustomer, client{})
+	setExpiry(t, session.ID, time.Time{})
+	if _, err := verifyToken(token); err != nil {
+		t.Errorf("legacy session: %v", err)
+	}
+	tokensMu.Lock()
+	sessions, _ := loadSessions()
+	for i := range sessions {
+		if sessions[i].ID == session.ID {
+			sessions[i].Created = time.Now().Add(-2 * time.Hour)
+		}
+	}
+	saveSessions(sessions)
+	tokensMu.Unlock()
+	if _, err := verifyToken(token); err != errInvalidToken {
+		t.Errorf("old legacy session: %v", err)
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	resetAuth(t)
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+
+	var tokens []string
+	for i := 0; i < maxSessionsPerUser+1; i++ {
+		token, _, err := issueToken("alice", RoleCustomer, client{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	if _, err := verifyToken(tokens[0]); err != errInvalidToken {
+		t.Errorf("oldest session: %v", err)
+	}
+	for _, token := range tokens[1:] {
+		if _, err := verifyToken(token); err != nil {
+			t.Errorf("newer session: %v", err)
+		}
+	}
+}
+
+func TestSessionsHandlers(t *testing.T) {
+	resetAuth(t)
+	putCustomer(t, "alice", "", "Str0ng!Passw0rd#x")
+	putCustomer(t, "bob", "", "Str0ng!Passw0rd#x")
+	putSuperUser(t, "root", RoleOwner)
+	putSuperUser(t, "editor", RoleEditor)
+
+	r := newTestEngine(t)
+	authed := r.Group("", RequireAuth())
+	authed.POST("/logout", LogoutHandler)
+	authed.GET("/sessions", SessionsHandler)
+	authed.DELETE("/sessions/:id", RevokeSessionHandler)
+
+	login := func(identity, role string) (string, string) {
+		token, session, err := issueToken(identity, role, client{IP: "192.0.2.1", UserAgent: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token, session.ID
+	}
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+	list := func(token string) (int, []interface{}) {
+		w, body := serve(r, testRequest{method: "GET", path: "/sessions", header: bearer(token)})
+		items, _ := body["items"].([]interface{})
+		return w.Code, items
+	}
+	revoke := func(token, id string) int {
+		w, _ := serve(r, testRequest{method: "DELETE", path: "/sessions/" + id, header: bearer(token)})
+		return w.Code
+	}
+
+	alice1, alice1ID := login("alice", RoleCustomer)
+	alice2, alice2ID := login("alice", RoleCustomer)
+	bob, bobID := login("bob", RoleCustomer)
+	root, _ := login("root", RoleSuperuser)
+	editor, _ := login("editor", RoleSuperuser)
+
+	// customers and superusers without users:manage list their own sessions
+	code, items := list(alice1)
+	if code != http.StatusOK || len(items) != 2 {
+		t.Fatalf("alice lists %d %v", code, items)
+	}
+	for _, item := range items {
+		s := item.(map[string]interface{})
+		if s["identity"] != "alice" || s["ip"] != "192.0.2.1" || s["userAgent"] != "test" || s["current"] != (s["id"] == alice1ID) {
+			t.Errorf("alice listed %v", s)
+		}
+	}
+	if _, items := list(editor); len(items) != 1 {
+		t.Errorf("editor listed %v", items)
+	}
+	if _, items := list(root); len(items) != 5 {
+		t.Errorf("owner listed %d sessions", len(items))
+	}
+
+	// nobody revokes the sessions of others without users:manage
+	if code := revoke(alice1, bobID); code != http.StatusNotFound {
+		t.Errorf("alice revoking bob: %d", code)
+	}
+	if code := revoke(editor, bobID); code != http.StatusNotFound {
+		t.Errorf("editor revoking bob: %d", code)
+	}
+	if _, err := verifyToken(bob); err != nil {
+		t.Errorf("bob after foreign revokes: %v", err)
+	}
+	if code := revoke(alice1, "unknown"); code != http.StatusNotFound {
+		t.Errorf("revoking unknown session: %d", code)
+	}
+
+	if code := revoke(alice1, alice2ID); code != http.StatusOK {
+		t.Errorf("alice revoking her other session: %d", code)
+	}
+	if _, err := verifyToken(alice2); err != errInvalidToken {
+		t.Errorf("revoked session: %v", err)
+	}
+	if code := revoke(root, bobID); code != http.StatusOK {
+		t.Errorf("owner revoking bob: %d", code)
+	}
+	if _, err := verifyToken(bob); err != errInvalidToken {
+		t.Errorf("bob after revoke by owner: %v", err)
+	}
+
+	// logout ends the session it is sent with and nothing else
+	w, _ := serve(r, testRequest{method: "POST", path: "/logout", header: bearer(alice1)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("logout: %d", w.Code)
+	}
+	if _, err := verifyToken(alice1); err != errInvalidToken {
+		t.Errorf("after logout: %v", err)
+	}
+	if w, _ := serve(r, testRequest{method: "GET", path: "/sessions", header: bearer(alice1)}); w.Code != http.StatusUnauthorized {
+		t.Errorf("listing after logout: %d", w.Code)
+	}
+	if _, err := verifyToken(root); err != nil {
+		t.Errorf("other user after logout: %v", err)
+	}
+
+	// signed tokens are not stored, so they are neither listed nor revoked by id
+	enableJWT(t)
+	signed, session, err := issueToken("alice", RoleCustomer, client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, items := list(signed); code != http.StatusOK || len(items) != 0 {
+		t.Errorf("signed token lists %d %v", code, items)
+	}
+	if code := revoke(root, session.ID); code != http.StatusNotFound {
+		t.Errorf("revoking a signed token: %d", code)
+	}
+}
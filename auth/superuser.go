@@ -2,101 +2,43 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/time/rate"
+	"go-database-json/storage"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
-	"time"
 )
 
-// TokenValid checks if the token of the user in the request matches the expected token
-func TokenValid(c *gin.Context, expectedToken string) bool {
-	var req map[string]User
-
-	// Parse JSON body into map
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf("Invalid JSON: %v", err),
-		})
-		return false
-	}
-
-	// Check that there is exactly one user in the request
-	if len(req) != 1 {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid request: expected exactly one user",
-		})
-		return false
-	}
-
-	// Extract the username and user info
-	var username string
-	var user User
-	for k, v := range req {
-		username = k
-		user = v
-		break
-	}
-
-	// Check if the provided token matches the expected one
-	if user.Token != expectedToken {
-		c.JSON(http.StatusForbidden, gin.H{
-			"error": fmt.Sprintf("Unauthorized: invalid token for user %s", username),
-		})
-		return false
-	}
-
-	// Success
-	c.Set("username", username)
-	return true
-}
-
 var (
-	// map username or IP to a rate limiter
-	limiterStore = make(map[string]*rate.Limiter)
-	mu           sync.Mutex
-	rateLimit    = rate.Every(1 * time.Minute) // 1 request per second
-	burstLimit   = 3                           // allow burst of 3 requests
+	// guard read-modify-write cycles on the auth files
+	tokensMu sync.Mutex
+	usersMu  sync.Mutex
 )
 
-func getLimiter(key string) *rate.Limiter {
-	mu.Lock()
-	defer mu.Unlock()
-
-	limiter, exists := limiterStore[key]
-	if !exists {
-		limiter = rate.NewLimiter(rateLimit, burstLimit)
-		limiterStore[key] = limiter
-	}
-	return limiter
-}
-
-func LoginHandler(c *gin.Context) {
-	// use IP or username as key
-	key := c.ClientIP()
-
-	limiter := getLimiter(key)
-	if !limiter.Allow() {
-		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts. Please try again later."})
-		return
-	}
-
-	// ... your login logic here ...
-}
+const superUsersPath = "auth/superusers.json"
 
 type SuperUser struct {
 	Identity string `json:"identity"`
 	Name     string `json:"name"`
 	Password string `json:"password"`
+	// Role decides the permissions of the superuser, superusers created
+	// before roles existed have none and count as owner
+	Role string `json:"role,omitempty"`
+	// TokenVersion is raised on password changes to invalidate signed tokens
+	TokenVersion int  `json:"tokenVersion,omitempty"`
+	MFA          *MFA `json:"mfa,omitempty"`
 }
 
+// loadSuperUsers reads the superusers file, a missing file means there are none yet
 func loadSuperUsers(path string) (map[string]SuperUser, error) {
 	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]SuperUser{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -106,50 +48,177 @@ func loadSuperUsers(path string) (map[string]SuperUser, error) {
 	if err := json.NewDecoder(file).Decode(&users); err != nil {
 		return nil, err
 	}
+	if users == nil {
+		users = map[string]SuperUser{}
+	}
 	return users, nil
 }
 
-// Tokens map: username -> slice of hashed tokens
-func loadTokens(path string) (map[string][]string, error) {
-	tokens := make(map[string][]string)
+func saveSuperUsers(path string, users map[string]SuperUser) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
+
+	superUsersCacheMu.Lock()
+	superUsersCache = nil
+	superUsersCacheMu.Unlock()
+	return nil
+}
+
+var (
+	// superUsersCache keeps the superusers for lookups on every request. It
+	// is dropped whenever the file is written and reloaded when the file
+	// changed on disk, e.g. through the "superuser create" command.
+	superUsersCache   map[string]SuperUser
+	superUsersCacheAt fileStamp
+	superUsersCacheMu sync.RWMutex
+)
+
+// fileStamp tells whether a file changed since it was read. Files are
+// replaced by an atomic rename on every write, so a new file is a change.
+type fileStamp struct {
+	info os.FileInfo
+}
 
-	file, err := os.Open(path)
+func stampFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fileStamp{}, nil
+	}
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{info: info}, nil
+}
+
+func (s fileStamp) same(other fileStamp) bool {
+	if s.info == nil || other.info == nil {
+		return s.info == nil && other.info == nil
+	}
+	return os.SameFile(s.info, other.info) && s.info.ModTime().Equal(other.info.ModTime()) && s.info.Size() == other.info.Size()
+}
+
+// lookupSuperUser returns a superuser from the cache
+func lookupSuperUser(identity string) (SuperUser, bool, error) {
+	stamp, err := stampFile(superUsersPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return tokens, nil
+		return SuperUser{}, false, err
+	}
+
+	superUsersCacheMu.RLock()
+	users := superUsersCache
+	if !superUsersCacheAt.same(stamp) {
+		users = nil
+	}
+	superUsersCacheMu.RUnlock()
+
+	if users == nil {
+		// load while holding the lock, so a concurrent save can't be
+		// followed by caching what was read before it
+		superUsersCacheMu.Lock()
+		if superUsersCache == nil || !superUsersCacheAt.same(stamp) {
+			// stamp again under the lock, the file may have been saved
+			// in between and the stamp has to match what is loaded
+			stamp, err = stampFile(superUsersPath)
+			if err != nil {
+				superUsersCacheMu.Unlock()
+				return SuperUser{}, false, err
+			}
+			loaded, err := loadSuperUsers(superUsersPath)
+			if err != nil {
+				superUsersCacheMu.Unlock()
+				return SuperUser{}, false, err
+			}
+			superUsersCache = loaded
+			superUsersCacheAt = stamp
 		}
-		return nil, err
+		users = superUsersCache
+		superUsersCacheMu.Unlock()
 	}
-	defer file.Close()
 
-	if err := json.NewDecoder(file).Decode(&tokens); err != nil {
+	user, ok := users[identity]
+	return user, ok, nil
+}
+
+// authenticateSuperUser verifies the credentials of a superuser and replaces
+// a legacy plaintext password with its hash on the first successful login.
+// Locked accounts get errAccountLocked without the password being checked.
+func authenticateSuperUser(identity, password string) (*SuperUser, error) {
+	if _, locked := lockedUntil(identity, RoleSuperuser); locked {
+		return nil, errAccountLocked
+	}
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
 		return nil, err
 	}
 
-	return tokens, nil
+	user, ok := users[identity]
+	if !ok {
+		recordFailure(identity, RoleSuperuser)
+		return nil, errInvalidCredentials
+	}
+	valid, needsRehash := verifyPassword(user.Password, password)
+	if !valid {
+		recordFailure(identity, RoleSuperuser)
+		return nil, errInvalidCredentials
+	}
+	resetFailures(identity, RoleSuperuser)
+
+	if needsRehash {
+		if err := rehashSuperUser(identity, password); err != nil {
+			log.Printf("failed to rehash password of %s: %v", identity, err)
+		}
+	}
+	return &user, nil
 }
 
-func saveTokens(path string, tokens map[string][]string) error {
-	file, err := os.Create(path)
+func rehashSuperUser(identity, password string) error {
+	hashed, err := hashPassword(password)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
+	usersMu.Lock()
+	defer usersMu.Unlock()
 
-	return encoder.Encode(tokens)
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		return err
+	}
+	user, ok := users[identity]
+	if !ok {
+		return nil
+	}
+	user.Password = hashed
+	users[identity] = user
+	return saveSuperUsers(superUsersPath, users)
 }
 
-func AdminHandler(c *gin.Context) {
-	users, err := loadSuperUsers("auth/superusers.json")
+// setSuperUserPassword stores a new password hash and raises the token version
+func setSuperUserPassword(identity, hashed string) (int, error) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
 	if err != nil {
-		log.Printf("failed to load superusers: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-		return
+		return 0, err
 	}
+	user, ok := users[identity]
+	if !ok {
+		return 0, errInvalidCredentials
+	}
+	user.Password = hashed
+	user.TokenVersion++
+	users[identity] = user
+	return user.TokenVersion, saveSuperUsers(superUsersPath, users)
+}
 
+func AdminHandler(c *gin.Context) {
 	var req struct {
 		Identity string `json:"identity"`
 		Password string `json:"password"`
@@ -159,54 +228,42 @@ func AdminHandler(c *gin.Context) {
 		return
 	}
 
-	user, ok := users[req.Identity]
-	if !ok || user.Password != req.Password {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+	user, err := authenticateSuperUser(req.Identity, req.Password)
+	if errors.Is(err, errAccountLocked) {
+		audit(c, EventLogin, req.Identity, RoleSuperuser, OutcomeLocked)
+		respondLocked(c, req.Identity, RoleSuperuser)
 		return
 	}
-
-	// generate a new random token (plain)
-	secretToken := []byte(uuid.NewString())
-
-	// hash the token for storage
-	hashed, err := bcrypt.GenerateFromPassword(secretToken, bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("failed to hash token: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+	if errors.Is(err, errInvalidCredentials) {
+		audit(c, EventLogin, req.Identity, RoleSuperuser, OutcomeFailure)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
 		return
 	}
-
-	// load existing tokens
-	tokens, err := loadTokens("auth/token.json")
 	if err != nil {
-		log.Printf("failed to load tokens: %v", err)
+		log.Printf("failed to load superusers: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return
 	}
 
-	// append the new hashed token for this user
-	userTokens := tokens[user.Identity]
-
-	// limit to max 5 tokens, drop oldest if needed
-	if len(userTokens) >= 5 {
-		userTokens = userTokens[1:] // drop the oldest token
+	// with MFA the token is only issued by MFALoginHandler
+	if startMFALogin(c, user) {
+		return
 	}
-	userTokens = append(userTokens, string(hashed))
-	tokens[user.Identity] = userTokens
 
-	// save updated tokens back to file
-	if err := saveTokens("auth/token.json", tokens); err != nil {
-		log.Printf("failed to save tokens: %v", err)
+	// issue a new token, only its hash is stored
+	token, _, err := issueToken(user.Identity, RoleSuperuser, clientOf(c))
+	if err != nil {
+		log.Printf("failed to issue token: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return
 	}
 
-	fmt.Printf("New token for user %s: %s\n", user.Identity, hashed)
+	audit(c, EventLogin, user.Identity, RoleSuperuser, OutcomeSuccess)
 
 	// return the plain token (client uses this to authenticate later)
 	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
-		"token":  string(secretToken),
+		"token":  token,
 		"user":   user.Identity,
 		"name":   user.Name,
 	})
@@ -222,33 +279,20 @@ func AdminCheckHandler(c *gin.Context) {
 		return
 	}
 
-	tokens, err := loadTokens("auth/token.json")
+	// check that the token belongs to the user
+	session, err := verifyToken(req.Token)
+	if errors.Is(err, errInvalidToken) || (err == nil && (session.Identity != req.Username || session.Role != RoleSuperuser)) {
+		audit(c, EventTokenCheck, req.Username, RoleSuperuser, OutcomeFailure)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+		return
+	}
 	if err != nil {
 		log.Printf("failed to load tokens: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		return
 	}
 
-	userTokens, ok := tokens[req.Username]
-	if !ok || len(userTokens) == 0 {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
-		return
-	}
-
-	// check if any stored hashed token matches the provided plain token
-	authenticated := false
-	for _, hashedToken := range userTokens {
-		err := bcrypt.CompareHashAndPassword([]byte(hashedToken), []byte(req.Token))
-		if err == nil {
-			authenticated = true
-			break
-		}
-	}
-
-	if !authenticated {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
-		return
-	}
+	audit(c, EventTokenCheck, req.Username, RoleSuperuser, OutcomeSuccess)
 
 	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
@@ -256,21 +300,17 @@ func AdminCheckHandler(c *gin.Context) {
 	})
 }
 
-var req struct {
-	Identity string `json:"identity"`
-	Password string `json:"password"`
-	Token    string `json:"token"`
-}
-
-// RegisterHandler registers a new superuser with bcrypt-hashed password
+// RegisterHandler registers a new superuser with bcrypt-hashed password.
+// The first superuser is created with the installer token printed at
+// startup, every further one only by an authenticated superuser.
 func RegisterHandler(c *gin.Context) {
-
-	const expectedToken = "token123"
-
-	if !TokenValid(c, expectedToken) {
-		return // response already sent
+	var req struct {
+		Identity     string `json:"identity"`
+		Name         string `json:"name"`
+		Password     string `json:"password"`
+		Role         string `json:"role"`
+		InstallToken string `json:"installToken"`
 	}
-
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": fmt.Sprintf("Invalid JSON: %v", err),
@@ -278,62 +318,202 @@ func RegisterHandler(c *gin.Context) {
 		return
 	}
 
-	if req.Identity == "" || req.Password == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Identity and Password required"})
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		log.Printf("failed to load superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read users"})
 		return
 	}
 
-	// load existing superusers
-	users := make(map[string]User)
-
-	path := "auth/superusers.json"
-
-	// try to read file if it exists
-	if file, err := os.Open(path); err == nil {
-		defer file.Close()
-		if err := json.NewDecoder(file).Decode(&users); err != nil {
-			log.Printf("failed to decode users: %v", err)
+	// the first superuser owns the installation, further ones get
+	// the viewer role unless another one is asked for
+	if len(users) == 0 {
+		if !checkInstallToken(req.InstallToken) {
+			audit(c, EventRegister, req.Identity, RoleSuperuser, OutcomeFailure)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid installer token"})
+			return
+		}
+		req.Role = RoleOwner
+	} else {
+		allowed, err := hasPermission(c, PermissionUsersManage)
+		if err != nil {
+			log.Printf("failed to load superusers: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read users"})
 			return
 		}
+		if !allowed {
+			audit(c, EventRegister, req.Identity, RoleSuperuser, OutcomeFailure)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + PermissionUsersManage})
+			return
+		}
+		if req.Role == "" {
+			req.Role = RoleViewer
+		}
+		if !checkGrantableRole(c, req.Role) {
+			return
+		}
+	}
+
+	if req.Identity == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identity and Password required"})
+		return
+	}
+
+	if err := checkPasswordPolicy(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	// check if user already exists
-	if _, exists := users[req.Identity]; exists {
+	err = addSuperUser(users, req.Identity, req.Name, req.Password, req.Role)
+	if errors.Is(err, ErrSuperUserExists) {
 		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
 		return
 	}
+	if err != nil {
+		log.Printf("failed to save superuser: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save user"})
+		return
+	}
+
+	audit(c, EventRegister, req.Identity, RoleSuperuser, OutcomeSuccess)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "created",
+		"user":   req.Identity,
+		"role":   req.Role,
+	})
+}
 
-	// hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+// checkGrantableRole makes sure the role exists and the caller holds every
+// permission of it, so nobody can hand out more than they have. It answers
+// with 400 or 403 and returns false otherwise.
+func checkGrantableRole(c *gin.Context, role string) bool {
+	permissions, ok := rolePermissions(role)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown role '%s'", role)})
+		return false
+	}
+
+	caller, _, err := lookupSuperUser(c.GetString("username"))
+	if err != nil {
+		log.Printf("failed to load superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read users"})
+		return false
+	}
+	granted, _ := rolePermissions(caller.Role)
+	for _, permission := range permissions {
+		if !permits(granted, permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Can't grant role '%s' without permission %s", role, permission)})
+			return false
+		}
+	}
+	return true
+}
+
+func superUserView(user SuperUser) gin.H {
+	role := user.Role
+	if role == "" {
+		role = RoleOwner
+	}
+	return gin.H{
+		"identity": user.Identity,
+		"name":     user.Name,
+		"role":     role,
+		"mfa":      user.MFA != nil && user.MFA.Enabled,
+	}
+}
+
+// ListSuperUsersHandler lists the superusers with their roles
+func ListSuperUsersHandler(c *gin.Context) {
+	users, err := loadSuperUsers(superUsersPath)
 	if err != nil {
-		log.Printf("failed to hash password: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		log.Printf("failed to load superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read users"})
 		return
 	}
 
-	// add new superuser
-	users[req.Identity] = User{
-		Identity: req.Identity,
-		Password: string(hashedPassword),
+	items := make([]gin.H, 0, len(users))
+	for _, user := range users {
+		items = append(items, superUserView(user))
 	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i]["identity"].(string) < items[j]["identity"].(string)
+	})
 
-	// write back to file
-	data, err := json.MarshalIndent(users, "", "  ")
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(items),
+		"items": items,
+	})
+}
+
+// UpdateSuperUserHandler changes the name or role of a superuser. The last
+// owner can't be given another role.
+func UpdateSuperUserHandler(c *gin.Context) {
+	var req struct {
+		Name *string `json:"name"`
+		Role *string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON: %v", err)})
+		return
+	}
+	if req.Role != nil && !checkGrantableRole(c, *req.Role) {
+		return
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	users, err := loadSuperUsers(superUsersPath)
 	if err != nil {
-		log.Printf("failed to marshal users: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save user"})
+		log.Printf("failed to load superusers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read users"})
+		return
+	}
+
+	identity := c.Param("identity")
+	user, ok := users[identity]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		log.Printf("failed to write file: %v", err)
+	if req.Role != nil && *req.Role != RoleOwner && superUserView(user)["role"] == RoleOwner {
+		// taking an owner's role needs the owner permissions as well
+		if !checkGrantableRole(c, RoleOwner) {
+			return
+		}
+		owners := 0
+		for _, u := range users {
+			if superUserView(u)["role"] == RoleOwner {
+				owners++
+			}
+		}
+		if owners == 1 {
+			c.JSON(http.StatusConflict, gin.H{"error": "The last owner can't be given another role"})
+			return
+		}
+	}
+
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+	if req.Role != nil {
+		user.Role = *req.Role
+	}
+	users[identity] = user
+
+	if err := saveSuperUsers(superUsersPath, users); err != nil {
+		log.Printf("failed to save superusers: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save user"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"status": "created",
-		"user":   req.Identity,
+		"status": "updated",
+		"user":   superUserView(user),
 	})
 }
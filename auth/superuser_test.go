@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"encoding/json"
+	"go-database-json/storage"
+	"os"
+	"testing"
+)
+
+// putSuperUser stores a superuser with the given role
+func putSuperUser(t *testing.T, identity, role string) {
+	t.Helper()
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	users, err := loadSuperUsers(superUsersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addSuperUser(users, identity, identity, "Str0ng!Passw0rd#x", role); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSuperUsersCache checks that the cache picks up changes made to the
+// file by another process, like the "superuser create" command
+func TestSuperUsersCache(t *testing.T) {
+	resetAuth(t)
+
+	lookup := func(identity string, want bool) {
+		t.Helper()
+		_, ok, err := lookupSuperUser(identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("lookupSuperUser(%s) = %v, want %v", identity, ok, want)
+		}
+	}
+	write := func(users map[string]SuperUser, atomic bool) {
+		t.Helper()
+		data, err := json.Marshal(users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if atomic {
+			err = storage.WriteFileAtomic(superUsersPath, data, 0600)
+		} else {
+			err = os.WriteFile(superUsersPath, data, 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lookup("alice", false)
+
+	write(map[string]SuperUser{"alice": {Identity: "alice"}}, true)
+	lookup("alice", true)
+
+	write(map[string]SuperUser{"alice": {Identity: "alice"}, "bob": {Identity: "bob"}}, true)
+	lookup("bob", true)
+
+	// written in place, the size changes
+	write(map[string]SuperUser{"carol": {Identity: "carol"}}, false)
+	lookup("carol", true)
+	lookup("alice", false)
+
+	if err := os.Remove(superUsersPath); err != nil {
+		t.Fatal(err)
+	}
+	lookup("carol", false)
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the test vectors in RFC 4226 and RFC 6238
+const rfcSecret = "12345678901234567890"
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	codes := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, want := range codes {
+		if code := hotp([]byte(rfcSecret), uint64(counter), 6); code != want {
+			t.Errorf("hotp(%d) = %s, want %s", counter, code, want)
+		}
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1 with 8 digits and 30 second steps
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	secret := base32NoPadding.EncodeToString([]byte(rfcSecret))
+	for _, tt := range tests {
+		step := tt.unix / totpPeriod
+		if code := hotp([]byte(rfcSecret), uint64(step), 8); code != tt.code {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, code, tt.code)
+		}
+
+		// the six digit codes are the last digits of the same value
+		code, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code[2:] {
+			t.Errorf("T=%d: totpCode = %s, want %s", tt.unix, code, tt.code[2:])
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := base32NoPadding.EncodeToString([]byte(rfcSecret))
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	code := func(step int64) string {
+		c, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{"current step", code(current), 0, current, true},
+		{"previous step", code(current - 1), 0, current - 1, true},
+		{"next step", code(current + 1), 0, current + 1, true},
+		{"too old", code(current - 2), 0, 0, false},
+		{"too new", code(current + 2), 0, 0, false},
+		{"surrounding spaces", " " + code(current) + " ", 0, current, true},
+		{"replayed", code(current), current, 0, false},
+		{"older than last use", code(current - 1), current - 1, 0, false},
+		{"eight digits", "14050471", 0, 0, false},
+		{"empty", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(secret, tt.code, tt.lastStep, now)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("%s: got (%d, %v), want (%d, %v)", tt.name, step, ok, tt.step, tt.ok)
+		}
+	}
+
+	if _, ok := verifyTOTP("not base32!", "123456", 0, now); ok {
+		t.Error("invalid secret accepted")
+	}
+}
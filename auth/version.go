@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"errors"
+	"go-database-json/storage"
+	"log"
+	"sync"
+)
+
+// tokenVersionField holds the token version in customer records
+const tokenVersionField = "tokenVersion"
+
+// tokenAccount is what a token is checked against on every request
+type tokenAccount struct {
+	// ID is the record id of a customer, signed tokens stay bound to the
+	// record even if a new account takes over the identity
+	ID      string
+	Version int
+}
+
+var (
+	// tokenAccounts caches the customers seen since start, signed tokens
+	// are verified against it without scanning the customers collection.
+	// Superusers are looked up in their own cache.
+	tokenAccounts   = make(map[string]tokenAccount)
+	tokenAccountsMu sync.RWMutex
+	// tokenAccountsGen counts changes, a lookup only caches what it read
+	// if no change happened meanwhile
+	tokenAccountsGen uint64
+)
+
+func accountKey(identity, role string) string {
+	return role + ":" + identity
+}
+
+// lookupTokenAccount returns the account a token of the user is checked
+// against. Unknown users get errInvalidToken.
+func lookupTokenAccount(identity, role string) (tokenAccount, error) {
+	switch role {
+	case RoleSuperuser:
+		user, ok, err := lookupSuperUser(identity)
+		if err != nil {
+			return tokenAccount{}, err
+		}
+		if !ok {
+			return tokenAccount{}, errInvalidToken
+		}
+		return tokenAccount{Version: user.TokenVersion}, nil
+	case RoleCustomer:
+	default:
+		return tokenAccount{}, errInvalidToken
+	}
+
+	tokenAccountsMu.RLock()
+	account, ok := tokenAccounts[accountKey(identity, role)]
+	gen := tokenAccountsGen
+	tokenAccountsMu.RUnlock()
+	if ok {
+		return account, nil
+	}
+
+	unlock := storage.Locks.RLockCollection(CustomersCollection)
+	customer, err := findCustomer(identity)
+	unlock()
+	if errors.Is(err, errCustomerNotFound) {
+		return tokenAccount{}, errInvalidToken
+	}
+	if err != nil {
+		return tokenAccount{}, err
+	}
+	account = tokenAccount{ID: customer.ID, Version: customerTokenVersion(customer.Data)}
+
+	tokenAccountsMu.Lock()
+	if gen == tokenAccountsGen {
+		tokenAccounts[accountKey(identity, role)] = account
+	}
+	tokenAccountsMu.Unlock()
+	return account, nil
+}
+
+// setTokenVersion makes the cache pick up a new token version of a user,
+// the version itself is read from the account on the next lookup
+func setTokenVersion(identity, role string, version int) {
+	tokenAccountsMu.Lock()
+	defer tokenAccountsMu.Unlock()
+	tokenAccountsGen++
+	if account, ok := tokenAccounts[accountKey(identity, role)]; ok {
+		account.Version = version
+		tokenAccounts[accountKey(identity, role)] = account
+	}
+}
+
+// ForgetCustomer logs out the customer stored in data after the record was
+// deleted or given another identity. Its stored sessions are revoked and
+// signed tokens are rejected as the identity no longer resolves to the record.
+func ForgetCustomer(data map[string]interface{}) {
+	identity, _ := data["identity"].(string)
+	if identity == "" {
+		return
+	}
+
+	tokenAccountsMu.Lock()
+	tokenAccountsGen++
+	delete(tokenAccounts, accountKey(identity, RoleCustomer))
+	tokenAccountsMu.Unlock()
+
+	if err := revokeUserSessions(identity, RoleCustomer); err != nil {
+		log.Printf("failed to revoke sessions of %s: %v", identity, err)
+	}
+}
+
+func customerTokenVersion(data map[string]interface{}) int {
+	// numbers read from JSON are float64
+	if version, ok := data[tokenVersionField].(float64); ok {
+		return int(version)
+	}
+	if version, ok := data[tokenVersionField].(int); ok {
+		return version
+	}
+	return 0
+}
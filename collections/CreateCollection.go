@@ -1,15 +1,13 @@
 package collections
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gosimple/slug"
+	"go-database-json/storage"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"time"
 )
 
@@ -26,28 +24,11 @@ func CreateCollection(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid 'name' field"})
 		return
 	}
-	s := slug.Make(name)
-	id := uuid.New()
-
-	basePath := "database"
-	collectionPath := filepath.Join(basePath, id.String())
-	filePath := collectionPath + "/config.json"
-
-	if err := os.MkdirAll(collectionPath, os.ModePerm); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create collection: %v", err)})
+	if !checkCollectionName(c, body) || !checkSchemaField(c, body) || !checkRuleFields(c, body) || !checkOwnerField(c, body) {
 		return
 	}
-
-	// Open the file for writing
-	file, err := os.Create(filePath)
-	if err != nil {
-		log.Fatalf("failed to create file: %v", err)
-	}
-	defer file.Close()
-
-	// Encode content as pretty JSON
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
+	s := slug.Make(name)
+	id := uuid.New()
 
 	now := time.Now()
 	germanDate := now.Format("02.01.2006 15:04")
@@ -56,17 +37,30 @@ func CreateCollection(c *gin.Context) {
 		"name":    name,
 		"created": germanDate,
 	}
-
-	if err := encoder.Encode(content); err != nil {
-		log.Fatalf("failed to write JSON: %v", err)
+	if recordSchema, ok := body["schema"].(map[string]interface{}); ok {
+		content["schema"] = recordSchema
+	}
+	for _, field := range ruleFields {
+		if rule, ok := body[field].(string); ok {
+			content[field] = rule
+		}
+	}
+	if owner, ok := body["ownerField"].(string); ok {
+		content["ownerField"] = owner
 	}
 
-	fmt.Printf("JSON file created: %s\n", filePath)
+	unlock := storage.Locks.LockCollection(id.String())
+	defer unlock()
+
+	if err := storage.Default.CreateCollection(id.String(), content); err != nil {
+		log.Printf("failed to create collection: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create collection: %v", err)})
+		return
+	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"message":           fmt.Sprintf("Collection '%s' created at '%s'", name, filePath),
-		"path":              collectionPath,
-		"collection_config": filePath,
-		"slug":              s,
+		"message": fmt.Sprintf("Collection '%s' created with id '%s'", name, id),
+		"id":      id.String(),
+		"slug":    s,
 	})
 }
@@ -1,54 +1,39 @@
 package collections
 
 import (
-	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"go-database-json/storage"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 )
 
 func GetCollection(c *gin.Context) {
 	collection := c.Param("collection")
-	dirPath := filepath.Join("database", collection)
-	configPath := filepath.Join(dirPath, "config.json")
 
-	// read config.json
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Collection config not found"})
-		return
-	}
+	unlock := storage.Locks.RLockCollection(collection)
+	defer unlock()
 
-	// parse JSON
-	var raw map[string]interface{}
-	if err := json.Unmarshal(data, &raw); err != nil {
+	// read the collection config
+	raw, err := storage.Default.GetCollection(collection)
+	if err != nil {
+		if errors.Is(err, storage.ErrCollectionNotFound) || errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Collection config not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid config.json"})
 		return
 	}
 
-	// count JSON files (excluding config.json)
-	files, err := os.ReadDir(dirPath)
+	// count the records
+	records, err := storage.Default.ListRecords(collection)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read collection directory"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read collection"})
 		return
 	}
 
-	count := 0
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-		name := file.Name()
-		if strings.HasSuffix(name, ".json") && name != "config.json" {
-			count++
-		}
-	}
-
 	c.JSON(http.StatusOK, gin.H{
 		"collection": collection,
 		"config":     raw,
-		"count":      count,
+		"count":      len(records),
 	})
 }
@@ -1,9 +1,11 @@
 package collections
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
+	"go-database-json/auth"
+	"go-database-json/storage"
 	"net/http"
-	"os"
 )
 
 func RemoveCollection(c *gin.Context) {
@@ -17,25 +19,21 @@ func RemoveCollection(c *gin.Context) {
 		return
 	}
 
-	folderPath := "database/" + collectionName
-
-	// Check if folder exists and is a directory
-	info, err := os.Stat(folderPath)
-	if os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Collection folder does not exist"})
-		return
-	}
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	if !info.IsDir() {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Specified path is not a directory"})
+	// dropping the customers would delete every customer account
+	if collectionName == auth.CustomersCollection {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The customers collection can't be deleted"})
 		return
 	}
 
-	// Remove the folder and all its contents
-	if err := os.RemoveAll(folderPath); err != nil {
+	unlock := storage.Locks.LockCollection(collectionName)
+	defer unlock()
+
+	// Remove the collection and all its records
+	if err := storage.Default.DropCollection(collectionName); err != nil {
+		if errors.Is(err, storage.ErrCollectionNotFound) || errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Collection folder does not exist"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete collection folder"})
 		return
 	}
@@ -1,15 +1,17 @@
 package collections
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"go-database-json/auth"
+	"go-database-json/storage"
 	"net/http"
-	"os"
-	"path/filepath"
 	"time"
 )
 
+// UpdateCollection merges the request body into the collection config.
+// Fields set to null are removed, e.g. {"schema": null} drops the schema.
 func UpdateCollection(c *gin.Context) {
 	id := c.Param("collection")
 	if id == "" {
@@ -17,21 +19,6 @@ func UpdateCollection(c *gin.Context) {
 		return
 	}
 
-	dir := "database/" + id
-
-	// check if dir exists
-	info, err := os.Stat(dir)
-	if os.IsNotExist(err) {
-		fmt.Printf("directory %s does not exist\n", dir)
-		os.Exit(1) // or return error if inside a function
-	}
-
-	// check if it's really a directory
-	if !info.IsDir() {
-		fmt.Printf("%s exists but is not a directory\n", dir)
-		os.Exit(1)
-	}
-
 	// parse JSON body into a map
 	var body map[string]interface{}
 	if err := c.ShouldBindJSON(&body); err != nil {
@@ -39,45 +26,64 @@ func UpdateCollection(c *gin.Context) {
 		return
 	}
 
-	// ensure database/{id} directory exists
-	dir = filepath.Join("database", id)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("could not create directory: %v", err)})
+	// the customers collection keeps its name, rules and schema may change
+	if id == auth.CustomersCollection {
+		if name, ok := body["name"]; ok && name != auth.CustomersCollection {
+			c.JSON(http.StatusForbidden, gin.H{"error": "The customers collection can't be renamed"})
+			return
+		}
+		if kind, ok := body["type"]; ok && kind != "auth" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "The customers collection must stay an auth collection"})
+			return
+		}
+	} else if !checkCollectionName(c, body) {
+		return
+	}
+	if !checkSchemaField(c, body) || !checkRuleFields(c, body) || !checkOwnerField(c, body) {
 		return
 	}
 
-	// file path
-	filePath := filepath.Join(dir, "config.json")
+	unlock := storage.Locks.LockCollection(id)
+	defer unlock()
 
-	// marshal the original body
-	data, err := json.MarshalIndent(body, "", "  ")
+	// load the current config
+	config, err := storage.Default.GetCollection(id)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to encode JSON: %v", err)})
+		if errors.Is(err, storage.ErrCollectionNotFound) || errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("collection %s does not exist", id)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to read config: %v", err)})
 		return
 	}
 
+	for key, value := range body {
+		if key == "created" {
+			continue
+		}
+		if value == nil {
+			delete(config, key)
+		} else {
+			config[key] = value
+		}
+	}
+
 	// append German date just before writing
 	now := time.Now()
 	germanDate := now.Format("02.01.2006 15:04:05")
-	body["created"] = germanDate
-
-	// re-marshal body with germanDate
-	data, err = json.MarshalIndent(body, "", "  ")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to encode JSON with date: %v", err)})
-		return
-	}
+	config["updated"] = germanDate
 
-	// write JSON to file
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to write file: %v", err)})
+	// write the new config
+	if err := storage.Default.UpdateCollection(id, config); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to write config: %v", err)})
 		return
 	}
 
 	// success
 	c.JSON(http.StatusOK, gin.H{
 		"message": "collection updated",
-		"path":    filePath,
+		"id":      id,
 		"date":    germanDate,
+		"config":  config,
 	})
 }
@@ -0,0 +1,155 @@
+package collections
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go-database-json/auth"
+	"go-database-json/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	previous := storage.Default
+	storage.Default = storage.NewMemoryStorage()
+	t.Cleanup(func() { storage.Default = previous })
+
+	r := gin.New()
+	r.GET("/", ListCollection)
+	r.POST("/", CreateCollection)
+	r.GET("/:collection", GetCollection)
+	r.PATCH("/:collection", UpdateCollection)
+	r.DELETE("/:collection", RemoveCollection)
+	return r
+}
+
+func serve(r *gin.Engine, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var out map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out
+}
+
+func TestCollectionLifecycle(t *testing.T) {
+	r := newTestRouter(t)
+
+	code, body := serve(r, "POST", "/", `{"name": "Notes", "listRule": "", "schema": {"type": "object"}}`)
+	if code != http.StatusCreated {
+		t.Fatalf("create: %d %v", code, body)
+	}
+	id := body["id"].(string)
+
+	config, err := storage.Default.GetCollection(id)
+	if err != nil || config["name"] != "Notes" || config["listRule"] != "" || config["schema"] == nil {
+		t.Fatalf("stored config %v: %v", config, err)
+	}
+
+	storage.Default.PutRecord(id, "r1", map[string]interface{}{"title": "x"})
+	code, body = serve(r, "GET", "/"+id, "")
+	if code != http.StatusOK || body["count"] != float64(1) {
+		t.Errorf("get: %d %v", code, body)
+	}
+
+	code, body = serve(r, "PATCH", "/"+id, `{"schema": null, "viewRule": "", "created": "never"}`)
+	if code != http.StatusOK {
+		t.Fatalf("update: %d %v", code, body)
+	}
+	config, _ = storage.Default.GetCollection(id)
+	if _, ok := config["schema"]; ok || config["viewRule"] != "" || config["created"] == "never" {
+		t.Errorf("updated config %v", config)
+	}
+
+	code, body = serve(r, "GET", "/", "")
+	if code != http.StatusOK || len(body["collections"].([]interface{})) != 1 {
+		t.Errorf("list: %d %v", code, body)
+	}
+
+	if code, _ := serve(r, "DELETE", "/"+id, `{}`); code != http.StatusOK {
+		t.Errorf("delete: %d", code)
+	}
+	if code, _ := serve(r, "GET", "/"+id, ""); code != http.StatusNotFound {
+		t.Errorf("get after delete: %d", code)
+	}
+	if code, _ := serve(r, "DELETE", "/"+id, `{}`); code != http.StatusNotFound {
+		t.Errorf("second delete: %d", code)
+	}
+}
+
+func TestCollectionValidation(t *testing.T) {
+	r := newTestRouter(t)
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{}`, http.StatusBadRequest},
+		{`{"name": ""}`, http.StatusBadRequest},
+		{`{"name": "x", "schema": "object"}`, http.StatusBadRequest},
+		{`{"name": "x", "schema": {"type": "thing"}}`, http.StatusBadRequest},
+		{`{"name": "x", "listRule": 1}`, http.StatusBadRequest},
+		{`{"name": "x", "listRule": "age >"}`, http.StatusBadRequest},
+		{`{"name": "x", "ownerField": "owner.id"}`, http.StatusBadRequest},
+		{`{"name": "x", "ownerField": "createdBy"}`, http.StatusBadRequest},
+		{`{"name": "x", "ownerField": 1}`, http.StatusBadRequest},
+		{`{"name": "x", "listRule": null, "viewRule": "", "ownerField": "owner"}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		if code, body := serve(r, "POST", "/", tt.body); code != tt.code {
+			t.Errorf("create %s: %d %v, want %d", tt.body, code, body, tt.code)
+		}
+	}
+}
+
+func TestCustomersCollectionProtected(t *testing.T) {
+	r := newTestRouter(t)
+	if err := auth.EnsureCustomersCollection(); err != nil {
+		t.Fatal(err)
+	}
+	storage.Default.PutRecord(auth.CustomersCollection, "c1", map[string]interface{}{"identity": "ann"})
+
+	code, body := serve(r, "POST", "/", `{"name": "Notes"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("create: %d %v", code, body)
+	}
+	notes := body["id"].(string)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"DELETE", "/customers", `{}`, http.StatusForbidden},
+		{"PATCH", "/customers", `{"name": "people"}`, http.StatusForbidden},
+		{"PATCH", "/customers", `{"name": null}`, http.StatusForbidden},
+		{"PATCH", "/customers", `{"type": null}`, http.StatusForbidden},
+		{"POST", "/", `{"name": "customers"}`, http.StatusConflict},
+		{"POST", "/", `{"name": "Customers "}`, http.StatusConflict},
+		{"PATCH", "/" + notes, `{"name": "Customers"}`, http.StatusConflict},
+		{"PATCH", "/customers", `{"name": "customers", "listRule": ""}`, http.StatusOK},
+		{"PATCH", "/" + notes, `{"name": "Customer notes"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code, body := serve(r, tt.method, tt.path, tt.body); code != tt.code {
+			t.Errorf("%s %s %s: %d %v, want %d", tt.method, tt.path, tt.body, code, body, tt.code)
+		}
+	}
+
+	config, err := storage.Default.GetCollection(auth.CustomersCollection)
+	if err != nil || config["name"] != auth.CustomersCollection || config["type"] != "auth" {
+		t.Errorf("customers config %v: %v", config, err)
+	}
+	if _, err := storage.Default.GetRecord(auth.CustomersCollection, "c1"); err != nil {
+		t.Errorf("customer record: %v", err)
+	}
+}
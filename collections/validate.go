@@ -0,0 +1,100 @@
+package collections
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gosimple/slug"
+	"go-database-json/auth"
+	"go-database-json/query"
+	"go-database-json/schema"
+	"go-database-json/storage"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// checkSchemaField validates the optional 'schema' field of a collection
+// config. It answers with 400 and returns false if the schema is invalid.
+func checkSchemaField(c *gin.Context, body map[string]interface{}) bool {
+	raw, ok := body["schema"]
+	if !ok || raw == nil {
+		return true
+	}
+
+	recordSchema, ok := raw.(map[string]interface{})
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "'schema' must be a JSON object"})
+		return false
+	}
+	if err := schema.Check(recordSchema); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid schema: %v", err)})
+		return false
+	}
+	return true
+}
+
+// ruleFields are the access rules a collection config may hold
+var ruleFields = []string{"listRule", "viewRule", "createRule", "updateRule", "deleteRule"}
+
+// checkRuleFields validates the access rules of a collection config. A rule
+// is null (superusers only), empty (everyone) or a filter expression.
+// It answers with 400 and returns false if a rule is invalid.
+func checkRuleFields(c *gin.Context, body map[string]interface{}) bool {
+	for _, field := range ruleFields {
+		raw, ok := body[field]
+		if !ok || raw == nil {
+			continue
+		}
+
+		expr, ok := raw.(string)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("'%s' must be a string or null", field)})
+			return false
+		}
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		if _, err := query.ParseFilter(expr); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s: %v", field, err)})
+			return false
+		}
+	}
+	return true
+}
+
+var fieldName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkOwnerField validates the optional 'ownerField' of a collection config,
+// the top-level record field holding the identity of the owning customer.
+// It answers with 400 and returns false if the field is invalid.
+func checkOwnerField(c *gin.Context, body map[string]interface{}) bool {
+	raw, ok := body["ownerField"]
+	if !ok || raw == nil {
+		return true
+	}
+
+	field, ok := raw.(string)
+	if !ok || !fieldName.MatchString(field) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "'ownerField' must be a field name or null"})
+		return false
+	}
+	for _, system := range storage.SystemFields {
+		if field == system {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("'ownerField' can't be the system field '%s'", field)})
+			return false
+		}
+	}
+	return true
+}
+
+// checkCollectionName refuses collection names that would pass for the
+// customers auth collection. It answers with 409 and returns false if the
+// name is taken.
+func checkCollectionName(c *gin.Context, body map[string]interface{}) bool {
+	name, ok := body["name"].(string)
+	if ok && slug.Make(name) == auth.CustomersCollection {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("The name '%s' is reserved for the customers collection", name)})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go-database-json/auth"
+	"go-database-json/storage"
+)
+
+const usage = `usage:
+  go-database-json                                                          start the server
+  go-database-json superuser create [--force] <identity> <password> [name]  add a superuser,
+                                                                            --force adds another owner if superusers exist`
+
+// runCommand executes a command given on the command line instead of
+// starting the server
+func runCommand(args []string) error {
+	force := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "--force" {
+			force = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+
+	if len(rest) >= 4 && len(rest) <= 5 && rest[0] == "superuser" && rest[1] == "create" {
+		name := ""
+		if len(rest) == 5 {
+			name = rest[4]
+		}
+
+		// the server caches and rewrites the auth files, so they are only
+		// changed while it is stopped
+		release, err := storage.LockDirectory("database")
+		if errors.Is(err, storage.ErrDirectoryLocked) {
+			return errors.New("the server is running, stop it before creating a superuser")
+		}
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		if err := auth.CreateSuperUser(rest[2], name, rest[3], force); err != nil {
+			return err
+		}
+		fmt.Printf("superuser %s created\n", rest[2])
+		return nil
+	}
+	return errors.New(usage)
+}
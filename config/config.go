@@ -0,0 +1,277 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Config holds the server settings read from config.json.
+// Missing fields keep their default values.
+type Config struct {
+	PasswordPolicy PasswordPolicy `json:"passwordPolicy"`
+	Sessions       Sessions       `json:"sessions"`
+	// RateLimits configures the rate limit policies by name, the server
+	// uses "login", "register", "reads" and "writes"
+	RateLimits map[string]RateLimit `json:"rateLimits"`
+	Lockout    Lockout              `json:"lockout"`
+	// Roles maps superuser roles to their permissions. The built-in roles
+	// can be changed except for owner, which always has every permission.
+	Roles map[string][]string `json:"roles"`
+	MFA   MFA                 `json:"mfa"`
+	Mail  Mail                `json:"mail"`
+	OAuth OAuth               `json:"oauth"`
+	// TrustedProxies lists the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header is believed. By default no proxy is
+	// trusted and the client IP is the address of the connection.
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// OAuth configures login of customers with external OAuth2 and OpenID
+// Connect providers
+type OAuth struct {
+	// Providers maps provider names, as used in the routes, to their settings
+	Providers map[string]OAuthProvider `json:"providers"`
+	// StateTTL is how long a started login may take to come back
+	StateTTL Duration `json:"stateTtl"`
+}
+
+// OAuthProvider is either a preset ("google", "gitlab" or "github"), a
+// generic OpenID Connect provider found through Issuer, or a plain OAuth2
+// provider with explicit endpoints. Endpoints set here override the preset
+// and discovery.
+type OAuthProvider struct {
+	Preset       string   `json:"preset"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+	AuthURL      string   `json:"authUrl"`
+	TokenURL     string   `json:"tokenUrl"`
+	UserInfoURL  string   `json:"userInfoUrl"`
+	// RedirectURL is where the provider sends customers back to, it has to
+	// be registered with the provider
+	RedirectURL string `json:"redirectUrl"`
+	// AllowSignup creates a customer account on the first login of an
+	// unknown external identity
+	AllowSignup bool `json:"allowSignup"`
+}
+
+// Mail configures how mails to customers are sent
+type Mail struct {
+	// Driver is "log" to only log mails, "file" to write them to Dir or
+	// "smtp" to send them
+	Driver string `json:"driver"`
+	From   string `json:"from"`
+	Dir    string `json:"dir"`
+	SMTP   SMTP   `json:"smtp"`
+	// TemplatesDir holds templates replacing the built-in ones
+	TemplatesDir string `json:"templatesDir"`
+	// AppURL is the address of the app the links in mails point to
+	AppURL string `json:"appUrl"`
+}
+
+type SMTP struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// MFA configures two-factor authentication of superusers
+type MFA struct {
+	// Policy is "optional" or "required". When required, superusers without
+	// MFA have to enroll during their next login.
+	Policy string `json:"policy"`
+	// Issuer is the account label shown in authenticator apps
+	Issuer string `json:"issuer"`
+}
+
+// Lockout locks an account for Duration after MaxFailures failed logins in
+// a row. A MaxFailures of 0 turns it off.
+type Lockout struct {
+	MaxFailures int      `json:"maxFailures"`
+	Duration    Duration `json:"duration"`
+}
+
+// PasswordPolicy is enforced when accounts are registered
+type PasswordPolicy struct {
+	MinLength int `json:"minLength"`
+	// RejectCommon rejects passwords from the bundled list of common passwords
+	RejectCommon bool `json:"rejectCommon"`
+}
+
+// Sessions controls the lifetime of issued tokens
+type Sessions struct {
+	// TTL is how long a token stays valid
+	TTL Duration `json:"ttl"`
+	// Sliding pushes the expiry of a token back whenever it is used,
+	// it has no effect on signed tokens
+	Sliding bool `json:"sliding"`
+	JWT     JWT  `json:"jwt"`
+}
+
+// JWT switches logins to HS256 signed tokens that are verified without
+// looking them up in the token store. As they are not stored, the sessions
+// endpoints can't list or revoke them, a password change ends all of them.
+type JWT struct {
+	Enabled bool   `json:"enabled"`
+	Secret  string `json:"secret"`
+}
+
+// RateLimit allows Requests per Per with bursts of up to Burst requests.
+// A policy without requests is not limited.
+type RateLimit struct {
+	Requests int      `json:"requests"`
+	Per      Duration `json:"per"`
+	Burst    int      `json:"burst"`
+	// Key is what requests are counted by: "ip", "identity" or "apiKey".
+	// Requests without identity or API key are counted by IP.
+	Key string `json:"key"`
+}
+
+// Duration is written as a Go duration string like "30m" or "24h"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"24h\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Current is the configuration the server runs with
+var Current = Default()
+
+func Default() Config {
+	return Config{
+		PasswordPolicy: PasswordPolicy{
+			MinLength:    8,
+			RejectCommon: true,
+		},
+		Sessions: Sessions{
+			TTL: Duration(24 * time.Hour),
+		},
+		RateLimits: map[string]RateLimit{
+			"login":    {Requests: 10, Per: Duration(time.Minute), Burst: 5, Key: "ip"},
+			"register": {Requests: 10, Per: Duration(time.Hour), Burst: 3, Key: "ip"},
+			"reads":    {Requests: 600, Per: Duration(time.Minute), Burst: 100, Key: "identity"},
+			"writes":   {Requests: 120, Per: Duration(time.Minute), Burst: 30, Key: "identity"},
+		},
+		Lockout: Lockout{
+			MaxFailures: 5,
+			Duration:    Duration(15 * time.Minute),
+		},
+		Roles: map[string][]string{
+			"owner":  {"*"},
+			"admin":  {"collections:*", "records:*", "apikeys:manage", "audit:read"},
+			"editor": {"collections:read", "records:*"},
+			"viewer": {"collections:read", "records:read:*"},
+		},
+		MFA: MFA{
+			Policy: "optional",
+			Issuer: "go-database-json",
+		},
+		Mail: Mail{
+			Driver:       "log",
+			From:         "no-reply@localhost",
+			Dir:          "mails",
+			SMTP:         SMTP{Port: 587},
+			TemplatesDir: "mail-templates",
+			AppURL:       "http://localhost:8080",
+		},
+		OAuth: OAuth{
+			StateTTL: Duration(10 * time.Minute),
+		},
+	}
+}
+
+// Load reads the config file into Current. A missing file keeps the defaults.
+func Load(path string) error {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		Current = cfg
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	if cfg.Sessions.TTL <= 0 {
+		return fmt.Errorf("sessions.ttl must be positive")
+	}
+	for name, limit := range cfg.RateLimits {
+		if limit.Requests < 0 || (limit.Requests > 0 && limit.Per <= 0) {
+			return fmt.Errorf("rateLimits.%s needs positive requests and per", name)
+		}
+		switch limit.Key {
+		case "", "ip", "identity", "apiKey":
+		default:
+			return fmt.Errorf("rateLimits.%s: unknown key %q", name, limit.Key)
+		}
+	}
+	if cfg.Lockout.MaxFailures < 0 || (cfg.Lockout.MaxFailures > 0 && cfg.Lockout.Duration <= 0) {
+		return fmt.Errorf("lockout needs positive maxFailures and duration")
+	}
+	if owner := cfg.Roles["owner"]; len(owner) != 1 || owner[0] != "*" {
+		return fmt.Errorf("roles.owner can't be changed")
+	}
+	if cfg.MFA.Policy != "optional" && cfg.MFA.Policy != "required" {
+		return fmt.Errorf("mfa.policy must be \"optional\" or \"required\"")
+	}
+	switch cfg.Mail.Driver {
+	case "log", "file":
+	case "smtp":
+		if cfg.Mail.SMTP.Host == "" {
+			return fmt.Errorf("mail.smtp.host is required for the smtp driver")
+		}
+	default:
+		return fmt.Errorf("mail.driver must be \"log\", \"file\" or \"smtp\"")
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if net.ParseIP(proxy) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			return fmt.Errorf("trustedProxies: %q is no IP address or CIDR range", proxy)
+		}
+	}
+	if cfg.OAuth.StateTTL <= 0 {
+		return fmt.Errorf("oauth.stateTtl must be positive")
+	}
+	for name, provider := range cfg.OAuth.Providers {
+		switch provider.Preset {
+		case "", "google", "gitlab", "github":
+		default:
+			return fmt.Errorf("oauth.providers.%s: unknown preset %q", name, provider.Preset)
+		}
+		if provider.ClientID == "" || provider.RedirectURL == "" {
+			return fmt.Errorf("oauth.providers.%s needs clientId and redirectUrl", name)
+		}
+		if provider.Preset == "" && provider.Issuer == "" && (provider.AuthURL == "" || provider.TokenURL == "" || provider.UserInfoURL == "") {
+			return fmt.Errorf("oauth.providers.%s needs a preset, an issuer or authUrl, tokenUrl and userInfoUrl", name)
+		}
+	}
+	if cfg.Sessions.JWT.Enabled && len(cfg.Sessions.JWT.Secret) < 32 {
+		return fmt.Errorf("sessions.jwt.secret must be at least 32 characters long")
+	}
+	Current = cfg
+	return nil
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTrustedProxies(t *testing.T) {
+	tests := []struct {
+		content string
+		proxies []string
+		err     string
+	}{
+		{`{}`, nil, ``},
+		{`{"trustedProxies": ["10.0.0.1", "192.168.0.0/16", "::1", "fd00::/8"]}`, []string{"10.0.0.1", "192.168.0.0/16", "::1", "fd00::/8"}, ``},
+		{`{"trustedProxies": ["proxy.local"]}`, nil, `"proxy.local" is no IP address or CIDR range`},
+		{`{"trustedProxies": ["10.0.0.0/33"]}`, nil, `"10.0.0.0/33" is no IP address or CIDR range`},
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() { Current = Default() })
+
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := Load(path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load(%s) = %v, want %q", tt.content, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Load(%s): %v", tt.content, err)
+			continue
+		}
+		if strings.Join(Current.TrustedProxies, ",") != strings.Join(tt.proxies, ",") {
+			t.Errorf("Load(%s): trusted proxies %v, want %v", tt.content, Current.TrustedProxies, tt.proxies)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-database-json/config"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a plain text mail
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer delivers mails
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Default is the mailer the server sends mails with, set by Configure
+var Default Mailer = LogMailer{}
+
+var errHeaderInjection = errors.New("mail header contains a line break")
+
+// Configure sets Default according to the mail config
+func Configure(cfg config.Mail) error {
+	switch cfg.Driver {
+	case "log":
+		Default = LogMailer{}
+	case "file":
+		if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+			return err
+		}
+		Default = FileMailer{Dir: cfg.Dir, From: cfg.From}
+	case "smtp":
+		Default = SMTPMailer{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			From:     cfg.From,
+		}
+	default:
+		return fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+	return nil
+}
+
+// LogMailer only logs mails, for development
+type LogMailer struct{}
+
+func (LogMailer) Send(msg Message) error {
+	log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+// FileMailer writes every mail as .eml file into Dir, for development
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m FileMailer) Send(msg Message) error {
+	data, err := msg.bytes(m.From)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix) + ".eml"
+	return os.WriteFile(filepath.Join(m.Dir, name), data, 0600)
+}
+
+// SMTPMailer sends mails through an SMTP server. STARTTLS is used when the
+// server offers it, credentials are only sent over TLS or to localhost.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(msg Message) error {
+	data, err := msg.bytes(m.From)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, data)
+}
+
+// bytes renders the message with headers as sent over SMTP
+func (msg Message) bytes(from string) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errHeaderInjection
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	body := quotedprintable.NewWriter(&buf)
+	if _, err := body.Write([]byte(strings.ReplaceAll(msg.Text, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,206 @@
+package mail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// smtpSession is what the stub server received in one connection
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// smtpStub accepts one SMTP session on a local port and sends what it
+// received on the returned channel
+func smtpStub(t *testing.T) (int, <-chan smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var session smtpSession
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP stub")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				text.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			case "AUTH":
+				mechanism, credentials, _ := strings.Cut(arg, " ")
+				decoded, err := base64.StdEncoding.DecodeString(credentials)
+				if mechanism != "PLAIN" || err != nil {
+					text.PrintfLine("504 unsupported")
+					continue
+				}
+				session.auth = string(decoded)
+				text.PrintfLine("235 authenticated")
+			case "MAIL":
+				session.from = arg
+				text.PrintfLine("250 ok")
+			case "RCPT":
+				session.to = append(session.to, arg)
+				text.PrintfLine("250 ok")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				session.data = string(data)
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				sessions <- session
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, sessions
+}
+
+func TestSMTPMailer(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		auth     string
+	}{
+		{"with credentials", "mailer", "\x00mailer\x00secret"},
+		{"without credentials", "", ""},
+	}
+
+	for _, tt := range tests {
+		port, sessions := smtpStub(t)
+		mailer := SMTPMailer{Host: "127.0.0.1", Port: port, Username: tt.username, Password: "secret", From: "app@example.com"}
+		text := "Hello Jürgen,\n\nopen https://example.com/reset?token=abc\n"
+		if err := mailer.Send(Message{To: "juergen@example.com", Subject: "Passwort zurücksetzen", Text: text}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		session := <-sessions
+		if session.auth != tt.auth {
+			t.Errorf("%s: auth %q, want %q", tt.name, session.auth, tt.auth)
+		}
+		if session.from != "FROM:<app@example.com>" {
+			t.Errorf("%s: MAIL %s", tt.name, session.from)
+		}
+		if len(session.to) != 1 || session.to[0] != "TO:<juergen@example.com>" {
+			t.Errorf("%s: RCPT %v", tt.name, session.to)
+		}
+
+		msg, err := mail.ReadMessage(strings.NewReader(session.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers := map[string]string{
+			"From":                      msg.Header.Get("From"),
+			"To":                        msg.Header.Get("To"),
+			"Subject":                   subject,
+			"Content-Type":              msg.Header.Get("Content-Type"),
+			"Content-Transfer-Encoding": msg.Header.Get("Content-Transfer-Encoding"),
+		}
+		want := map[string]string{
+			"From":                      "app@example.com",
+			"To":                        "juergen@example.com",
+			"Subject":                   "Passwort zurücksetzen",
+			"Content-Type":              "text/plain; charset=utf-8",
+			"Content-Transfer-Encoding": "quoted-printable",
+		}
+		for key, value := range want {
+			if headers[key] != value {
+				t.Errorf("%s: header %s = %q, want %q", tt.name, key, headers[key], value)
+			}
+		}
+		if _, err := msg.Header.Date(); err != nil {
+			t.Errorf("%s: Date header: %v", tt.name, err)
+		}
+
+		body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.ReplaceAll(string(body), "\r\n", "\n"); got != text {
+			t.Errorf("%s: body %q, want %q", tt.name, got, text)
+		}
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	messages := []Message{
+		{To: "a@example.com\r\nBcc: b@example.com", Subject: "hi", Text: "x"},
+		{To: "a@example.com", Subject: "hi\nBcc: b@example.com", Text: "x"},
+	}
+	for _, msg := range messages {
+		err := SMTPMailer{Host: "127.0.0.1", Port: port, From: "app@example.com"}.Send(msg)
+		if err != errHeaderInjection {
+			t.Errorf("%q: %v", msg.To+msg.Subject, err)
+		}
+	}
+	if err := (SMTPMailer{Host: "127.0.0.1", Port: port, From: "app@example.com\nBcc: x"}).Send(Message{To: "a@example.com"}); err != errHeaderInjection {
+		t.Errorf("from: %v", err)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	if err := (FileMailer{Dir: dir, From: "app@example.com"}).Send(Message{To: "a@example.com", Subject: "Hi", Text: "Hello\n"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files: %v %v", files, err)
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	msg, err := mail.ReadMessage(bufio.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "a@example.com" || msg.Header.Get("Subject") != "Hi" {
+		t.Fatalf("headers: %v", msg.Header)
+	}
+}
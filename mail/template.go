@@ -0,0 +1,46 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"go-database-json/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.txt
+var builtinTemplates embed.FS
+
+// Render builds a mail from the named template. A file <name>.txt in the
+// configured templates directory replaces the built-in template.
+//
+// Templates start with a "Subject: " line followed by an empty line and
+// the text of the mail.
+func Render(name, to string, data interface{}) (Message, error) {
+	source, err := os.ReadFile(filepath.Join(config.Current.Mail.TemplatesDir, name+".txt"))
+	if os.IsNotExist(err) {
+		source, err = builtinTemplates.ReadFile("templates/" + name + ".txt")
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(source))
+	if err != nil {
+		return Message{}, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return Message{}, err
+	}
+
+	head, text, _ := strings.Cut(strings.ReplaceAll(buf.String(), "\r\n", "\n"), "\n\n")
+	subject, ok := strings.CutPrefix(head, "Subject: ")
+	if !ok || strings.Contains(subject, "\n") {
+		return Message{}, fmt.Errorf("mail template %s must start with a single Subject line", name)
+	}
+	return Message{To: to, Subject: subject, Text: strings.TrimSpace(text) + "\n"}, nil
+}
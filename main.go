@@ -1,56 +1,154 @@
 package main
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"go-database-json/auth"
 	"go-database-json/collections"
+	"go-database-json/config"
+	"go-database-json/mail"
+	"go-database-json/ratelimit"
 	"go-database-json/records"
+	"go-database-json/storage"
+	"log"
+	"os"
 )
 
 func main() {
+	// settings like the password policy, all optional
+	if err := config.Load("config.json"); err != nil {
+		log.Fatalf("failed to load config.json: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := mail.Configure(config.Current.Mail); err != nil {
+		log.Fatalf("failed to set up mail: %v", err)
+	}
+
+	// make sure no other server instance uses the same data directory
+	release, err := storage.LockDirectory("database")
+	if err != nil {
+		log.Fatalf("failed to lock database directory: %v", err)
+	}
+	defer release()
+
+	// remove temp files left behind by writes interrupted by a crash
+	for _, dir := range []string{"database", "auth"} {
+		removed, err := storage.CleanupTempFiles(dir)
+		if err != nil {
+			log.Fatalf("failed to clean up %s: %v", dir, err)
+		}
+		for _, path := range removed {
+			log.Printf("removed orphaned temp file %s", path)
+		}
+	}
+
+	// customers are stored as records in their own auth collection
+	if err := auth.EnsureCustomersCollection(); err != nil {
+		log.Fatalf("failed to set up customers collection: %v", err)
+	}
+
+	// without any superuser the first one is created with a one-time token
+	installToken, err := auth.PrepareInstall()
+	if err != nil {
+		log.Fatalf("failed to read superusers: %v", err)
+	}
+	if installToken != "" {
+		log.Printf("no superuser exists yet, create one with POST /api/superuser/register and \"installToken\": %q", installToken)
+		log.Printf("or run: %s superuser create <identity> <password>", os.Args[0])
+	}
+
 	r := gin.Default()
-	// TODO Filters for records ?
 
-	collectiongroup := r.Group("/api/collection")
+	// the client IP keys rate limits, sessions and the audit log, so
+	// forwarded headers are only believed from configured proxies
+	if err := r.SetTrustedProxies(config.Current.TrustedProxies); err != nil {
+		log.Fatalf("failed to set trusted proxies: %v", err)
+	}
+
+	// records are guarded by the access rules of their collection
+	collectiongroup := r.Group("/api/collection", auth.OptionalAuth(), auth.CheckAPIKeyScope(), auth.RequireRecordPermission(), ratelimit.ReadsAndWrites())
 	{
 		collectiongroup.GET("/:collection", records.ListRecord)
 		collectiongroup.GET("/:collection/:id", records.GetRecord)
 		collectiongroup.POST("/:collection", records.CreateRecord)
+		collectiongroup.PUT("/:collection/:id", records.ReplaceRecord)
 		collectiongroup.PATCH("/:collection/:id", records.UpdateRecord)
 		collectiongroup.DELETE("/:collection/:id", records.DeleteRecord)
 	}
 
-	collectionsgroup := r.Group("/api/collections")
+	// managing collections is reserved for superusers
+	collectionsgroup := r.Group("/api/collections", auth.RequireAuth(), auth.RequireSuperuser(), ratelimit.ReadsAndWrites())
 	{
 		// CRUD Collection
-		collectionsgroup.GET("/", collections.ListCollection)
-		collectionsgroup.GET("/:collection", collections.GetCollection)
-		collectionsgroup.POST("/", collections.CreateCollection)
-		collectionsgroup.PATCH("/:collection", collections.UpdateCollection)
-		collectionsgroup.DELETE("/:collection", collections.RemoveCollection)
+		collectionsgroup.GET("/", auth.RequirePermission(auth.PermissionCollectionsRead), collections.ListCollection)
+		collectionsgroup.GET("/:collection", auth.RequirePermission(auth.PermissionCollectionsRead), collections.GetCollection)
+		collectionsgroup.POST("/", auth.RequirePermission(auth.PermissionCollectionsCreate), collections.CreateCollection)
+		collectionsgroup.PATCH("/:collection", auth.RequirePermission(auth.PermissionCollectionsUpdate), collections.UpdateCollection)
+		collectionsgroup.DELETE("/:collection", auth.RequirePermission(auth.PermissionCollectionsDelete), collections.RemoveCollection)
 	}
 
 	// SuperUser
 	superusergroup := r.Group("/api/superuser")
 	{
-		superusergroup.POST("/login", auth.AdminHandler)
-		superusergroup.POST("/register", auth.RegisterHandler)
+		superusergroup.POST("/login", ratelimit.Policy("login"), auth.AdminHandler)
+		superusergroup.POST("/login/mfa", ratelimit.Policy("login"), auth.MFALoginHandler)
+		superusergroup.POST("/register", auth.OptionalAuth(), ratelimit.Policy("register"), auth.RegisterHandler)
 		superusergroup.POST("/check", auth.AdminCheckHandler)
+
+		admin := superusergroup.Group("", auth.RequireAuth(), auth.RequireSuperuser(), ratelimit.ReadsAndWrites())
+		admin.POST("/logout", auth.LogoutHandler)
+		admin.POST("/password", auth.ChangePasswordHandler)
+		admin.POST("/mfa/enroll", auth.MFAEnrollHandler)
+		admin.POST("/mfa/confirm", auth.MFAConfirmHandler)
+		admin.POST("/mfa/disable", auth.MFADisableHandler)
+		admin.GET("/sessions", auth.SessionsHandler)
+		admin.DELETE("/sessions/:id", auth.RevokeSessionHandler)
+		admin.GET("/audit", auth.RequirePermission(auth.PermissionAuditRead), auth.AuditHandler)
+		admin.GET("/apikeys", auth.RequirePermission(auth.PermissionAPIKeysManage), auth.ListAPIKeysHandler)
+		admin.POST("/apikeys", auth.RequirePermission(auth.PermissionAPIKeysManage), auth.CreateAPIKeyHandler)
+		admin.DELETE("/apikeys/:id", auth.RequirePermission(auth.PermissionAPIKeysManage), auth.RevokeAPIKeyHandler)
+		admin.GET("/users", auth.RequirePermission(auth.PermissionUsersManage), auth.ListSuperUsersHandler)
+		admin.PATCH("/users/:identity", auth.RequirePermission(auth.PermissionUsersManage), auth.UpdateSuperUserHandler)
 	}
 
 	// Customers
 	customergroup := r.Group("/api/customer")
 	{
-		customergroup.POST("/login", auth.CustomerHandler)
-		customergroup.POST("/register", auth.RegisterHandler)
+		customergroup.POST("/login", ratelimit.Policy("login"), auth.CustomerHandler)
+		customergroup.POST("/register", ratelimit.Policy("register"), auth.CustomerRegisterHandler)
 		customergroup.POST("/check", auth.CustomerCheckHandler)
+		customergroup.POST("/password-reset", ratelimit.Policy("register"), auth.PasswordResetRequestHandler)
+		customergroup.POST("/password-reset/confirm", ratelimit.Policy("login"), auth.PasswordResetConfirmHandler)
+		customergroup.POST("/verify-email/confirm", ratelimit.Policy("login"), auth.VerifyEmailConfirmHandler)
+
+		// login with external providers
+		customergroup.GET("/oauth", auth.OAuthProvidersHandler)
+		customergroup.GET("/oauth/:provider", auth.OptionalAuth(), ratelimit.Policy("login"), auth.OAuthStartHandler)
+		customergroup.GET("/oauth/:provider/callback", ratelimit.Policy("login"), auth.OAuthCallbackHandler)
+		customergroup.POST("/oauth/:provider/callback", ratelimit.Policy("login"), auth.OAuthCallbackHandler)
+
+		sessions := customergroup.Group("", auth.RequireAuth(), auth.RequireCustomer(), ratelimit.ReadsAndWrites())
+		sessions.POST("/logout", auth.LogoutHandler)
+		sessions.POST("/password", auth.ChangePasswordHandler)
+		sessions.POST("/verify-email", auth.VerifyEmailRequestHandler)
+		sessions.GET("/oauth-links", auth.OAuthLinksHandler)
+		sessions.DELETE("/oauth-links/:provider", auth.OAuthUnlinkHandler)
+		sessions.GET("/sessions", auth.SessionsHandler)
+		sessions.DELETE("/sessions/:id", auth.RevokeSessionHandler)
 	}
 
 	// File Upload
 	// S3 Support
-	// Mail Support
 
-	err := r.Run(":8080")
+	err = r.Run(":8080")
 	if err != nil {
 		return
 	}
@@ -0,0 +1,101 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Cursor marks the position of the last item returned in cursor pagination.
+// It holds the sort values of that item so iteration stays stable while
+// records are inserted or removed.
+type Cursor struct {
+	Values []interface{} `json:"v"`
+	ID     string        `json:"id"`
+	// Sort is the sort expression the cursor was created for, a cursor is
+	// meaningless under another order
+	Sort string `json:"s"`
+}
+
+var errMalformedCursor = errors.New("malformed cursor")
+
+// nonScalar stands for every object or array sort value in a cursor
+var nonScalar = map[string]interface{}{}
+
+// sortKey writes sort fields back as a normalized sort expression
+func sortKey(fields []SortField) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		parts[i] = field.Path
+		if field.Desc {
+			parts[i] = "-" + field.Path
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// NewCursor builds the cursor pointing after the given document
+func NewCursor(fields []SortField, id string, doc map[string]interface{}) Cursor {
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		values[i], _ = Lookup(doc, field.Path)
+		// sorting ranks all objects and arrays equal, an empty object keeps
+		// that position without copying the value into the cursor
+		if typeRank(values[i]) == typeRank(nonScalar) {
+			values[i] = nonScalar
+		}
+	}
+	return Cursor{Values: values, ID: id, Sort: sortKey(fields)}
+}
+
+// Encode returns the opaque string representation handed to clients
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a cursor created by Encode for the given sort fields.
+// Cursors created for another sort order are rejected as stale.
+func DecodeCursor(s string, fields []SortField) (Cursor, error) {
+	var c Cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errMalformedCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || len(c.Values) != len(fields) || c.ID == "" {
+		return c, errMalformedCursor
+	}
+	if c.Sort != sortKey(fields) {
+		return c, errors.New("cursor belongs to another sort order")
+	}
+	// sort values are plain JSON values or the empty object NewCursor uses
+	// for objects and arrays
+	for _, value := range c.Values {
+		switch value := value.(type) {
+		case nil, bool, float64, string:
+		case map[string]interface{}:
+			if len(value) != 0 {
+				return c, errMalformedCursor
+			}
+		default:
+			return c, errMalformedCursor
+		}
+	}
+	return c, nil
+}
+
+// After reports whether the document with the given id sorts after the cursor
+func (c Cursor) After(fields []SortField, id string, doc map[string]interface{}) bool {
+	for i, field := range fields {
+		v, _ := Lookup(doc, field.Path)
+		cmp := Compare(v, c.Values[i])
+		if field.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp > 0
+		}
+	}
+	return id > c.ID
+}
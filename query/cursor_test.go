@@ -0,0 +1,158 @@
+package query
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	doc := map[string]interface{}{
+		"name":    "ann",
+		"age":     float64(30),
+		"active":  true,
+		"address": map[string]interface{}{"city": "Berlin"},
+	}
+
+	tests := []struct {
+		sort string
+		want []interface{}
+	}{
+		{"", []interface{}{}},
+		{"name", []interface{}{"ann"}},
+		{"-age,name", []interface{}{float64(30), "ann"}},
+		{"+address.city,-active", []interface{}{"Berlin", true}},
+		{"missing", []interface{}{nil}},
+		{"address,-name", []interface{}{map[string]interface{}{}, "ann"}},
+	}
+
+	for _, tt := range tests {
+		fields, err := ParseSort(tt.sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := NewCursor(fields, "rec-1", doc).Encode()
+
+		decoded, err := DecodeCursor(encoded, fields)
+		if err != nil {
+			t.Errorf("sort %q: %v", tt.sort, err)
+			continue
+		}
+		if decoded.ID != "rec-1" || len(decoded.Values) != len(tt.want) {
+			t.Errorf("sort %q: decoded %+v", tt.sort, decoded)
+			continue
+		}
+		for i, value := range tt.want {
+			if !Equal(decoded.Values[i], value) {
+				t.Errorf("sort %q: value %d is %v, want %v", tt.sort, i, decoded.Values[i], value)
+			}
+		}
+	}
+}
+
+func TestCursorAfter(t *testing.T) {
+	fields, _ := ParseSort("-age")
+	cursor := NewCursor(fields, "b", map[string]interface{}{"age": float64(30)})
+
+	tests := []struct {
+		id    string
+		age   float64
+		after bool
+	}{
+		{"x", 40, false},
+		{"x", 20, true},
+		{"a", 30, false},
+		{"b", 30, false},
+		{"c", 30, true},
+	}
+	for _, tt := range tests {
+		if got := cursor.After(fields, tt.id, map[string]interface{}{"age": tt.age}); got != tt.after {
+			t.Errorf("After(%s, %v) = %v, want %v", tt.id, tt.age, got, tt.after)
+		}
+	}
+}
+
+func TestCursorNonScalar(t *testing.T) {
+	fields, _ := ParseSort("tags")
+	docs := []struct {
+		id   string
+		tags interface{}
+	}{
+		{"a", nil},
+		{"b", "x"},
+		{"c", []interface{}{"z"}},
+		{"d", map[string]interface{}{"y": 1.0}},
+		{"e", []interface{}{"a", "b"}},
+	}
+
+	// walk the list one record at a time like a client following nextCursor
+	var seen []string
+	encoded := ""
+	for page := 0; page < len(docs)+1; page++ {
+		var cursor *Cursor
+		if encoded != "" {
+			decoded, err := DecodeCursor(encoded, fields)
+			if err != nil {
+				t.Fatalf("page %d: %v", page, err)
+			}
+			cursor = &decoded
+		}
+
+		next := -1
+		for i, doc := range docs {
+			data := map[string]interface{}{"tags": doc.tags}
+			if cursor == nil || cursor.After(fields, doc.id, data) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		seen = append(seen, docs[next].id)
+		encoded = NewCursor(fields, docs[next].id, map[string]interface{}{"tags": docs[next].tags}).Encode()
+	}
+
+	if strings.Join(seen, "") != "abcde" {
+		t.Errorf("pages returned %v", seen)
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	fields, _ := ParseSort("-age,name")
+	valid := NewCursor(fields, "rec-1", map[string]interface{}{"age": float64(30), "name": "ann"}).Encode()
+	raw := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+		sort   string
+	}{
+		{"not base64", "!!!", "-age,name"},
+		{"not json", raw(`{"v":`), "-age,name"},
+		{"flipped byte", valid[:len(valid)-3] + "A" + valid[len(valid)-2:], "-age,name"},
+		{"truncated", valid[:len(valid)/2], "-age,name"},
+		{"too few values", raw(`{"v":[30],"id":"rec-1","s":"-age,name"}`), "-age,name"},
+		{"too many values", raw(`{"v":[30,"ann",1],"id":"rec-1","s":"-age,name"}`), "-age,name"},
+		{"missing id", raw(`{"v":[30,"ann"],"s":"-age,name"}`), "-age,name"},
+		{"object value", raw(`{"v":[{"a":1},"ann"],"id":"rec-1","s":"-age,name"}`), "-age,name"},
+		{"array value", raw(`{"v":[[1],"ann"],"id":"rec-1","s":"-age,name"}`), "-age,name"},
+		{"tampered sort", raw(`{"v":[30,"ann"],"id":"rec-1","s":"age,name"}`), "-age,name"},
+		{"stale: other direction", valid, "age,name"},
+		{"stale: other fields", valid, "-age,city"},
+		{"stale: other order", valid, "name,-age"},
+		{"stale: no sort", valid, ""},
+	}
+
+	for _, tt := range tests {
+		sortFields, err := ParseSort(tt.sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeCursor(tt.cursor, sortFields); err == nil {
+			t.Errorf("%s: cursor was accepted", tt.name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package query
+
+import "strings"
+
+// Projection is a parsed list of field paths like "name,address.city,tags"
+type Projection struct {
+	// all is set when the whole value at this path was requested
+	all    bool
+	fields map[string]*Projection
+}
+
+// ParseFields parses a comma separated list of dot separated field paths.
+// It returns nil when no fields were requested.
+func ParseFields(input string) *Projection {
+	var projection *Projection
+	for _, path := range strings.Split(input, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if projection == nil {
+			projection = &Projection{}
+		}
+		node := projection
+		for _, part := range strings.Split(path, ".") {
+			if node.fields == nil {
+				node.fields = make(map[string]*Projection)
+			}
+			child, ok := node.fields[part]
+			if !ok {
+				child = &Projection{}
+				node.fields[part] = child
+			}
+			node = child
+		}
+		node.all = true
+	}
+	return projection
+}
+
+// Apply returns a copy of the document trimmed to the projected fields.
+// Paths reaching into an array are applied to each of its elements.
+func (p *Projection) Apply(doc map[string]interface{}) map[string]interface{} {
+	if p == nil {
+		return doc
+	}
+	result := make(map[string]interface{})
+	for key, sub := range p.fields {
+		value, ok := doc[key]
+		if !ok {
+			continue
+		}
+		if sub.all {
+			result[key] = value
+			continue
+		}
+		if projected, ok := sub.applyValue(value); ok {
+			result[key] = projected
+		}
+	}
+	return result
+}
+
+func (p *Projection) applyValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return p.Apply(v), true
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if projected, ok := p.applyValue(item); ok {
+				items = append(items, projected)
+			}
+		}
+		return items, true
+	}
+	return nil, false
+}
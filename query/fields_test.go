@@ -0,0 +1,77 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	doc := decode(t, `{
+		"id": "1",
+		"name": "ann",
+		"age": 30,
+		"address": {"city": "Berlin", "zip": "10115", "geo": {"lat": 52.5, "lng": 13.4}},
+		"tags": ["vip", "beta"],
+		"items": [{"name": "a", "price": 1}, {"name": "b", "price": 2}, "loose"],
+		"nothing": null
+	}`)
+
+	tests := []struct {
+		fields string
+		want   string
+	}{
+		{"", `<all>`},
+		{" , ", `<all>`},
+		{"name", `{"name": "ann"}`},
+		{"name, age", `{"name": "ann", "age": 30}`},
+		{"name,name", `{"name": "ann"}`},
+		{"address.city", `{"address": {"city": "Berlin"}}`},
+		{"address.geo.lat,address.zip", `{"address": {"zip": "10115", "geo": {"lat": 52.5}}}`},
+		{"address,address.city", `{"address": {"city": "Berlin", "zip": "10115", "geo": {"lat": 52.5, "lng": 13.4}}}`},
+		{"address.city,address", `{"address": {"city": "Berlin", "zip": "10115", "geo": {"lat": 52.5, "lng": 13.4}}}`},
+		{"items.name", `{"items": [{"name": "a"}, {"name": "b"}]}`},
+		{"tags", `{"tags": ["vip", "beta"]}`},
+		{"nothing", `{"nothing": null}`},
+
+		// unknown fields are left out
+		{"unknown", `{}`},
+		{"name,unknown", `{"name": "ann"}`},
+		{"address.unknown", `{"address": {}}`},
+		{"unknown.city", `{}`},
+		{"name.first", `{}`},
+		{"tags.length", `{"tags": []}`},
+	}
+
+	for _, tt := range tests {
+		got := ParseFields(tt.fields).Apply(doc)
+		if tt.want == "<all>" {
+			if len(got) != len(doc) {
+				t.Errorf("fields %q: projected %v, want the whole document", tt.fields, got)
+			}
+			continue
+		}
+		if !Equal(normalize(t, got), decode(t, tt.want)) {
+			t.Errorf("fields %q: got %v, want %s", tt.fields, got, tt.want)
+		}
+	}
+}
+
+func TestProjectionLeavesDocument(t *testing.T) {
+	doc := decode(t, `{"name": "ann", "address": {"city": "Berlin", "zip": "10115"}}`)
+	ParseFields("address.city").Apply(doc)
+
+	address := doc["address"].(map[string]interface{})
+	if len(doc) != 2 || len(address) != 2 {
+		t.Errorf("document was modified: %v", doc)
+	}
+}
+
+// normalize round trips a value through JSON so numbers compare alike
+func normalize(t *testing.T, value map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decode(t, string(data))
+}
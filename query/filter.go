@@ -0,0 +1,466 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Resolver returns the value of an identifier used in a filter expression
+type Resolver func(name string) (interface{}, bool)
+
+// Filter is a parsed filter expression like `age >= 18 && (role = "admin" || tags contains "vip")`
+type Filter interface {
+	Match(resolve Resolver) bool
+}
+
+// MatchDocument evaluates the filter against the fields of a decoded record
+func MatchDocument(f Filter, doc map[string]interface{}) bool {
+	return f.Match(func(name string) (interface{}, bool) {
+		return Lookup(doc, name)
+	})
+}
+
+type andFilter struct{ left, right Filter }
+
+func (f andFilter) Match(resolve Resolver) bool {
+	return f.left.Match(resolve) && f.right.Match(resolve)
+}
+
+type orFilter struct{ left, right Filter }
+
+func (f orFilter) Match(resolve Resolver) bool {
+	return f.left.Match(resolve) || f.right.Match(resolve)
+}
+
+type operand interface {
+	value(resolve Resolver) interface{}
+}
+
+type literal struct{ v interface{} }
+
+func (l literal) value(Resolver) interface{} { return l.v }
+
+type identifier struct{ name string }
+
+func (i identifier) value(resolve Resolver) interface{} {
+	v, _ := resolve(i.name)
+	return v
+}
+
+type list struct{ items []operand }
+
+func (l list) value(resolve Resolver) interface{} {
+	values := make([]interface{}, len(l.items))
+	for i, item := range l.items {
+		values[i] = item.value(resolve)
+	}
+	return values
+}
+
+type comparison struct {
+	left  operand
+	op    string
+	right operand
+}
+
+func (f comparison) Match(resolve Resolver) bool {
+	left := f.left.value(resolve)
+	right := f.right.value(resolve)
+
+	switch f.op {
+	case "=":
+		return Equal(left, right)
+	case "!=":
+		return !Equal(left, right)
+	case ">", ">=", "<", "<=":
+		cmp, ok := compareOrdered(left, right)
+		if !ok {
+			return false
+		}
+		switch f.op {
+		case ">":
+			return cmp > 0
+		case ">=":
+			return cmp >= 0
+		case "<":
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	case "in":
+		values, ok := right.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range values {
+			if Equal(left, v) {
+				return true
+			}
+		}
+		return false
+	case "contains":
+		switch l := left.(type) {
+		case string:
+			s, ok := right.(string)
+			return ok && strings.Contains(l, s)
+		case []interface{}:
+			for _, v := range l {
+				if Equal(v, right) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Equal compares two decoded JSON values, treating all numbers as float64
+func Equal(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		return ok && af == bf
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Compare orders two decoded JSON values for sorting.
+// Missing values sort first, then booleans, numbers and strings.
+func Compare(a, b interface{}) int {
+	if cmp, ok := compareOrdered(a, b); ok {
+		return cmp
+	}
+	ra, rb := typeRank(a), typeRank(b)
+	if ra < rb {
+		return -1
+	}
+	if ra > rb {
+		return 1
+	}
+	return 0
+}
+
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64, int, int64:
+		return 2
+	case string:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func compareOrdered(a, b interface{}) (int, bool) {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		}
+		return 0, true
+	}
+	if as, ok := a.(string); ok {
+		bs, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(as, bs), true
+	}
+	if ab, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case ab == bb:
+			return 0, true
+		case !ab:
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// maxFilterDepth limits how deep parentheses and lists can be nested
+const maxFilterDepth = 32
+
+// ParseFilter parses a filter expression.
+//
+// Supported operators are =, !=, >, >=, <, <=, in and contains,
+// combined with && and || and grouped with parentheses. Parentheses
+// and lists can be nested up to maxFilterDepth levels.
+func ParseFilter(input string) (Filter, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokString
+	tokNumber
+	tokOperator
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, token{tokString, sb.String()})
+			i = j + 1
+		case r == '(' || r == ')' || r == '[' || r == ']' || r == ',':
+			tokens = append(tokens, token{tokPunct, string(r)})
+			i++
+		case strings.ContainsRune("=!<>&|", r):
+			j := i + 1
+			if j < len(runes) && strings.ContainsRune("=&|", runes[j]) {
+				j++
+			}
+			op := string(runes[i:j])
+			switch op {
+			case "=", "!=", ">", ">=", "<", "<=", "&&", "||":
+			default:
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+			tokens = append(tokens, token{tokOperator, op})
+			i = j
+		case r == '-' || unicode.IsDigit(r):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || runes[j] == 'E' ||
+				// the sign of an exponent like 1e-5
+				((runes[j] == '-' || runes[j] == '+') && (runes[j-1] == 'e' || runes[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, string(runes[i:j])})
+			i = j
+		case r == '_' || r == '@' || unicode.IsLetter(r):
+			j := i + 1
+			for j < len(runes) && (runes[j] == '_' || runes[j] == '.' || runes[j] == '@' || unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j])) {
+				j++
+			}
+			word := string(runes[i:j])
+			if word == "in" || word == "contains" {
+				tokens = append(tokens, token{tokOperator, word})
+			} else {
+				tokens = append(tokens, token{tokIdent, word})
+			}
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// enter is called when opening parentheses or lists and fails once they are
+// nested too deep, every successful call has to be followed by leave
+func (p *parser) enter() error {
+	if p.depth >= maxFilterDepth {
+		return fmt.Errorf("filter is nested deeper than %d levels", maxFilterDepth)
+	}
+	p.depth++
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	t, ok := p.peek()
+	if ok && t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr() (Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOperator, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Filter, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOperator, "&&") {
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = andFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseTerm() (Filter, error) {
+	if p.accept(tokPunct, "(") {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(tokPunct, ")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return f, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.peek()
+	if !ok || t.kind != tokOperator || t.text == "&&" || t.text == "||" {
+		return nil, fmt.Errorf("expected comparison operator")
+	}
+	p.pos++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return comparison{left: left, op: t.text, right: right}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	p.pos++
+
+	switch t.kind {
+	case tokString:
+		return literal{t.text}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return literal{n}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		}
+		return identifier{t.text}, nil
+	case tokPunct:
+		if t.text == "[" {
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			var items []operand
+			if p.accept(tokPunct, "]") {
+				return list{items}, nil
+			}
+			for {
+				item, err := p.parseOperand()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+				if p.accept(tokPunct, "]") {
+					return list{items}, nil
+				}
+				if !p.accept(tokPunct, ",") {
+					return nil, fmt.Errorf("expected ',' or ']' in list")
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
@@ -0,0 +1,227 @@
+package query
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseFilterMatch(t *testing.T) {
+	doc := decode(t, `{
+		"name": "Ann \"the\" Admin",
+		"age": 30,
+		"active": true,
+		"role": "admin",
+		"tags": ["vip", "beta"],
+		"score": 2.5,
+		"address": {"city": "Berlin", "zip": "10115"},
+		"items": [{"name": "first"}, {"name": "second"}],
+		"nothing": null
+	}`)
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		// comparisons
+		{`age = 30`, true},
+		{`age != 30`, false},
+		{`age > 29.5`, true},
+		{`age >= 30`, true},
+		{`age < 30`, false},
+		{`age <= 30`, true},
+		{`score = 2.5`, true},
+		{`age > -1`, true},
+		{`age = 3e1`, true},
+		{`age = 3e+1`, true},
+		{`age = 3000e-2`, true},
+		{`score = 25E-1`, true},
+		{`age > 1e-5`, true},
+		{`age < -1e-5`, false},
+		{`role in ["user", "admin"]`, true},
+		{`role in []`, false},
+		{`age in [1, 30]`, true},
+		{`tags contains "vip"`, true},
+		{`tags contains "gold"`, false},
+		{`name contains "Admin"`, true},
+		{`active = true`, true},
+		{`active != false`, true},
+		{`nothing = null`, true},
+		{`missing = null`, true},
+		{`missing != null`, false},
+
+		// types don't mix
+		{`age = "30"`, false},
+		{`age > "20"`, false},
+		{`role > 1`, false},
+		{`active > 0`, false},
+		{`role > "a"`, true},
+		{`active > false`, true},
+		{`tags contains 1`, false},
+		{`age contains "3"`, false},
+		{`role in "admin"`, false},
+
+		// quoting and escapes
+		{`name = "Ann \"the\" Admin"`, true},
+		{`name = 'Ann "the" Admin'`, true},
+		{`role = 'admin'`, true},
+		{`role = "adm\in"`, true},
+		{`role = "ad min"`, false},
+
+		// dotted paths
+		{`address.city = "Berlin"`, true},
+		{`address.zip = "10115"`, true},
+		{`address.country = null`, true},
+		{`items.1.name = "second"`, true},
+		{`items.5.name = null`, true},
+		{`role.length = null`, true},
+
+		// precedence: && binds tighter than ||
+		{`age = 1 && role = "admin" || active = true`, true},
+		{`active = true || age = 1 && role = "nobody"`, true},
+		{`(active = true || age = 1) && role = "nobody"`, false},
+		{`age = 1 && (role = "admin" || active = true)`, false},
+		{`((age = 30))`, true},
+		{`age = 30 && role = "admin" && active = true`, true},
+		{`age = 1 || role = "x" || active = false`, false},
+	}
+
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.filter, err)
+			continue
+		}
+		if got := MatchDocument(f, doc); got != tt.want {
+			t.Errorf("%q matched %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterMalformed(t *testing.T) {
+	tests := []string{
+		``,
+		`   `,
+		`age`,
+		`age =`,
+		`= 30`,
+		`age == 30`,
+		`age => 30`,
+		`age & 1`,
+		`age | 1`,
+		`age ! 1`,
+		`age = 30 &&`,
+		`|| age = 30`,
+		`(age = 30`,
+		`age = 30)`,
+		`()`,
+		`age = "open`,
+		`age = 'open`,
+		`age = "\`,
+		`age = 1.2.3`,
+		`age = -`,
+		`age = 1e`,
+		`age = 1e-`,
+		`age = 1e--5`,
+		`age = 1e-5-5`,
+		`age = 1-5`,
+		`age = -e5`,
+		`role in [`,
+		`role in ["a"`,
+		`role in ["a" "b"]`,
+		`role in [,]`,
+		`role in ]`,
+		`age = 30 role = "x"`,
+		`age # 30`,
+		`age = $x`,
+		`age = 30 && && role = "x"`,
+		`age in in [1]`,
+		`contains contains contains`,
+		"age = 30 \x00",
+	}
+
+	for _, input := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("ParseFilter(%q) panicked: %v", input, r)
+				}
+			}()
+			if _, err := ParseFilter(input); err == nil {
+				t.Errorf("ParseFilter(%q) succeeded, want error", input)
+			}
+		}()
+	}
+}
+
+func TestParseFilterDepth(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("(", depth) + "age = 30" + strings.Repeat(")", depth)
+	}
+	list := func(depth int) string {
+		return "tags contains " + strings.Repeat("[", depth) + `"vip"` + strings.Repeat("]", depth)
+	}
+
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{nested(maxFilterDepth), true},
+		{nested(maxFilterDepth + 1), false},
+		{nested(maxFilterDepth/2) + " && " + nested(maxFilterDepth/2), true},
+		{"(" + nested(maxFilterDepth/2) + " && " + nested(maxFilterDepth/2) + ")", true},
+		{list(maxFilterDepth), true},
+		{list(maxFilterDepth + 1), false},
+		{nested(maxFilterDepth-1) + " && (" + list(1) + ")", true},
+		{strings.Repeat("(", maxFilterDepth-2) + list(2) + strings.Repeat(")", maxFilterDepth-2), true},
+		{strings.Repeat("(", maxFilterDepth-1) + list(2) + strings.Repeat(")", maxFilterDepth-1), false},
+		// fails without recursing through all of it
+		{nested(1 << 20), false},
+		{"age in " + strings.Repeat("[", 1<<20), false},
+	}
+	for _, tt := range tests {
+		if _, err := ParseFilter(tt.filter); (err == nil) != tt.valid {
+			t.Errorf("ParseFilter(%.60q...): %v", tt.filter, err)
+		}
+	}
+
+	f, err := ParseFilter(nested(maxFilterDepth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !MatchDocument(f, map[string]interface{}{"age": 30.0}) {
+		t.Error("nested filter doesn't match")
+	}
+}
+
+func TestParseFilterResolver(t *testing.T) {
+	f, err := ParseFilter(`@request.auth.id != "" && owner = @request.auth.id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(values map[string]interface{}) Resolver {
+		return func(name string) (interface{}, bool) {
+			v, ok := values[name]
+			return v, ok
+		}
+	}
+
+	if !f.Match(resolve(map[string]interface{}{"@request.auth.id": "ann", "owner": "ann"})) {
+		t.Error("owner did not match")
+	}
+	if f.Match(resolve(map[string]interface{}{"@request.auth.id": "bob", "owner": "ann"})) {
+		t.Error("other user matched")
+	}
+	if f.Match(resolve(map[string]interface{}{"@request.auth.id": ""})) {
+		t.Error("anonymous user matched")
+	}
+}
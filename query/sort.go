@@ -0,0 +1,52 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SortField is one entry of a sort expression like "-created"
+type SortField struct {
+	Path string
+	Desc bool
+}
+
+// ParseSort parses a comma separated sort expression like "-created,name".
+// A leading "-" sorts descending, an optional "+" ascending.
+func ParseSort(input string) ([]SortField, error) {
+	var fields []SortField
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field := SortField{Path: part}
+		switch part[0] {
+		case '-':
+			field.Desc = true
+			field.Path = part[1:]
+		case '+':
+			field.Path = part[1:]
+		}
+		if field.Path == "" {
+			return nil, fmt.Errorf("empty sort field")
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// CompareBy orders two documents by the given sort fields
+func CompareBy(fields []SortField, a, b map[string]interface{}) int {
+	for _, field := range fields {
+		av, _ := Lookup(a, field.Path)
+		bv, _ := Lookup(b, field.Path)
+		if cmp := Compare(av, bv); cmp != 0 {
+			if field.Desc {
+				return -cmp
+			}
+			return cmp
+		}
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-database-json/auth"
+	"go-database-json/config"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// store maps request keys to their limiters. An entry idle for longer than
+// it takes the bucket to fill up again behaves like a new one and is evicted.
+type store struct {
+	mu        sync.Mutex
+	limiters  map[string]*entry
+	limit     rate.Limit
+	burst     int
+	idle      time.Duration
+	lastSweep time.Time
+}
+
+var (
+	// stores are shared by all routes using the same policy
+	stores   = make(map[string]*store)
+	storesMu sync.Mutex
+)
+
+func storeFor(name string, policy config.RateLimit) *store {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if s, ok := stores[name]; ok {
+		return s
+	}
+
+	per := time.Duration(policy.Per)
+	burst := policy.Burst
+	if burst <= 0 {
+		burst = policy.Requests
+	}
+	s := &store{
+		limiters: make(map[string]*entry),
+		limit:    rate.Limit(float64(policy.Requests) / per.Seconds()),
+		burst:    burst,
+		idle:     time.Duration(float64(burst) / float64(policy.Requests) * float64(per)),
+	}
+	stores[name] = s
+	return s
+}
+
+func (s *store) get(key string, now time.Time) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > s.idle {
+		for k, e := range s.limiters {
+			if now.Sub(e.lastSeen) > s.idle {
+				delete(s.limiters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	e, ok := s.limiters[key]
+	if !ok {
+		e = &entry{limiter: rate.NewLimiter(s.limit, s.burst)}
+		s.limiters[key] = e
+	}
+	e.lastSeen = now
+	return e.limiter
+}
+
+// Policy limits requests with the named policy from the config. Unknown
+// policies and policies without requests let everything through.
+//
+// Limiting by identity or API key needs the caller to be authenticated
+// first, so the middleware has to run after the auth middleware.
+func Policy(name string) gin.HandlerFunc {
+	policy, ok := config.Current.RateLimits[name]
+	if !ok || policy.Requests == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	s := storeFor(name, policy)
+
+	return func(c *gin.Context) {
+		now := time.Now()
+		limiter := s.get(requestKey(c, policy.Key), now)
+
+		allowed := limiter.AllowN(now, 1)
+		tokens := limiter.TokensAt(now)
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(s.burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(tokens)))))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(secondsUntil(float64(s.burst)-tokens, s.limit)))
+
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(secondsUntil(1-tokens, s.limit)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests. Please try again later."})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ReadsAndWrites limits safe methods with the "reads" policy and all other
+// methods with the "writes" policy
+func ReadsAndWrites() gin.HandlerFunc {
+	reads := Policy("reads")
+	writes := Policy("writes")
+
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			reads(c)
+		default:
+			writes(c)
+		}
+	}
+}
+
+// requestKey returns what a request is counted by, falling back to the
+// client IP when the request carries no identity or API key
+func requestKey(c *gin.Context, key string) string {
+	username := c.GetString("username")
+	switch key {
+	case "apiKey":
+		if username != "" && c.GetString("role") == auth.RoleAPIKey {
+			return "key:" + username
+		}
+	case "identity":
+		if username != "" {
+			return "user:" + c.GetString("role") + ":" + username
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// secondsUntil returns how long it takes to gain the given number of tokens
+func secondsUntil(tokens float64, limit rate.Limit) int {
+	if tokens <= 0 {
+		return 0
+	}
+	return int(math.Ceil(tokens / float64(limit)))
+}
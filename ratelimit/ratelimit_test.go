@@ -0,0 +1,255 @@
+package ratelimit
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-database-json/auth"
+	"go-database-json/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// usePolicies installs rate limit policies and forgets the buckets of
+// earlier tests
+func usePolicies(t *testing.T, policies map[string]config.RateLimit) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	config.Current.RateLimits = policies
+	storesMu.Lock()
+	stores = make(map[string]*store)
+	storesMu.Unlock()
+	t.Cleanup(func() { config.Current = config.Default() })
+}
+
+// newLimitedEngine serves GET and POST / behind the middleware. Requests
+// authenticate through the X-Test-User and X-Test-Role headers.
+func newLimitedEngine(limit gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if user := c.GetHeader("X-Test-User"); user != "" {
+			c.Set("username", user)
+			c.Set("role", c.GetHeader("X-Test-Role"))
+		}
+	}, limit)
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/", ok)
+	r.HEAD("/", ok)
+	r.POST("/", ok)
+	return r
+}
+
+type testRequest struct {
+	method string
+	ip     string
+	user   string
+	role   string
+}
+
+func serve(r *gin.Engine, req testRequest) *httptest.ResponseRecorder {
+	if req.method == "" {
+		req.method = "GET"
+	}
+	httpReq := httptest.NewRequest(req.method, "/", nil)
+	httpReq.RemoteAddr = req.ip + ":4711"
+	if req.user != "" {
+		httpReq.Header.Set("X-Test-User", req.user)
+		httpReq.Header.Set("X-Test-Role", req.role)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httpReq)
+	return w
+}
+
+// TestPolicyClientIP checks that spoofed X-Forwarded-For headers don't get
+// around a limit by IP unless the request comes through a trusted proxy
+func TestPolicyClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Cleanup(func() { config.Current = config.Default() })
+
+	tests := []struct {
+		name    string
+		trusted []string
+		codes   []int
+	}{
+		{"no trusted proxy", nil, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{"other proxy", []string{"10.0.0.0/8"}, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{"trusted proxy", []string{"192.0.2.1"}, []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+	}
+
+	for _, tt := range tests {
+		config.Current.RateLimits = map[string]config.RateLimit{
+			tt.name: {Requests: 1, Per: config.Duration(time.Hour), Burst: 1, Key: "ip"},
+		}
+
+		r := gin.New()
+		if err := r.SetTrustedProxies(tt.trusted); err != nil {
+			t.Fatal(err)
+		}
+		r.GET("/", Policy(tt.name), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+		for i, forwarded := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.0.2.1:4711"
+			req.Header.Set("X-Forwarded-For", forwarded)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.codes[i] {
+				t.Errorf("%s: request %d got %d, want %d", tt.name, i, w.Code, tt.codes[i])
+			}
+		}
+	}
+}
+
+func TestPolicyLimit(t *testing.T) {
+	usePolicies(t, map[string]config.RateLimit{
+		"test": {Requests: 1, Per: config.Duration(10 * time.Second), Burst: 3, Key: "ip"},
+		"off":  {},
+	})
+	r := newLimitedEngine(Policy("test"))
+
+	tests := []struct {
+		code       int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{http.StatusOK, "2", "10", ""},
+		{http.StatusOK, "1", "20", ""},
+		{http.StatusOK, "0", "30", ""},
+		{http.StatusTooManyRequests, "0", "30", "10"},
+		{http.StatusTooManyRequests, "0", "30", "10"},
+	}
+	for i, tt := range tests {
+		w := serve(r, testRequest{ip: "192.0.2.1"})
+		header := w.Header()
+		if w.Code != tt.code || header.Get("X-RateLimit-Limit") != "3" || header.Get("X-RateLimit-Remaining") != tt.remaining ||
+			header.Get("X-RateLimit-Reset") != tt.reset || header.Get("Retry-After") != tt.retryAfter {
+			t.Errorf("request %d: %d, limit %s, remaining %s, reset %s, retry after %q", i, w.Code,
+				header.Get("X-RateLimit-Limit"), header.Get("X-RateLimit-Remaining"), header.Get("X-RateLimit-Reset"), header.Get("Retry-After"))
+		}
+	}
+
+	// other clients have their own bucket
+	if w := serve(r, testRequest{ip: "192.0.2.2"}); w.Code != http.StatusOK {
+		t.Errorf("other client: %d", w.Code)
+	}
+
+	// unknown policies and policies without requests don't limit
+	for _, name := range []string{"off", "unknown"} {
+		r := newLimitedEngine(Policy(name))
+		for i := 0; i < 5; i++ {
+			if w := serve(r, testRequest{ip: "192.0.2.1"}); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+				t.Fatalf("%s: request %d got %d %v", name, i, w.Code, w.Header())
+			}
+		}
+	}
+}
+
+func TestReadsAndWrites(t *testing.T) {
+	usePolicies(t, map[string]config.RateLimit{
+		"reads":  {Requests: 2, Per: config.Duration(time.Hour), Key: "ip"},
+		"writes": {Requests: 1, Per: config.Duration(time.Hour), Key: "ip"},
+	})
+	r := newLimitedEngine(ReadsAndWrites())
+
+	tests := []struct {
+		method string
+		code   int
+		limit  string
+	}{
+		{"POST", http.StatusOK, "1"},
+		{"POST", http.StatusTooManyRequests, "1"},
+		{"GET", http.StatusOK, "2"},
+		{"HEAD", http.StatusOK, "2"},
+		{"GET", http.StatusTooManyRequests, "2"},
+	}
+	for i, tt := range tests {
+		w := serve(r, testRequest{method: tt.method, ip: "192.0.2.1"})
+		if w.Code != tt.code || w.Header().Get("X-RateLimit-Limit") != tt.limit {
+			t.Errorf("request %d (%s): %d with limit %s, want %d with %s", i, tt.method, w.Code, w.Header().Get("X-RateLimit-Limit"), tt.code, tt.limit)
+		}
+	}
+}
+
+func TestPolicyKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		// requests after a first one from ann at 192.0.2.1 used up the bucket
+		req  testRequest
+		code int
+	}{
+		{"ip: same address", "ip", testRequest{ip: "192.0.2.1", user: "bob", role: auth.RoleCustomer}, http.StatusTooManyRequests},
+		{"ip: other address", "ip", testRequest{ip: "192.0.2.2", user: "ann", role: auth.RoleCustomer}, http.StatusOK},
+		{"identity: same user elsewhere", "identity", testRequest{ip: "192.0.2.2", user: "ann", role: auth.RoleCustomer}, http.StatusTooManyRequests},
+		{"identity: other user", "identity", testRequest{ip: "192.0.2.1", user: "bob", role: auth.RoleCustomer}, http.StatusOK},
+		{"identity: same name other role", "identity", testRequest{ip: "192.0.2.1", user: "ann", role: auth.RoleSuperuser}, http.StatusOK},
+		{"identity: anonymous by address", "identity", testRequest{ip: "192.0.2.1"}, http.StatusOK},
+		{"apiKey: users by address", "apiKey", testRequest{ip: "192.0.2.1", user: "bob", role: auth.RoleCustomer}, http.StatusTooManyRequests},
+		{"apiKey: key from the same address", "apiKey", testRequest{ip: "192.0.2.1", user: "apikey:sync", role: auth.RoleAPIKey}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		usePolicies(t, map[string]config.RateLimit{
+			"test": {Requests: 1, Per: config.Duration(time.Hour), Key: tt.key},
+		})
+		r := newLimitedEngine(Policy("test"))
+
+		if w := serve(r, testRequest{ip: "192.0.2.1", user: "ann", role: auth.RoleCustomer}); w.Code != http.StatusOK {
+			t.Fatalf("%s: first request %d", tt.name, w.Code)
+		}
+		if w := serve(r, tt.req); w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+
+	// API keys have a bucket each, wherever they are used from
+	usePolicies(t, map[string]config.RateLimit{
+		"test": {Requests: 1, Per: config.Duration(time.Hour), Key: "apiKey"},
+	})
+	r := newLimitedEngine(Policy("test"))
+	serve(r, testRequest{ip: "192.0.2.1", user: "apikey:sync", role: auth.RoleAPIKey})
+	if w := serve(r, testRequest{ip: "192.0.2.2", user: "apikey:sync", role: auth.RoleAPIKey}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same key elsewhere: %d", w.Code)
+	}
+}
+
+func TestIdleEviction(t *testing.T) {
+	usePolicies(t, nil)
+	// the bucket fills up again within 20 seconds
+	s := storeFor("test", config.RateLimit{Requests: 1, Per: config.Duration(10 * time.Second), Burst: 2})
+	if s.idle != 20*time.Second {
+		t.Fatalf("idle after %v", s.idle)
+	}
+
+	start := time.Now()
+	a := s.get("a", start)
+	a.AllowN(start, 2)
+	s.get("b", start.Add(15*time.Second))
+	if len(s.limiters) != 2 {
+		t.Fatalf("%d limiters before the sweep", len(s.limiters))
+	}
+
+	// a was idle long enough to have a full bucket again, b was not
+	now := start.Add(25 * time.Second)
+	s.get("c", now)
+	for key, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if _, ok := s.limiters[key]; ok != want {
+			t.Errorf("limiter %s kept: %v, want %v", key, ok, want)
+		}
+	}
+	if tokens := s.get("a", now).TokensAt(now); tokens != 2 {
+		t.Errorf("evicted key starts with %v tokens", tokens)
+	}
+
+	// sweeps don't run on every request
+	s.get("d", now.Add(time.Second))
+	s.get("e", now.Add(21*time.Second))
+	if _, ok := s.limiters["b"]; ok {
+		t.Errorf("b survived the next sweep")
+	}
+	if _, ok := s.limiters["d"]; !ok {
+		t.Errorf("d was swept before it was idle")
+	}
+}
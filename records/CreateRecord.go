@@ -1,13 +1,11 @@
 package records
 
 import (
-	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"io/ioutil"
+	"go-database-json/storage"
 	"net/http"
-	"os"
-	"path/filepath"
 )
 
 func CreateRecord(c *gin.Context) {
@@ -21,25 +19,45 @@ func CreateRecord(c *gin.Context) {
 		return
 	}
 
-	// Make sure the collection directory exists
-	if err := os.MkdirAll("database/"+collection, os.ModePerm); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create directory"})
+	// system fields are maintained by the server
+	if !checkSystemFields(c, collection, data, nil) {
 		return
 	}
+	stampCreate(c, data, collection, id)
 
-	// Marshal the data to JSON
-	jsonBytes, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not marshal JSON"})
+	unlock := lockWrite(collection, id)
+	defer unlock()
+
+	rule, ok := loadRule(c, collection, createRule)
+	if !ok {
+		return
+	}
+	// records of customers belong to them
+	if !rule.stampOwner(c, data) {
+		return
+	}
+	if !rule.allows(c, data, data) {
+		forbidden(c)
+		return
+	}
+
+	if !validateRecord(c, collection, data) {
+		return
+	}
+	if !checkUniqueCustomer(c, collection, id, data) {
 		return
 	}
 
-	// Write to file
-	path := filepath.Join("database/"+collection, id+".json")
-	if err := ioutil.WriteFile(path, jsonBytes, 0644); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not write file"})
+	// Store the record, creating the collection if needed
+	if err := storage.Default.PutRecord(collection, id, data); err != nil {
+		if errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection name"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not write record"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"status": "created", "id": id, "collection": collection})
+	c.Header("ETag", etag(1))
+	c.JSON(http.StatusCreated, gin.H{"status": "created", "id": id, "collection": collection, "data": data})
 }
@@ -1,30 +1,59 @@
 package records
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
+	"go-database-json/storage"
 	"net/http"
-	"os"
-	"path/filepath"
 )
 
 func DeleteRecord(c *gin.Context) {
 	collection := c.Param("collection")
 	id := c.Param("id")
 
-	// Build the file path
-	path := filepath.Join("database", collection, id+".json")
+	unlock := lockWrite(collection, id)
+	defer unlock()
 
-	// Check if the file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	// load the record for the delete rule and If-Match
+	current, err := storage.Default.GetRecord(collection, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read item"})
+		return
+	}
+
+	rule, ok := loadRule(c, collection, deleteRule)
+	if !ok {
+		return
+	}
+	// records of other customers look like missing ones
+	if rule.hides(c, current) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
 		return
 	}
+	if !rule.allows(c, current, nil) {
+		forbidden(c)
+		return
+	}
+
+	// honour If-Match against the current revision
+	if !checkIfMatch(c, current) {
+		return
+	}
 
-	// Delete the file
-	if err := os.Remove(path); err != nil {
+	// Delete the record
+	if err := storage.Default.DeleteRecord(collection, id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
 		return
 	}
+	forgetCustomer(collection, current, nil)
 
 	c.JSON(http.StatusOK, gin.H{
 		"status":     "deleted",
@@ -1,30 +1,52 @@
 package records
 
 import (
-	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"go-database-json/query"
+	"go-database-json/storage"
 	"net/http"
-	"os"
-	"path/filepath"
 )
 
 func GetRecord(c *gin.Context) {
 	collection := c.Param("collection")
 	id := c.Param("id")
 
-	path := filepath.Join("database", collection, id+".json")
-	file, err := os.Open(path)
+	unlock := storage.Locks.RLockRecord(collection, id)
+	defer unlock()
+
+	data, err := storage.Default.GetRecord(collection, id)
 	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON file"})
+		return
+	}
+
+	withIdentity(data, collection, id)
+	hideAuthFields(collection, data)
+
+	// records hidden by the view rule look like missing ones
+	rule, ok := loadRule(c, collection, viewRule)
+	if !ok {
+		return
+	}
+	if !rule.allows(c, data, nil) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
-	defer file.Close()
 
-	var data map[string]interface{}
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&data); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON file"})
+	// let clients revalidate cached copies
+	tag := etag(revisionOf(data))
+	c.Header("ETag", tag)
+	if header := c.GetHeader("If-None-Match"); header != "" && etagMatches(header, tag) {
+		c.Status(http.StatusNotModified)
 		return
 	}
-	c.JSON(http.StatusOK, data)
+
+	// trim the response to the requested fields
+	fields := query.ParseFields(c.Query("fields"))
+	c.JSON(http.StatusOK, fields.Apply(data))
 }
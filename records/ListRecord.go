@@ -1,54 +1,177 @@
 package records
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"go-database-json/query"
+	"go-database-json/storage"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultPerPage = 30
+	maxPerPage     = 500
 )
 
 func ListRecord(c *gin.Context) {
 	collection := c.Param("collection")
-	dirPath := filepath.Join("database", collection)
 
-	// check if directory exists
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+	// parse the optional filter expression
+	var filter query.Filter
+	if expr := c.Query("filter"); expr != "" {
+		f, err := query.ParseFilter(expr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid filter: %v", err)})
+			return
+		}
+		filter = f
+	}
+
+	// parse sorting and pagination
+	sortFields, err := query.ParseSort(c.Query("sort"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid sort: %v", err)})
+		return
+	}
+
+	perPage, err := positiveIntQuery(c, "perPage", defaultPerPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	page, err := positiveIntQuery(c, "page", 1)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	files, err := os.ReadDir(dirPath)
+	fields := query.ParseFields(c.Query("fields"))
+
+	cursorParam, cursorMode := c.GetQuery("cursor")
+	var cursor *query.Cursor
+	if cursorParam != "" {
+		decoded, err := query.DecodeCursor(cursorParam, sortFields)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid cursor: %v", err)})
+			return
+		}
+		cursor = &decoded
+	}
+
+	unlock := storage.Locks.RLockCollection(collection)
+	records, err := storage.Default.ListRecords(collection)
+	unlock()
 	if err != nil {
+		if errors.Is(err, storage.ErrCollectionNotFound) || errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read collection"})
 		return
 	}
 
-	var items []map[string]interface{}
+	rule, ok := loadRule(c, collection, listRule)
+	if !ok {
+		return
+	}
 
-	for _, file := range files {
-		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+	var matched []storage.Record
+	for _, record := range records {
+		withIdentity(record.Data, collection, record.ID)
+		hideAuthFields(collection, record.Data)
+		if !rule.allows(c, record.Data, nil) {
 			continue
 		}
+		if filter == nil || query.MatchDocument(filter, record.Data) {
+			matched = append(matched, record)
+		}
+	}
 
-		path := filepath.Join(dirPath, file.Name())
+	// sort by the requested fields, using the record id as tie breaker
+	sort.Slice(matched, func(i, j int) bool {
+		if cmp := query.CompareBy(sortFields, matched[i].Data, matched[j].Data); cmp != 0 {
+			return cmp < 0
+		}
+		return matched[i].ID < matched[j].ID
+	})
 
-		f, err := os.Open(path)
-		if err != nil {
-			continue // skip unreadable files
+	totalItems := len(matched)
+
+	if cursorMode {
+		// cursor pagination: everything after the given position
+		start := 0
+		if cursor != nil {
+			start = sort.Search(len(matched), func(i int) bool {
+				return cursor.After(sortFields, matched[i].ID, matched[i].Data)
+			})
+		}
+		end := start + perPage
+		if end > len(matched) {
+			end = len(matched)
 		}
+		pageItems := matched[start:end]
 
-		var item map[string]interface{}
-		if err := json.NewDecoder(f).Decode(&item); err == nil {
-			items = append(items, item)
+		response := gin.H{
+			"collection": collection,
+			"count":      len(pageItems),
+			"items":      itemData(pageItems, fields),
+			"perPage":    perPage,
+			"totalItems": totalItems,
 		}
-		f.Close()
+		if end < len(matched) {
+			last := pageItems[len(pageItems)-1]
+			response["nextCursor"] = query.NewCursor(sortFields, last.ID, last.Data).Encode()
+		}
+		c.JSON(http.StatusOK, response)
+		return
 	}
 
+	// page pagination
+	totalPages := (totalItems + perPage - 1) / perPage
+	start := (page - 1) * perPage
+	if start > totalItems {
+		start = totalItems
+	}
+	end := start + perPage
+	if end > totalItems {
+		end = totalItems
+	}
+	pageItems := matched[start:end]
+
 	c.JSON(http.StatusOK, gin.H{
 		"collection": collection,
-		"count":      len(items),
-		"items":      items,
+		"count":      len(pageItems),
+		"items":      itemData(pageItems, fields),
+		"page":       page,
+		"perPage":    perPage,
+		"totalItems": totalItems,
+		"totalPages": totalPages,
 	})
 }
+
+func itemData(items []storage.Record, fields *query.Projection) []map[string]interface{} {
+	data := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		data[i] = fields.Apply(item.Data)
+	}
+	return data
+}
+
+func positiveIntQuery(c *gin.Context, name string, fallback int) (int, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid %s: must be a positive integer", name)
+	}
+	return n, nil
+}
@@ -0,0 +1,92 @@
+package records
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go-database-json/storage"
+	"net/http"
+)
+
+// ReplaceRecord replaces the whole content of a record with the request body
+func ReplaceRecord(c *gin.Context) {
+	collection := c.Param("collection")
+	id := c.Param("id")
+
+	// Read JSON data from the request body
+	var data map[string]interface{}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	// hold the record lock across the read and the write
+	unlock := lockWrite(collection, id)
+	defer unlock()
+
+	// Check if the record exists
+	current, err := storage.Default.GetRecord(collection, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read record"})
+		return
+	}
+
+	// the update rule is checked against the current record
+	rule, ok := loadRule(c, collection, updateRule)
+	if !ok {
+		return
+	}
+	// records of other customers look like missing ones
+	if rule.hides(c, current) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	hidden := hideAuthFields(collection, current)
+
+	submitted := shallowCopy(data)
+	stampUpdate(c, data, current, collection, id)
+	if !rule.stampOwner(c, data) {
+		return
+	}
+
+	// callers the rule rejects learn nothing about the record from the
+	// checks below
+	if !rule.allows(c, current, data) {
+		forbidden(c)
+		return
+	}
+
+	// reject the write if the client edited an outdated revision
+	if !checkIfMatch(c, current) {
+		return
+	}
+	if !checkSystemFields(c, collection, submitted, current) {
+		return
+	}
+
+	if !validateRecord(c, collection, data) {
+		return
+	}
+	if !checkUniqueCustomer(c, collection, id, data) {
+		return
+	}
+
+	// Overwrite the record
+	if err := storage.Default.PutRecord(collection, id, withHidden(data, hidden)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not write record"})
+		return
+	}
+	forgetCustomer(collection, current, data)
+
+	c.Header("ETag", etag(revisionOf(data)))
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "replaced",
+		"id":         id,
+		"collection": collection,
+		"data":       data,
+	})
+}
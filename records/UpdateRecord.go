@@ -2,48 +2,137 @@ package records
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"io/ioutil"
+	"go-database-json/storage"
 	"net/http"
-	"os"
-	"path/filepath"
 )
 
+// UpdateRecord applies a JSON Merge Patch (application/merge-patch+json or
+// application/json) or a JSON Patch (application/json-patch+json) to a record
 func UpdateRecord(c *gin.Context) {
 	collection := c.Param("collection")
 	id := c.Param("id")
 
-	// Read JSON data from the request body
-	var data map[string]interface{}
-	if err := c.ShouldBindJSON(&data); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read request body"})
 		return
 	}
 
-	// Build file path
-	path := filepath.Join("database", collection, id+".json")
+	// hold the record lock across the read and the write
+	unlock := lockWrite(collection, id)
+	defer unlock()
+
+	// Check if the record exists
+	current, err := storage.Default.GetRecord(collection, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidName) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read record"})
+		return
+	}
 
-	// Check if the file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		fmt.Println(path)
+	// the update rule is checked against the current record
+	rule, ok := loadRule(c, collection, updateRule)
+	if !ok {
+		return
+	}
+	// records of other customers look like missing ones
+	if rule.hides(c, current) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
 		return
 	}
 
-	// Marshal the new data to JSON
-	jsonBytes, err := json.MarshalIndent(data, "", "  ")
+	hidden := hideAuthFields(collection, current)
+
+	// patch a copy so system fields can be compared against the original
+	working, err := deepCopy(current)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not marshal JSON"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read record"})
+		return
+	}
+
+	var patched interface{}
+	switch c.ContentType() {
+	case "application/json-patch+json":
+		var operations []patchOperation
+		if err := json.Unmarshal(body, &operations); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Patch"})
+			return
+		}
+		patched, err = jsonPatch(working, operations)
+		// failed operations tell about the record, callers who can't
+		// update it only learn that
+		if err != nil && !rule.allows(c, current, current) {
+			forbidden(c)
+			return
+		}
+		if errors.Is(err, errTestFailed) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Patch: %v", err)})
+			return
+		}
+	case "application/merge-patch+json", "application/json", "":
+		var patch map[string]interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+			return
+		}
+		patched = mergePatch(working, patch)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported Content-Type, use application/merge-patch+json or application/json-patch+json"})
+		return
+	}
+
+	data, ok := patched.(map[string]interface{})
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Patched record must be a JSON object"})
+		return
+	}
+
+	submitted := shallowCopy(data)
+	stampUpdate(c, data, current, collection, id)
+	if !rule.stampOwner(c, data) {
+		return
+	}
+
+	// callers the rule rejects learn nothing about the record from the
+	// checks below
+	if !rule.allows(c, current, data) {
+		forbidden(c)
+		return
+	}
+
+	// reject the write if the client edited an outdated revision
+	if !checkIfMatch(c, current) {
+		return
+	}
+	if !checkSystemFields(c, collection, submitted, current) {
+		return
+	}
+
+	if !validateRecord(c, collection, data) {
+		return
+	}
+	if !checkUniqueCustomer(c, collection, id, data) {
 		return
 	}
 
-	// Overwrite the file
-	if err := ioutil.WriteFile(path, jsonBytes, 0644); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not write file"})
+	// Overwrite the record
+	if err := storage.Default.PutRecord(collection, id, withHidden(data, hidden)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not write record"})
 		return
 	}
+	forgetCustomer(collection, current, data)
 
+	c.Header("ETag", etag(revisionOf(data)))
 	c.JSON(http.StatusOK, gin.H{
 		"status":     "updated",
 		"id":         id,
@@ -0,0 +1,185 @@
+package records
+
+import (
+	"encoding/json"
+	"errors"
+	"go-database-json/storage"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func parseJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return v
+}
+
+// the examples of RFC 6902 appendix A
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string // empty when the patch has to fail
+	}{
+		{"A.1 add object member", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`},
+		{"A.2 add array element", `{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`},
+		{"A.3 remove object member", `{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`},
+		{"A.4 remove array element", `{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`},
+		{"A.5 replace value", `{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz": "boo", "foo": "bar"}`},
+		{"A.6 move value", `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`, `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`, `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`},
+		{"A.7 move array element", `{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`},
+		{"A.8 test success", `{"baz": "qux", "foo": ["a", 2, "c"]}`, `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`, `{"baz": "qux", "foo": ["a", 2, "c"]}`},
+		{"A.9 test error", `{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`, ``},
+		{"A.10 add nested member", `{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"foo": "bar", "child": {"grandchild": {}}}`},
+		{"A.11 ignore unrecognized elements", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`, `{"foo": "bar", "baz": "qux"}`},
+		{"A.12 add to nonexistent target", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`, ``},
+		{"A.14 escape ordering", `{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}]`, `{"/": 9, "~1": 10}`},
+		{"A.15 comparing strings and numbers", `{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": "10"}]`, ``},
+		{"A.16 add array value", `{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo": ["bar", ["abc", "def"]]}`},
+
+		// more edge cases
+		{"copy is independent", `{"a": {"b": 1}}`, `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "replace", "path": "/c/b", "value": 2}]`, `{"a": {"b": 1}, "c": {"b": 2}}`},
+		{"test whole object", `{"a": {"b": [1, 2]}}`, `[{"op": "test", "path": "/a", "value": {"b": [1, 2]}}]`, `{"a": {"b": [1, 2]}}`},
+		{"test missing path", `{"a": 1}`, `[{"op": "test", "path": "/b", "value": null}]`, ``},
+		{"move into own child", `{"a": {"b": 1}}`, `[{"op": "move", "from": "/a", "path": "/a/c"}]`, ``},
+		{"move to itself", `{"a": 1}`, `[{"op": "move", "from": "/a", "path": "/a"}]`, `{"a": 1}`},
+		{"replace missing", `{"a": 1}`, `[{"op": "replace", "path": "/b", "value": 2}]`, ``},
+		{"remove missing", `{"a": 1}`, `[{"op": "remove", "path": "/b"}]`, ``},
+		{"remove out of bounds", `{"a": [1]}`, `[{"op": "remove", "path": "/a/1"}]`, ``},
+		{"leading zero index", `{"a": [1, 2]}`, `[{"op": "remove", "path": "/a/01"}]`, ``},
+		{"add past end", `{"a": [1]}`, `[{"op": "add", "path": "/a/2", "value": 3}]`, ``},
+		{"invalid pointer", `{"a": 1}`, `[{"op": "remove", "path": "a"}]`, ``},
+		{"unknown operation", `{"a": 1}`, `[{"op": "increment", "path": "/a"}]`, ``},
+		{"later failure", `{"a": 1}`, `[{"op": "add", "path": "/b", "value": 2}, {"op": "test", "path": "/a", "value": 2}]`, ``},
+	}
+
+	for _, tt := range tests {
+		var operations []patchOperation
+		if err := json.Unmarshal([]byte(tt.patch), &operations); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := jsonPatch(parseJSON(t, tt.doc), operations)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: patch succeeded with %v, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if want := parseJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestJSONPatchTestFailure(t *testing.T) {
+	operations := []patchOperation{{Op: "test", Path: "/a", Value: "x"}}
+	if _, err := jsonPatch(parseJSON(t, `{"a": "y"}`), operations); !errors.Is(err, errTestFailed) {
+		t.Errorf("failed test returned %v", err)
+	}
+}
+
+// the examples of RFC 7396 appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`["a", "b"]`, `["c", "d"]`, `["c", "d"]`},
+		{`{"a": "b"}`, `["c"]`, `["c"]`},
+		{`{"a": "foo"}`, `null`, `null`},
+		{`{"a": "foo"}`, `"bar"`, `"bar"`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`[1, 2]`, `{"a": "b", "c": null}`, `{"a": "b"}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+	}
+
+	for _, tt := range tests {
+		got := mergePatch(parseJSON(t, tt.target), parseJSON(t, tt.patch))
+		if want := parseJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("merge %s into %s: got %v, want %s", tt.patch, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateRecordPatches(t *testing.T) {
+	r := newTestRouter(t)
+	createCollection(t, "notes", nil)
+
+	_, body := serve(r, testRequest{method: "POST", path: "/notes", body: `{"title": "first", "tags": ["a", "b"], "meta": {"pinned": true}}`, header: superuser})
+	id := body["id"].(string)
+	patch := func(contentType, patch string) (int, map[string]interface{}) {
+		w, body := serve(r, testRequest{method: "PATCH", path: "/notes/" + id, body: patch, header: map[string]string{
+			"Content-Type": contentType, "X-Test-User": "root", "X-Test-Role": "superuser",
+		}})
+		return w.Code, body
+	}
+
+	// a failing test leaves the stored record alone, including the
+	// operations before it that changed the working copy
+	code, _ := patch("application/json-patch+json", `[
+		{"op": "remove", "path": "/tags/0"},
+		{"op": "add", "path": "/meta/color", "value": "red"},
+		{"op": "test", "path": "/title", "value": "other"}
+	]`)
+	if code != http.StatusConflict {
+		t.Errorf("failing test: %d, want 409", code)
+	}
+	stored, _ := storage.Default.GetRecord("notes", id)
+	if len(stored["tags"].([]interface{})) != 2 || stored["meta"].(map[string]interface{})["color"] != nil || stored["revision"] != float64(1) {
+		t.Errorf("failed patch changed the record: %v", stored)
+	}
+
+	code, body = patch("application/json-patch+json", `[
+		{"op": "test", "path": "/title", "value": "first"},
+		{"op": "move", "from": "/tags/0", "path": "/tags/-"},
+		{"op": "copy", "from": "/title", "path": "/subtitle"}
+	]`)
+	if code != http.StatusOK {
+		t.Fatalf("json patch: %d %v", code, body)
+	}
+	data := body["data"].(map[string]interface{})
+	if !reflect.DeepEqual(data["tags"], []interface{}{"b", "a"}) || data["subtitle"] != "first" {
+		t.Errorf("json patch result %v", data)
+	}
+
+	code, body = patch("application/merge-patch+json", `{"subtitle": null, "meta": {"pinned": null, "color": "blue"}}`)
+	if code != http.StatusOK {
+		t.Fatalf("merge patch: %d %v", code, body)
+	}
+	data = body["data"].(map[string]interface{})
+	if _, ok := data["subtitle"]; ok || !reflect.DeepEqual(data["meta"], map[string]interface{}{"color": "blue"}) {
+		t.Errorf("merge patch result %v", data)
+	}
+
+	for _, tt := range []struct {
+		contentType, patch string
+		code               int
+	}{
+		{"application/json-patch+json", `{"op": "add"}`, http.StatusBadRequest},
+		{"application/json-patch+json", `[{"op": "remove", "path": "/missing"}]`, http.StatusBadRequest},
+		{"application/json-patch+json", `[{"op": "replace", "path": "", "value": [1]}]`, http.StatusBadRequest},
+		{"application/json-patch+json", `[{"op": "replace", "path": "/revision", "value": 7}]`, http.StatusBadRequest},
+		{"application/merge-patch+json", `[1]`, http.StatusBadRequest},
+		{"text/plain", `{}`, http.StatusUnsupportedMediaType},
+	} {
+		if code, body := patch(tt.contentType, tt.patch); code != tt.code {
+			t.Errorf("%s %s: %d %v, want %d", tt.contentType, tt.patch, code, body, tt.code)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package records
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go-database-json/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestRouter serves the record handlers on a fresh in-memory storage.
+// Requests authenticate through the X-Test-User and X-Test-Role headers.
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	previous := storage.Default
+	storage.Default = storage.NewMemoryStorage()
+	t.Cleanup(func() { storage.Default = previous })
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if user := c.GetHeader("X-Test-User"); user != "" {
+			c.Set("username", user)
+			c.Set("role", c.GetHeader("X-Test-Role"))
+		}
+	})
+	r.GET("/:collection", ListRecord)
+	r.POST("/:collection", CreateRecord)
+	r.GET("/:collection/:id", GetRecord)
+	r.PATCH("/:collection/:id", UpdateRecord)
+	r.PUT("/:collection/:id", ReplaceRecord)
+	r.DELETE("/:collection/:id", DeleteRecord)
+	return r
+}
+
+type testRequest struct {
+	method, path string
+	body         string
+	header       map[string]string
+}
+
+func serve(r *gin.Engine, req testRequest) (*httptest.ResponseRecorder, map[string]interface{}) {
+	httpReq := httptest.NewRequest(req.method, req.path, bytes.NewBufferString(req.body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	for key, value := range req.header {
+		httpReq.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httpReq)
+
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w, body
+}
+
+// as authenticates a request with the given identity and role
+func as(user, role string) map[string]string {
+	return map[string]string{"X-Test-User": user, "X-Test-Role": role}
+}
+
+// superuser is the header of requests bypassing the access rules
+var superuser = as("root", "superuser")
+
+// createCollection stores a collection config with open access rules
+func createCollection(t *testing.T, id string, config map[string]interface{}) {
+	t.Helper()
+	content := map[string]interface{}{
+		"name":       id,
+		"listRule":   "",
+		"viewRule":   "",
+		"createRule": "",
+		"updateRule": "",
+		"deleteRule": "",
+	}
+	for key, value := range config {
+		content[key] = value
+	}
+	if err := storage.Default.CreateCollection(id, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListRecordFilter(t *testing.T) {
+	r := newTestRouter(t)
+	createCollection(t, "people", nil)
+	for _, body := range []string{
+		`{"name": "ann", "age": 30, "address": {"city": "Berlin"}}`,
+		`{"name": "bob", "age": 17, "address": {"city": "Hamburg"}}`,
+		`{"name": "eve", "age": 45, "address": {"city": "Berlin"}}`,
+	} {
+		if w, _ := serve(r, testRequest{method: "POST", path: "/people", body: body, header: superuser}); w.Code != http.StatusCreated {
+			t.Fatalf("create: %d %s", w.Code, w.Body)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		code   int
+		count  int
+	}{
+		{`age >= 18`, http.StatusOK, 2},
+		{`address.city = "Berlin" && age < 40`, http.StatusOK, 1},
+		{`name = "bob" || age > 40`, http.StatusOK, 2},
+		{`name in ["ann", "eve"]`, http.StatusOK, 2},
+		{`age >= `, http.StatusBadRequest, 0},
+		{`(age = 1`, http.StatusBadRequest, 0},
+		{`name = "open`, http.StatusBadRequest, 0},
+		{`age # 1`, http.StatusBadRequest, 0},
+		{`age > 1e-5 && age < 1E+2`, http.StatusOK, 3},
+		{strings.Repeat("(", 10) + `age = 30` + strings.Repeat(")", 10), http.StatusOK, 1},
+		{strings.Repeat("(", 1000) + `age = 30` + strings.Repeat(")", 1000), http.StatusBadRequest, 0},
+		{`name in ` + strings.Repeat("[", 1000), http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		path := "/people?filter=" + url.QueryEscape(tt.filter)
+		w, body := serve(r, testRequest{method: "GET", path: path, header: superuser})
+		if w.Code != tt.code {
+			t.Errorf("filter %q: status %d, want %d", tt.filter, w.Code, tt.code)
+			continue
+		}
+		if tt.code == http.StatusOK && int(body["totalItems"].(float64)) != tt.count {
+			t.Errorf("filter %q: %v items, want %d", tt.filter, body["totalItems"], tt.count)
+		}
+		if tt.code == http.StatusBadRequest && body["error"] == nil {
+			t.Errorf("filter %q: no error message", tt.filter)
+		}
+	}
+}
+
+func TestRecordLifecycle(t *testing.T) {
+	r := newTestRouter(t)
+	createCollection(t, "notes", nil)
+	ann := as("ann", "customer")
+
+	w, body := serve(r, testRequest{method: "POST", path: "/notes", body: `{"title": "first"}`, header: ann})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	id := body["id"].(string)
+	data := body["data"].(map[string]interface{})
+	if data["createdBy"] != "ann" || data["collectionId"] != "notes" || data["revision"] != float64(1) || w.Header().Get("ETag") != `"1"` {
+		t.Errorf("create stamped %v, ETag %s", data, w.Header().Get("ETag"))
+	}
+
+	// stored through the storage interface
+	if stored, err := storage.Default.GetRecord("notes", id); err != nil || stored["title"] != "first" {
+		t.Fatalf("stored record %v: %v", stored, err)
+	}
+
+	w, body = serve(r, testRequest{method: "GET", path: "/notes/" + id, header: ann})
+	if w.Code != http.StatusOK || body["title"] != "first" {
+		t.Errorf("get: %d %v", w.Code, body)
+	}
+	w, _ = serve(r, testRequest{method: "GET", path: "/notes/" + id, header: map[string]string{"If-None-Match": `"1"`}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional get: %d", w.Code)
+	}
+
+	// system fields can't be changed
+	w, _ = serve(r, testRequest{method: "PATCH", path: "/notes/" + id, body: `{"createdBy": "eve"}`, header: ann})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("patch system field: %d", w.Code)
+	}
+
+	w, body = serve(r, testRequest{method: "PATCH", path: "/notes/" + id, body: `{"title": "second"}`, header: map[string]string{"X-Test-User": "bob", "X-Test-Role": "customer", "If-Match": `"1"`}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch: %d %s", w.Code, w.Body)
+	}
+	data = body["data"].(map[string]interface{})
+	if data["title"] != "second" || data["revision"] != float64(2) || data["createdBy"] != "ann" || data["updatedBy"] != "bob" {
+		t.Errorf("patch stamped %v", data)
+	}
+
+	// the edit above made revision 1 outdated
+	w, _ = serve(r, testRequest{method: "PUT", path: "/notes/" + id, body: `{"title": "third"}`, header: map[string]string{"If-Match": `"1"`}})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("replace with outdated revision: %d", w.Code)
+	}
+	w, body = serve(r, testRequest{method: "PUT", path: "/notes/" + id, body: `{"title": "third"}`, header: map[string]string{"If-Match": `"2"`}})
+	if w.Code != http.StatusOK || body["data"].(map[string]interface{})["revision"] != float64(3) {
+		t.Errorf("replace: %d %v", w.Code, body)
+	}
+
+	w, body = serve(r, testRequest{method: "GET", path: "/notes?fields=title", header: ann})
+	if w.Code != http.StatusOK || body["totalItems"] != float64(1) {
+		t.Errorf("list: %d %v", w.Code, body)
+	} else if item := body["items"].([]interface{})[0].(map[string]interface{}); len(item) != 1 || item["title"] != "third" {
+		t.Errorf("list projected %v", item)
+	}
+
+	w, _ = serve(r, testRequest{method: "DELETE", path: "/notes/" + id, header: ann})
+	if w.Code != http.StatusOK {
+		t.Errorf("delete: %d", w.Code)
+	}
+	for _, method := range []string{"GET", "PATCH", "PUT", "DELETE"} {
+		if w, _ := serve(r, testRequest{method: method, path: "/notes/" + id, body: `{}`, header: ann}); w.Code != http.StatusNotFound {
+			t.Errorf("%s of deleted record: %d", method, w.Code)
+		}
+	}
+}
+
+func TestRecordAccessRules(t *testing.T) {
+	r := newTestRouter(t)
+	createCollection(t, "posts", map[string]interface{}{
+		"listRule":   `published = true`,
+		"viewRule":   `published = true || author = @request.auth.id`,
+		"createRule": `@request.auth.id != "" && @request.body.author = @request.auth.id`,
+		"updateRule": `author = @request.auth.id`,
+		"deleteRule": nil,
+	})
+	ann := as("ann", "customer")
+	bob := as("bob", "customer")
+
+	if w, _ := serve(r, testRequest{method: "POST", path: "/posts", body: `{"author": "ann", "published": false}`}); w.Code != http.StatusForbidden {
+		t.Errorf("anonymous create: %d", w.Code)
+	}
+	if w, _ := serve(r, testRequest{method: "POST", path: "/posts", body: `{"author": "ann", "published": false}`, header: bob}); w.Code != http.StatusForbidden {
+		t.Errorf("create for someone else: %d", w.Code)
+	}
+	w, body := serve(r, testRequest{method: "POST", path: "/posts", body: `{"author": "ann", "published": false}`, header: ann})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	id := body["id"].(string)
+
+	if w, _ := serve(r, testRequest{method: "GET", path: "/posts/" + id, header: bob}); w.Code != http.StatusNotFound {
+		t.Errorf("view of unpublished post by other user: %d", w.Code)
+	}
+	if w, _ := serve(r, testRequest{method: "GET", path: "/posts/" + id, header: ann}); w.Code != http.StatusOK {
+		t.Errorf("view by author: %d", w.Code)
+	}
+	if _, body := serve(r, testRequest{method: "GET", path: "/posts", header: ann}); body["totalItems"] != float64(0) {
+		t.Errorf("list showed unpublished post: %v", body)
+	}
+	if w, _ := serve(r, testRequest{method: "PATCH", path: "/posts/" + id, body: `{"published": true}`, header: bob}); w.Code != http.StatusForbidden {
+		t.Errorf("update by other user: %d", w.Code)
+	}
+	if w, _ := serve(r, testRequest{method: "PATCH", path: "/posts/" + id, body: `{"published": true}`, header: ann}); w.Code != http.StatusOK {
+		t.Errorf("update by author: %d", w.Code)
+	}
+	if _, body := serve(r, testRequest{method: "GET", path: "/posts"}); body["totalItems"] != float64(1) {
+		t.Errorf("list missed published post: %v", body)
+	}
+
+	// a null rule leaves the action to superusers
+	if w, _ := serve(r, testRequest{method: "DELETE", path: "/posts/" + id, header: ann}); w.Code != http.StatusForbidden {
+		t.Errorf("delete by author: %d", w.Code)
+	}
+	if w, _ := serve(r, testRequest{method: "DELETE", path: "/posts/" + id, header: superuser}); w.Code != http.StatusOK {
+		t.Errorf("delete by superuser: %d", w.Code)
+	}
+}
+
+func TestRecordOwner(t *testing.T) {
+	r := newTestRouter(t)
+	createCollection(t, "notes", map[string]interface{}{"ownerField": "owner"})
+	ann := as("ann", "customer")
+	bob := as("bob", "customer")
+
+	create := func(body string, header map[string]string) (int, map[string]interface{}) {
+		w, resp := serve(r, testRequest{method: "POST", path: "/notes", body: body, header: header})
+		data, _ := resp["data"].(map[string]interface{})
+		return w.Code, data
+	}
+
+	// customers own what they create
+	code, annNote := create(`{"text": "ann's"}`, ann)
+	if code != http.StatusCreated || annNote["owner"] != "ann" {
+		t.Fatalf("create by customer: %d %v", code, annNote)
+	}
+	if code, _ := create(`{"text": "x", "owner": "ann"}`, ann); code != http.StatusCreated {
+		t.Errorf("create naming oneself as owner: %d", code)
+	}
+	if code, _ := create(`{"text": "x", "owner": "bob"}`, ann); code != http.StatusBadRequest {
+		t.Errorf("create for someone else: %d", code)
+	}
+	if code, _ := create(`{"text": "x"}`, nil); code != http.StatusForbidden {
+		t.Errorf("anonymous create: %d", code)
+	}
+	// superusers hand out records
+	code, bobNote := create(`{"text": "bob's", "owner": "bob"}`, superuser)
+	if code != http.StatusCreated || bobNote["owner"] != "bob" {
+		t.Fatalf("create by superuser: %d %v", code, bobNote)
+	}
+
+	annPath := "/notes/" + annNote["id"].(string)
+	tests := []struct {
+		name string
+		req  testRequest
+		code int
+	}{
+		{"view own", testRequest{method: "GET", path: annPath, header: ann}, http.StatusOK},
+		{"view other's", testRequest{method: "GET", path: annPath, header: bob}, http.StatusNotFound},
+		{"view anonymously", testRequest{method: "GET", path: annPath}, http.StatusNotFound},
+		{"view as superuser", testRequest{method: "GET", path: annPath, header: superuser}, http.StatusOK},
+		{"update other's", testRequest{method: "PATCH", path: annPath, body: `{"text": "mine"}`, header: bob}, http.StatusNotFound},
+		{"replace other's", testRequest{method: "PUT", path: annPath, body: `{"text": "mine"}`, header: bob}, http.StatusNotFound},
+		{"delete other's", testRequest{method: "DELETE", path: annPath, header: bob}, http.StatusNotFound},
+		{"give away own", testRequest{method: "PATCH", path: annPath, body: `{"owner": "bob"}`, header: ann}, http.StatusBadRequest},
+		{"replace keeps owner", testRequest{method: "PUT", path: annPath, body: `{"text": "replaced"}`, header: ann}, http.StatusOK},
+		{"update own", testRequest{method: "PATCH", path: annPath, body: `{"text": "updated"}`, header: ann}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w, _ := serve(r, tt.req); w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d: %s", tt.name, w.Code, tt.code, w.Body)
+		}
+	}
+	if stored, _ := storage.Default.GetRecord("notes", annNote["id"].(string)); stored["owner"] != "ann" || stored["text"] != "updated" {
+		t.Errorf("stored %v", stored)
+	}
+
+	// lists only hold the records of the caller
+	lists := []struct {
+		name   string
+		header map[string]string
+		total  float64
+	}{
+		{"ann", ann, 2},
+		{"bob", bob, 1},
+		{"anonymous", nil, 0},
+		{"superuser", superuser, 3},
+		{"api key", as("apikey:sync", "apikey"), 3},
+	}
+	for _, tt := range lists {
+		_, body := serve(r, testRequest{method: "GET", path: "/notes", header: tt.header})
+		if body["totalItems"] != tt.total {
+			t.Errorf("list as %s: %v", tt.name, body)
+			continue
+		}
+		for _, item := range body["items"].([]interface{}) {
+			if owner := item.(map[string]interface{})["owner"]; tt.total < 3 && owner != tt.header["X-Test-User"] {
+				t.Errorf("list as %s showed a record of %v", tt.name, owner)
+			}
+		}
+	}
+}
+
+func TestRecordRuleBeforePreconditions(t *testing.T) {
+	r := newTestRouter(t)
+	createCollection(t, "posts", map[string]interface{}{"updateRule": `author = @request.auth.id`})
+	ann := as("ann", "customer")
+
+	w, body := serve(r, testRequest{method: "POST", path: "/posts", body: `{"author": "ann", "secret": "x"}`, header: ann})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	path := "/posts/" + body["id"].(string)
+
+	with := func(user string, header map[string]string) map[string]string {
+		h := as(user, "customer")
+		for key, value := range header {
+			h[key] = value
+		}
+		return h
+	}
+	stale := map[string]string{"If-Match": `"7"`}
+	jsonPatch := map[string]string{"Content-Type": "application/json-patch+json"}
+
+	// the rule is checked first, so its answer tells nothing about the record
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		header map[string]string
+		bob    int
+		ann    int
+	}{
+		{"stale update", "PATCH", `{"title": "t"}`, stale, http.StatusForbidden, http.StatusPreconditionFailed},
+		{"stale replace", "PUT", `{"author": "ann"}`, stale, http.StatusForbidden, http.StatusPreconditionFailed},
+		{"system field", "PATCH", `{"createdBy": "eve"}`, nil, http.StatusForbidden, http.StatusBadRequest},
+		{"failed test", "PATCH", `[{"op": "test", "path": "/secret", "value": "y"}]`, jsonPatch, http.StatusForbidden, http.StatusConflict},
+		{"missing path", "PATCH", `[{"op": "remove", "path": "/hidden"}]`, jsonPatch, http.StatusForbidden, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		for _, user := range []string{"bob", "ann"} {
+			want := tt.bob
+			if user == "ann" {
+				want = tt.ann
+			}
+			w, body := serve(r, testRequest{method: tt.method, path: path, body: tt.body, header: with(user, tt.header)})
+			if w.Code != want {
+				t.Errorf("%s by %s: got %d, want %d", tt.name, user, w.Code, want)
+			}
+			if _, ok := body["revision"]; ok && user == "bob" {
+				t.Errorf("%s by %s: revision leaked: %v", tt.name, user, body)
+			}
+		}
+	}
+}
+
+func TestCustomerUniqueness(t *testing.T) {
+	r := newTestRouter(t)
+	createCollection(t, "customers", nil)
+
+	create := func(body string) (int, string) {
+		w, resp := serve(r, testRequest{method: "POST", path: "/customers", body: body, header: superuser})
+		id, _ := resp["id"].(string)
+		return w.Code, id
+	}
+	if code, _ := create(`{"identity": "alice", "email": "alice@example.com"}`); code != http.StatusCreated {
+		t.Fatalf("create alice: %d", code)
+	}
+	code, bob := create(`{"identity": "bob@example.com"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("create bob: %d", code)
+	}
+
+	tests := []struct {
+		name string
+		req  testRequest
+		code int
+	}{
+		{"same identity", testRequest{method: "POST", path: "/customers", body: `{"identity": "alice"}`}, http.StatusConflict},
+		{"same email", testRequest{method: "POST", path: "/customers", body: `{"identity": "carol", "email": "ALICE@example.com"}`}, http.StatusConflict},
+		{"email taken as identity", testRequest{method: "POST", path: "/customers", body: `{"identity": "carol", "email": "bob@example.com"}`}, http.StatusConflict},
+		{"rename to taken identity", testRequest{method: "PATCH", path: "/customers/" + bob, body: `{"identity": "alice"}`}, http.StatusConflict},
+		{"replace with taken email", testRequest{method: "PUT", path: "/customers/" + bob, body: `{"identity": "bob", "email": "alice@example.com"}`}, http.StatusConflict},
+		{"keep own identity", testRequest{method: "PATCH", path: "/customers/" + bob, body: `{"name": "Bob"}`}, http.StatusOK},
+		{"rename to free identity", testRequest{method: "PATCH", path: "/customers/" + bob, body: `{"identity": "robert", "email": "bob@example.com"}`}, http.StatusOK},
+		{"unique customer", testRequest{method: "POST", path: "/customers", body: `{"identity": "carol"}`}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		tt.req.header = superuser
+		if w, _ := serve(r, tt.req); w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d: %s", tt.name, w.Code, tt.code, w.Body)
+		}
+	}
+
+	// the same identities are fine in other collections
+	createCollection(t, "notes", nil)
+	for i := 0; i < 2; i++ {
+		if w, _ := serve(r, testRequest{method: "POST", path: "/notes", body: `{"identity": "alice"}`, header: superuser}); w.Code != http.StatusCreated {
+			t.Fatalf("create note: %d %s", w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package records
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// revisionField holds the record revision, bumped on every write
+const revisionField = "revision"
+
+// revisionOf returns the revision stored in a record, 0 for legacy records
+func revisionOf(data map[string]interface{}) int {
+	if rev, ok := data[revisionField].(float64); ok {
+		return int(rev)
+	}
+	if rev, ok := data[revisionField].(int); ok {
+		return rev
+	}
+	return 0
+}
+
+func etag(revision int) string {
+	return `"` + strconv.Itoa(revision) + `"`
+}
+
+// etagMatches reports whether an If-Match / If-None-Match header value
+// contains the given entity tag or "*"
+func etagMatches(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch answers with 412 Precondition Failed and returns false when
+// the request carries an If-Match header that does not match the record
+func checkIfMatch(c *gin.Context, current map[string]interface{}) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" || etagMatches(header, etag(revisionOf(current))) {
+		return true
+	}
+	c.JSON(http.StatusPreconditionFailed, gin.H{
+		"error":    "Record was modified by someone else",
+		"revision": revisionOf(current),
+	})
+	return false
+}
@@ -0,0 +1,142 @@
+package records
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-database-json/auth"
+	"go-database-json/query"
+	"go-database-json/storage"
+	"net/http"
+	"strings"
+)
+
+// collection config keys holding the access rules
+const (
+	listRule   = "listRule"
+	viewRule   = "viewRule"
+	createRule = "createRule"
+	updateRule = "updateRule"
+	deleteRule = "deleteRule"
+)
+
+// collection config key naming the field that holds the owner of a record
+const ownerField = "ownerField"
+
+// accessRule is the resolved rule of a collection for the current caller.
+// A missing or null rule only lets superusers through, an empty rule lets
+// everyone through and any other rule is a filter expression evaluated
+// against the record, e.g. `@request.auth.id != "" && owner = @request.auth.id`.
+// In collections with an owner field callers other than superusers and API
+// keys only get to their own records on top of that.
+type accessRule struct {
+	bypass bool
+	filter query.Filter
+	// owner is the owner field the caller is restricted by
+	owner string
+}
+
+// loadRule resolves the named access rule of a collection. It answers with
+// 500 and returns false if the collection config or the rule is broken.
+func loadRule(c *gin.Context, collection, name string) (*accessRule, bool) {
+	// API keys are checked against their scope and the permissions of their
+	// creator before, the customers collection has to be named in the scope
+	if role := c.GetString("role"); role == auth.RoleSuperuser || role == auth.RoleAPIKey {
+		return &accessRule{bypass: true}, true
+	}
+
+	config, err := storage.Default.GetCollection(collection)
+	if errors.Is(err, storage.ErrCollectionNotFound) || errors.Is(err, storage.ErrInvalidName) {
+		return &accessRule{}, true // no config, superusers only
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read collection config"})
+		return nil, false
+	}
+
+	owner, _ := config[ownerField].(string)
+
+	expr, ok := config[name].(string)
+	if !ok {
+		return &accessRule{owner: owner}, true
+	}
+	if strings.TrimSpace(expr) == "" {
+		return &accessRule{bypass: true, owner: owner}, true
+	}
+
+	filter, err := query.ParseFilter(expr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid " + name + " in collection config"})
+		return nil, false
+	}
+	return &accessRule{filter: filter, owner: owner}, true
+}
+
+// allows evaluates the rule against a record. Plain identifiers refer to the
+// record, @request.auth.id and @request.auth.role to the caller and
+// @request.body.<field> to the submitted data.
+func (r *accessRule) allows(c *gin.Context, record, body map[string]interface{}) bool {
+	if r.hides(c, record) {
+		return false
+	}
+	if r.bypass {
+		return true
+	}
+	if r.filter == nil {
+		return false
+	}
+
+	return r.filter.Match(func(name string) (interface{}, bool) {
+		switch {
+		case name == "@request.auth.id":
+			return c.GetString("username"), true
+		case name == "@request.auth.role":
+			return c.GetString("role"), true
+		case strings.HasPrefix(name, "@request.body."):
+			if body == nil {
+				return nil, false
+			}
+			return query.Lookup(body, strings.TrimPrefix(name, "@request.body."))
+		case strings.HasPrefix(name, "@"):
+			return nil, false
+		}
+		return query.Lookup(record, name)
+	})
+}
+
+// ownedBy reports whether the record belongs to the calling customer
+func ownedBy(c *gin.Context, record map[string]interface{}, field string) bool {
+	identity := c.GetString("username")
+	if identity == "" || c.GetString("role") != auth.RoleCustomer {
+		return false
+	}
+	owner, ok := record[field]
+	return ok && query.Equal(owner, identity)
+}
+
+// hides reports whether the record belongs to someone else in a collection
+// the caller is restricted to their own records in
+func (r *accessRule) hides(c *gin.Context, record map[string]interface{}) bool {
+	return r.owner != "" && !ownedBy(c, record, r.owner)
+}
+
+// stampOwner sets the owner field of records written by customers to their
+// identity. It answers with 400 and returns false when a customer tries to
+// hand a record to someone else.
+func (r *accessRule) stampOwner(c *gin.Context, data map[string]interface{}) bool {
+	if r.owner == "" || c.GetString("role") != auth.RoleCustomer {
+		return true
+	}
+	identity := c.GetString("username")
+	if value, ok := data[r.owner]; ok && !query.Equal(value, identity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Field '%s' holds the owner and can't be set to someone else", r.owner)})
+		return false
+	}
+	data[r.owner] = identity
+	return true
+}
+
+// forbidden answers with 403 for callers not passing an access rule
+func forbidden(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to perform this action"})
+}
@@ -0,0 +1,183 @@
+package records
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-database-json/auth"
+	"go-database-json/query"
+	"go-database-json/storage"
+	"net/http"
+	"time"
+)
+
+// checkSystemFields answers with 400 and returns false when the body tries to
+// set a system field. On updates a field may be sent back unchanged.
+// Credentials of customer records can't be set through the record handlers.
+func checkSystemFields(c *gin.Context, collection string, data, current map[string]interface{}) bool {
+	if collection == auth.CustomersCollection {
+		for _, field := range auth.CustomerAuthFields {
+			if _, ok := data[field]; ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Field '%s' can only be changed through the customer endpoints", field)})
+				return false
+			}
+		}
+	}
+
+	protected := storage.SystemFields
+	if collection == auth.CustomersCollection {
+		protected = append(append([]string{}, protected...), auth.CustomerReadOnlyFields...)
+	}
+
+	for _, field := range protected {
+		value, ok := data[field]
+		if !ok {
+			continue
+		}
+		if current != nil && query.Equal(value, current[field]) {
+			continue
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Field '%s' is reserved and can't be modified", field)})
+		return false
+	}
+	return true
+}
+
+// lockWrite locks a record for writing and returns the unlock func. Writes
+// to customer records lock the whole collection, the identity and email
+// address of a customer are checked against all other accounts and tokens
+// are looked up by identity.
+func lockWrite(collection, id string) func() {
+	if collection == auth.CustomersCollection {
+		return storage.Locks.LockCollection(collection)
+	}
+	return storage.Locks.LockRecord(collection, id)
+}
+
+// checkUniqueCustomer answers with 409 and returns false when a customer
+// record would take the identity or email address of another account.
+// The caller must hold the lock returned by lockWrite.
+func checkUniqueCustomer(c *gin.Context, collection, id string, data map[string]interface{}) bool {
+	if collection != auth.CustomersCollection {
+		return true
+	}
+	err := auth.CheckUniqueCustomer(id, data)
+	if errors.Is(err, auth.ErrCustomerExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A customer with this identity or email address already exists"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read customers"})
+		return false
+	}
+	return true
+}
+
+// forgetCustomer logs out the customer of a record that was deleted, data is
+// nil then, or that was given another identity
+func forgetCustomer(collection string, current, data map[string]interface{}) {
+	if collection != auth.CustomersCollection {
+		return
+	}
+	if data == nil || !query.Equal(data["identity"], current["identity"]) {
+		auth.ForgetCustomer(current)
+	}
+}
+
+// stampCreate fills in the system fields of a new record
+func stampCreate(c *gin.Context, data map[string]interface{}, collection, id string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	author := c.GetString("username")
+
+	data["id"] = id
+	data["collectionId"] = collection
+	data["created"] = now
+	data["updated"] = now
+	data["createdBy"] = author
+	data["updatedBy"] = author
+	data[revisionField] = 1
+}
+
+// stampUpdate carries the system fields of the current record over to its
+// new content and records who changed it when
+func stampUpdate(c *gin.Context, data, current map[string]interface{}, collection, id string) {
+	for _, field := range []string{"created", "createdBy"} {
+		if value, ok := current[field]; ok {
+			data[field] = value
+		} else {
+			delete(data, field)
+		}
+	}
+
+	// read-only customer fields are kept, but a new email address has to
+	// be verified again
+	if collection == auth.CustomersCollection {
+		for _, field := range auth.CustomerReadOnlyFields {
+			if value, ok := current[field]; ok {
+				data[field] = value
+			}
+		}
+		if !query.Equal(data["email"], current["email"]) || !query.Equal(data["identity"], current["identity"]) {
+			data["verified"] = false
+		}
+	}
+
+	data["id"] = id
+	data["collectionId"] = collection
+	data["updated"] = time.Now().UTC().Format(time.RFC3339)
+	data["updatedBy"] = c.GetString("username")
+	data[revisionField] = revisionOf(current) + 1
+}
+
+// withIdentity adds id and collectionId to records written before
+// system fields existed
+func withIdentity(data map[string]interface{}, collection, id string) map[string]interface{} {
+	if _, ok := data["id"]; !ok {
+		data["id"] = id
+	}
+	if _, ok := data["collectionId"]; !ok {
+		data["collectionId"] = collection
+	}
+	return data
+}
+
+// hideAuthFields removes the credentials from customer records and returns
+// them, so they can be put back before the record is stored again
+func hideAuthFields(collection string, data map[string]interface{}) map[string]interface{} {
+	if collection != auth.CustomersCollection {
+		return nil
+	}
+	hidden := make(map[string]interface{})
+	for _, field := range auth.CustomerAuthFields {
+		if value, ok := data[field]; ok {
+			hidden[field] = value
+			delete(data, field)
+		}
+	}
+	return hidden
+}
+
+// withHidden returns a copy of data with the hidden fields put back
+func withHidden(data, hidden map[string]interface{}) map[string]interface{} {
+	if len(hidden) == 0 {
+		return data
+	}
+	stored := make(map[string]interface{}, len(data)+len(hidden))
+	for key, value := range data {
+		stored[key] = value
+	}
+	for key, value := range hidden {
+		stored[key] = value
+	}
+	return stored
+}
+
+// shallowCopy copies the top level of a record, e.g. to check the submitted
+// fields after the system fields were stamped
+func shallowCopy(data map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,46 @@
+package records
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go-database-json/schema"
+	"go-database-json/storage"
+	"net/http"
+)
+
+// validateRecord checks the client fields of a record against the JSON Schema
+// of its collection. It answers with 400 and the list of field errors and
+// returns false when the record does not match.
+func validateRecord(c *gin.Context, collection string, data map[string]interface{}) bool {
+	config, err := storage.Default.GetCollection(collection)
+	if errors.Is(err, storage.ErrCollectionNotFound) {
+		return true // records in collections without config are not validated
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read collection config"})
+		return false
+	}
+
+	recordSchema, ok := config["schema"].(map[string]interface{})
+	if !ok {
+		return true
+	}
+
+	// the schema describes the client fields only
+	fields := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		fields[key] = value
+	}
+	for _, field := range storage.SystemFields {
+		delete(fields, field)
+	}
+
+	if errs := schema.Validate(recordSchema, fields); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "Validation failed",
+			"errors": errs,
+		})
+		return false
+	}
+	return true
+}
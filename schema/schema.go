@@ -0,0 +1,335 @@
+package schema
+
+import (
+	"fmt"
+	"go-database-json/query"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// FieldError describes one value that does not match the schema.
+// Path uses the same dot notation as filters, e.g. "address.city" or "tags.0".
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+var validTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// Check reports whether schema only uses the supported subset of
+// JSON Schema draft 2020-12 correctly: type, enum, const, required,
+// properties, additionalProperties, items, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, minLength, maxLength, pattern,
+// minItems and maxItems. Other keywords like title are ignored.
+func Check(schema map[string]interface{}) error {
+	return check(schema, "")
+}
+
+func check(schema map[string]interface{}, path string) error {
+	fail := func(format string, args ...interface{}) error {
+		where := path
+		if where == "" {
+			where = "root"
+		}
+		return fmt.Errorf("%s: %s", where, fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := schema["type"]; ok {
+		var names []interface{}
+		switch v := t.(type) {
+		case string:
+			names = []interface{}{v}
+		case []interface{}:
+			names = v
+		default:
+			return fail("type must be a string or an array of strings")
+		}
+		for _, name := range names {
+			s, ok := name.(string)
+			if !ok || !validTypes[s] {
+				return fail("unknown type %v", name)
+			}
+		}
+	}
+
+	if enum, ok := schema["enum"]; ok {
+		if _, ok := enum.([]interface{}); !ok {
+			return fail("enum must be an array")
+		}
+	}
+
+	if required, ok := schema["required"]; ok {
+		list, ok := required.([]interface{})
+		if !ok {
+			return fail("required must be an array of strings")
+		}
+		for _, name := range list {
+			if _, ok := name.(string); !ok {
+				return fail("required must be an array of strings")
+			}
+		}
+	}
+
+	for _, keyword := range []string{"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum"} {
+		if v, ok := schema[keyword]; ok {
+			if _, ok := v.(float64); !ok {
+				return fail("%s must be a number", keyword)
+			}
+		}
+	}
+
+	for _, keyword := range []string{"minLength", "maxLength", "minItems", "maxItems"} {
+		if v, ok := schema[keyword]; ok {
+			n, ok := v.(float64)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return fail("%s must be a non-negative integer", keyword)
+			}
+		}
+	}
+
+	if pattern, ok := schema["pattern"]; ok {
+		s, ok := pattern.(string)
+		if !ok {
+			return fail("pattern must be a string")
+		}
+		if _, err := compile(s); err != nil {
+			return fail("invalid pattern: %v", err)
+		}
+	}
+
+	if properties, ok := schema["properties"]; ok {
+		props, ok := properties.(map[string]interface{})
+		if !ok {
+			return fail("properties must be an object")
+		}
+		// check in a stable order so the same error is reported every time
+		names := make([]string, 0, len(props))
+		for name := range props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			subSchema, ok := props[name].(map[string]interface{})
+			if !ok {
+				return fail("property %s must be a schema object", name)
+			}
+			if err := check(subSchema, join(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if additional, ok := schema["additionalProperties"]; ok {
+		switch v := additional.(type) {
+		case bool:
+		case map[string]interface{}:
+			if err := check(v, join(path, "*")); err != nil {
+				return err
+			}
+		default:
+			return fail("additionalProperties must be a boolean or a schema object")
+		}
+	}
+
+	if items, ok := schema["items"]; ok {
+		itemSchema, ok := items.(map[string]interface{})
+		if !ok {
+			return fail("items must be a schema object")
+		}
+		if err := check(itemSchema, join(path, "*")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks value against schema and returns every mismatch found
+func Validate(schema map[string]interface{}, value interface{}) []FieldError {
+	var errs []FieldError
+	validate(schema, value, "", &errs)
+	return errs
+}
+
+func validate(schema map[string]interface{}, value interface{}, path string, errs *[]FieldError) {
+	add := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		add("must be of type %s", typeNames(t))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if query.Equal(value, option) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("must be one of %v", enum)
+		}
+	}
+
+	if constant, ok := schema["const"]; ok && !query.Equal(value, constant) {
+		add("must be %v", constant)
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if min, ok := schema["minimum"].(float64); ok && v < min {
+			add("must be >= %v", min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && v > max {
+			add("must be <= %v", max)
+		}
+		if min, ok := schema["exclusiveMinimum"].(float64); ok && v <= min {
+			add("must be > %v", min)
+		}
+		if max, ok := schema["exclusiveMaximum"].(float64); ok && v >= max {
+			add("must be < %v", max)
+		}
+
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := schema["minLength"].(float64); ok && length < min {
+			add("must be at least %v characters long", min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && length > max {
+			add("must be at most %v characters long", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := compile(pattern); err == nil && !re.MatchString(v) {
+				add("must match pattern %s", pattern)
+			}
+		}
+
+	case []interface{}:
+		count := float64(len(v))
+		if min, ok := schema["minItems"].(float64); ok && count < min {
+			add("must contain at least %v items", min)
+		}
+		if max, ok := schema["maxItems"].(float64); ok && count > max {
+			add("must contain at most %v items", max)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				validate(items, item, join(path, strconv.Itoa(i)), errs)
+			}
+		}
+
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				key, _ := name.(string)
+				if _, ok := v[key]; !ok {
+					*errs = append(*errs, FieldError{Path: join(path, key), Message: "is required"})
+				}
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+
+		// walk keys in a stable order so errors are reported deterministically
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if sub, ok := properties[key].(map[string]interface{}); ok {
+				validate(sub, v[key], join(path, key), errs)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					*errs = append(*errs, FieldError{Path: join(path, key), Message: "is not allowed"})
+				}
+			case map[string]interface{}:
+				validate(additional, v[key], join(path, key), errs)
+			}
+		}
+	}
+}
+
+func matchesType(t interface{}, value interface{}) bool {
+	switch v := t.(type) {
+	case string:
+		return isType(v, value)
+	case []interface{}:
+		for _, name := range v {
+			if s, ok := name.(string); ok && isType(s, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isType(name string, value interface{}) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+func typeNames(t interface{}) string {
+	if s, ok := t.(string); ok {
+		return s
+	}
+	return fmt.Sprint(t)
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var patterns sync.Map
+
+// compile caches compiled patterns since schemas are checked on every write
+func compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, re)
+	return re, nil
+}
@@ -0,0 +1,190 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func parse(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &schema); err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return schema
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		schema string
+		err    string // empty when the schema is valid
+	}{
+		{`{}`, ``},
+		{`{"title": "ignored", "description": 1}`, ``},
+		{`{"type": "object"}`, ``},
+		{`{"type": ["string", "null"]}`, ``},
+		{`{"type": "thing"}`, `root: unknown type thing`},
+		{`{"type": ["string", 1]}`, `root: unknown type 1`},
+		{`{"type": 1}`, `root: type must be a string or an array of strings`},
+		{`{"enum": ["a", 1, null]}`, ``},
+		{`{"enum": "a"}`, `root: enum must be an array`},
+		{`{"const": {"any": "value"}}`, ``},
+		{`{"required": ["a"]}`, ``},
+		{`{"required": "a"}`, `root: required must be an array of strings`},
+		{`{"required": ["a", 1]}`, `root: required must be an array of strings`},
+		{`{"minimum": 1, "maximum": 2.5, "exclusiveMinimum": -1, "exclusiveMaximum": 3}`, ``},
+		{`{"minimum": "1"}`, `root: minimum must be a number`},
+		{`{"exclusiveMaximum": true}`, `root: exclusiveMaximum must be a number`},
+		{`{"minLength": 0, "maxLength": 3, "minItems": 1, "maxItems": 2}`, ``},
+		{`{"minLength": -1}`, `root: minLength must be a non-negative integer`},
+		{`{"maxItems": 1.5}`, `root: maxItems must be a non-negative integer`},
+		{`{"maxLength": "3"}`, `root: maxLength must be a non-negative integer`},
+		{`{"pattern": "^[a-z]+$"}`, ``},
+		{`{"pattern": "("}`, "root: invalid pattern: error parsing regexp: missing closing ): `(`"},
+		{`{"pattern": 1}`, `root: pattern must be a string`},
+		{`{"properties": {"a": {"type": "string"}}}`, ``},
+		{`{"properties": []}`, `root: properties must be an object`},
+		{`{"properties": {"a": "string"}}`, `root: property a must be a schema object`},
+		{`{"properties": {"a": {"properties": {"b": {"type": "x"}}}}}`, `a.b: unknown type x`},
+		{`{"additionalProperties": false}`, ``},
+		{`{"additionalProperties": {"type": "number"}}`, ``},
+		{`{"additionalProperties": {"type": "x"}}`, `*: unknown type x`},
+		{`{"additionalProperties": "no"}`, `root: additionalProperties must be a boolean or a schema object`},
+		{`{"items": {"type": "string"}}`, ``},
+		{`{"items": [{"type": "string"}]}`, `root: items must be a schema object`},
+		{`{"properties": {"tags": {"items": {"minLength": -2}}}}`, `tags.*: minLength must be a non-negative integer`},
+	}
+
+	for _, tt := range tests {
+		err := Check(parse(t, tt.schema))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("Check(%s): %v", tt.schema, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("Check(%s) = %v, want %q", tt.schema, err, tt.err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		schema string
+		value  string
+		errs   []FieldError
+	}{
+		// type
+		{`{"type": "string"}`, `"a"`, nil},
+		{`{"type": "string"}`, `1`, []FieldError{{"", "must be of type string"}}},
+		{`{"type": "integer"}`, `2`, nil},
+		{`{"type": "integer"}`, `2.5`, []FieldError{{"", "must be of type integer"}}},
+		{`{"type": "number"}`, `2.5`, nil},
+		{`{"type": "boolean"}`, `"true"`, []FieldError{{"", "must be of type boolean"}}},
+		{`{"type": "null"}`, `null`, nil},
+		{`{"type": "array"}`, `{}`, []FieldError{{"", "must be of type array"}}},
+		{`{"type": "object"}`, `[]`, []FieldError{{"", "must be of type object"}}},
+		{`{"type": ["string", "null"]}`, `null`, nil},
+		{`{"type": ["string", "null"]}`, `1`, []FieldError{{"", "must be of type [string null]"}}},
+		// a type mismatch skips the other keywords
+		{`{"type": "string", "minLength": 5}`, `1`, []FieldError{{"", "must be of type string"}}},
+
+		// enum and const
+		{`{"enum": ["a", 1]}`, `1`, nil},
+		{`{"enum": ["a", 1]}`, `"b"`, []FieldError{{"", "must be one of [a 1]"}}},
+		{`{"const": "x"}`, `"x"`, nil},
+		{`{"const": "x"}`, `"y"`, []FieldError{{"", "must be x"}}},
+		{`{"const": {"a": [1]}}`, `{"a": [1]}`, nil},
+
+		// numbers
+		{`{"minimum": 1}`, `1`, nil},
+		{`{"minimum": 1}`, `0.5`, []FieldError{{"", "must be >= 1"}}},
+		{`{"maximum": 1}`, `2`, []FieldError{{"", "must be <= 1"}}},
+		{`{"exclusiveMinimum": 1}`, `1`, []FieldError{{"", "must be > 1"}}},
+		{`{"exclusiveMaximum": 1}`, `1`, []FieldError{{"", "must be < 1"}}},
+		{`{"minimum": 1}`, `"0"`, nil},
+
+		// strings count characters, not bytes
+		{`{"minLength": 2}`, `"ä"`, []FieldError{{"", "must be at least 2 characters long"}}},
+		{`{"maxLength": 2}`, `"äö"`, nil},
+		{`{"maxLength": 2}`, `"abc"`, []FieldError{{"", "must be at most 2 characters long"}}},
+		{`{"pattern": "^[a-z]+$"}`, `"abc"`, nil},
+		{`{"pattern": "^[a-z]+$"}`, `"aBc"`, []FieldError{{"", "must match pattern ^[a-z]+$"}}},
+		{`{"pattern": "b"}`, `"abc"`, nil},
+
+		// arrays
+		{`{"minItems": 1}`, `[]`, []FieldError{{"", "must contain at least 1 items"}}},
+		{`{"maxItems": 1}`, `[1, 2]`, []FieldError{{"", "must contain at most 1 items"}}},
+		{`{"items": {"type": "string"}}`, `["a", 1, "b", true]`, []FieldError{{"1", "must be of type string"}, {"3", "must be of type string"}}},
+
+		// objects
+		{`{"required": ["a", "b"]}`, `{"b": 1}`, []FieldError{{"a", "is required"}}},
+		{`{"required": ["b", "a"]}`, `{}`, []FieldError{{"b", "is required"}, {"a", "is required"}}},
+		{`{"required": ["a"]}`, `{"a": null}`, nil},
+		{`{"properties": {"a": {"type": "string"}}}`, `{"a": 1, "b": 2}`, []FieldError{{"a", "must be of type string"}}},
+		{`{"properties": {"a": {}}, "additionalProperties": false}`, `{"z": 1, "a": 1, "c": 2}`, []FieldError{{"c", "is not allowed"}, {"z", "is not allowed"}}},
+		{`{"additionalProperties": {"type": "number"}}`, `{"b": "x", "a": 1}`, []FieldError{{"b", "must be of type number"}}},
+		{
+			`{"type": "object", "required": ["name"], "properties": {
+				"address": {"type": "object", "required": ["city"], "properties": {"zip": {"pattern": "^[0-9]{5}$"}}},
+				"tags": {"type": "array", "items": {"type": "object", "properties": {"label": {"minLength": 1}}}}
+			}}`,
+			`{"address": {"zip": "1234"}, "tags": [{"label": "ok"}, {"label": ""}]}`,
+			[]FieldError{
+				{"name", "is required"},
+				{"address.city", "is required"},
+				{"address.zip", "must match pattern ^[0-9]{5}$"},
+				{"tags.1.label", "must be at least 1 characters long"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		var value interface{}
+		if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+			t.Fatal(err)
+		}
+		if errs := Validate(parse(t, tt.schema), value); !reflect.DeepEqual(errs, tt.errs) {
+			t.Errorf("Validate(%s, %s) = %v, want %v", tt.schema, tt.value, errs, tt.errs)
+		}
+	}
+}
+
+// errors have to come out the same way on every run, map iteration order
+// must not leak into them
+func TestDeterministicErrors(t *testing.T) {
+	schema := parse(t, `{
+		"properties": {
+			"a": {"type": "x"}, "b": {"type": "y"}, "c": {"type": "z"},
+			"d": {"type": "string"}, "e": {"type": "string"}, "f": {"type": "string"}
+		},
+		"additionalProperties": false
+	}`)
+	value := map[string]interface{}{"f": 1.0, "e": 2.0, "d": 3.0, "x": 1.0, "w": 2.0}
+
+	firstCheck := Check(schema)
+	delete(schema["properties"].(map[string]interface{}), "a")
+	delete(schema["properties"].(map[string]interface{}), "b")
+	delete(schema["properties"].(map[string]interface{}), "c")
+	firstErrs := Validate(schema, value)
+
+	for i := 0; i < 50; i++ {
+		withInvalid := parse(t, `{"properties": {"a": {"type": "x"}, "b": {"type": "y"}, "c": {"type": "z"}}}`)
+		if err := Check(withInvalid); err == nil || err.Error() != firstCheck.Error() || err.Error() != "a: unknown type x" {
+			t.Fatalf("Check reported %v, then %v", firstCheck, err)
+		}
+		if errs := Validate(schema, value); !reflect.DeepEqual(errs, firstErrs) {
+			t.Fatalf("Validate reported %v, then %v", firstErrs, errs)
+		}
+	}
+
+	want := []FieldError{
+		{"d", "must be of type string"},
+		{"e", "must be of type string"},
+		{"f", "must be of type string"},
+		{"w", "is not allowed"},
+		{"x", "is not allowed"},
+	}
+	if !reflect.DeepEqual(firstErrs, want) {
+		t.Errorf("Validate = %v, want %v", firstErrs, want)
+	}
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tempFiles returns the names of the temporary files in dir
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if isTempFile(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+
+	for _, content := range []string{`{"a": 1}`, `{"b": 2, "c": 3}`, ``} {
+		if err := WriteFileAtomic(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("read %q, want %q", data, content)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("mode %v, want 0600", perm)
+		}
+		if names := tempFiles(t, dir); len(names) != 0 {
+			t.Errorf("temporary files left: %v", names)
+		}
+	}
+
+	// failed writes leave the target and the directory as they were
+	target := filepath.Join(dir, "target")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(target, []byte("x"), 0600); err == nil {
+		t.Error("replacing a directory succeeded")
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		t.Errorf("target changed: %v", err)
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "data.json"), []byte("x"), 0600); err == nil {
+		t.Error("writing into a missing directory succeeded")
+	}
+	if names := tempFiles(t, dir); len(names) != 0 {
+		t.Errorf("temporary files left after failures: %v", names)
+	}
+}
+
+// TestWriteFileAtomicReaders checks that readers always see one complete
+// version of the file while it is replaced
+func TestWriteFileAtomicReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	versions := [][]byte{
+		bytes.Repeat([]byte("a"), 64<<10),
+		bytes.Repeat([]byte("b"), 16<<10),
+	}
+	if err := WriteFileAtomic(path, versions[0], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if err := WriteFileAtomic(path, versions[i%2], 0600); err != nil {
+				t.Error(err)
+				break
+			}
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		default:
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, versions[0]) && !bytes.Equal(data, versions[1]) {
+			t.Fatalf("read %d bytes of a partial write", len(data))
+		}
+	}
+}
+
+func TestCleanupTempFiles(t *testing.T) {
+	root := t.TempDir()
+	files := []string{
+		"superusers.json",
+		".superusers.json.tmp-123",
+		"database/notes/a.json",
+		"database/notes/.a.json.tmp-456",
+		"database/notes/.hidden",
+		"database/notes/b.json.tmp-789",
+		"database/.config.json.tmp-1",
+	}
+	for _, name := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// directories are never removed, even with a matching name
+	if err := os.Mkdir(filepath.Join(root, ".dir.tmp-1"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := CleanupTempFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range removed {
+		removed[i], _ = filepath.Rel(root, removed[i])
+	}
+	sort.Strings(removed)
+	want := []string{
+		".superusers.json.tmp-123",
+		"database/.config.json.tmp-1",
+		"database/notes/.a.json.tmp-456",
+	}
+	if strings.Join(removed, ",") != strings.Join(want, ",") {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+
+	for _, name := range append(files, ".dir.tmp-1") {
+		_, err := os.Stat(filepath.Join(root, name))
+		kept := err == nil
+		isRemoved := false
+		for _, w := range want {
+			isRemoved = isRemoved || w == name
+		}
+		if kept == isRemoved {
+			t.Errorf("%s: kept %v", name, kept)
+		}
+	}
+
+	// a missing root is nothing to clean up
+	if removed, err := CleanupTempFiles(filepath.Join(root, "missing")); err != nil || len(removed) != 0 {
+		t.Errorf("missing root: %v %v", removed, err)
+	}
+}
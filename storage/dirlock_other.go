@@ -0,0 +1,32 @@
+//go:build !unix
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// LockDirectory takes an exclusive lock on dir so no other server process
+// can use the same data directory. Without flock the lock file is created
+// exclusively, so a crashed process leaves it behind and it has to be
+// removed by hand.
+func LockDirectory(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, ".lock")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if os.IsExist(err) {
+		return nil, ErrDirectoryLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		file.Close()
+		os.Remove(path)
+	}, nil
+}
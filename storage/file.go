@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const configFile = "config.json"
+
+// FileStorage keeps every collection in its own directory below Root,
+// with one <id>.json file per record and the collection settings in config.json
+type FileStorage struct {
+	Root string
+}
+
+func NewFileStorage(root string) *FileStorage {
+	return &FileStorage{Root: root}
+}
+
+func (s *FileStorage) collectionPath(collection string) string {
+	return filepath.Join(s.Root, collection)
+}
+
+func (s *FileStorage) recordPath(collection, id string) string {
+	return filepath.Join(s.Root, collection, id+".json")
+}
+
+func (s *FileStorage) GetRecord(collection, id string) (map[string]interface{}, error) {
+	if !validName(collection) || !validRecordID(id) {
+		return nil, ErrInvalidName
+	}
+	return readJSON(s.recordPath(collection, id), ErrNotFound)
+}
+
+func (s *FileStorage) PutRecord(collection, id string, data map[string]interface{}) error {
+	if !validName(collection) || !validRecordID(id) {
+		return ErrInvalidName
+	}
+
+	// Make sure the collection directory exists
+	if err := os.MkdirAll(s.collectionPath(collection), os.ModePerm); err != nil {
+		return err
+	}
+	return writeJSON(s.recordPath(collection, id), data)
+}
+
+func (s *FileStorage) DeleteRecord(collection, id string) error {
+	if !validName(collection) || !validRecordID(id) {
+		return ErrInvalidName
+	}
+	err := os.Remove(s.recordPath(collection, id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *FileStorage) ListRecords(collection string) ([]Record, error) {
+	if !validName(collection) {
+		return nil, ErrInvalidName
+	}
+
+	files, err := os.ReadDir(s.collectionPath(collection))
+	if os.IsNotExist(err) {
+		return nil, ErrCollectionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".json") || name == configFile {
+			continue
+		}
+
+		data, err := readJSON(filepath.Join(s.collectionPath(collection), name), ErrNotFound)
+		if err != nil {
+			continue // skip unreadable files
+		}
+		records = append(records, Record{ID: strings.TrimSuffix(name, ".json"), Data: data})
+	}
+	return records, nil
+}
+
+func (s *FileStorage) CreateCollection(id string, config map[string]interface{}) error {
+	if !validName(id) {
+		return ErrInvalidName
+	}
+	if _, err := os.Stat(s.collectionPath(id)); err == nil {
+		return ErrCollectionExists
+	}
+	if err := os.MkdirAll(s.collectionPath(id), os.ModePerm); err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(s.collectionPath(id), configFile), config)
+}
+
+func (s *FileStorage) GetCollection(id string) (map[string]interface{}, error) {
+	if !validName(id) {
+		return nil, ErrInvalidName
+	}
+	return readJSON(filepath.Join(s.collectionPath(id), configFile), ErrCollectionNotFound)
+}
+
+func (s *FileStorage) UpdateCollection(id string, config map[string]interface{}) error {
+	if !validName(id) {
+		return ErrInvalidName
+	}
+	info, err := os.Stat(s.collectionPath(id))
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return ErrCollectionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(s.collectionPath(id), configFile), config)
+}
+
+func (s *FileStorage) ListCollections() ([]string, error) {
+	entries, err := os.ReadDir(s.Root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var collections []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			collections = append(collections, entry.Name())
+		}
+	}
+	return collections, nil
+}
+
+func (s *FileStorage) DropCollection(id string) error {
+	if !validName(id) {
+		return ErrInvalidName
+	}
+	info, err := os.Stat(s.collectionPath(id))
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return ErrCollectionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(s.collectionPath(id))
+}
+
+// readJSON decodes a JSON object file, returning notFound if it does not exist
+func readJSON(path string, notFound error) (map[string]interface{}, error) {
+	bytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeJSON(path string, data map[string]interface{}) error {
+	bytes, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, bytes, 0644)
+}
@@ -0,0 +1,94 @@
+package storage
+
+import "sync"
+
+// LockManager hands out read-write locks per collection and per record.
+// Record locks also hold a shared lock on their collection, so dropping or
+// reconfiguring a collection waits for all record operations on it.
+type LockManager struct {
+	collections keyedLock
+	records     keyedLock
+}
+
+// Locks is the lock manager shared by the gin handlers
+var Locks = NewLockManager()
+
+func NewLockManager() *LockManager {
+	return &LockManager{
+		collections: keyedLock{locks: make(map[string]*refLock)},
+		records:     keyedLock{locks: make(map[string]*refLock)},
+	}
+}
+
+// LockCollection locks a collection exclusively and returns the unlock func
+func (m *LockManager) LockCollection(collection string) func() {
+	return m.collections.lock(collection, false)
+}
+
+// RLockCollection locks a collection for reading and returns the unlock func
+func (m *LockManager) RLockCollection(collection string) func() {
+	return m.collections.lock(collection, true)
+}
+
+// LockRecord locks a record exclusively and returns the unlock func
+func (m *LockManager) LockRecord(collection, id string) func() {
+	unlockCollection := m.collections.lock(collection, true)
+	unlockRecord := m.records.lock(collection+"/"+id, false)
+	return func() {
+		unlockRecord()
+		unlockCollection()
+	}
+}
+
+// RLockRecord locks a record for reading and returns the unlock func
+func (m *LockManager) RLockRecord(collection, id string) func() {
+	unlockCollection := m.collections.lock(collection, true)
+	unlockRecord := m.records.lock(collection+"/"+id, true)
+	return func() {
+		unlockRecord()
+		unlockCollection()
+	}
+}
+
+// keyedLock keeps one RWMutex per key, dropping it once nobody uses it
+type keyedLock struct {
+	mu    sync.Mutex
+	locks map[string]*refLock
+}
+
+type refLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func (k *keyedLock) lock(key string, shared bool) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &refLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	if shared {
+		l.RLock()
+	} else {
+		l.Lock()
+	}
+
+	return func() {
+		if shared {
+			l.RUnlock()
+		} else {
+			l.Unlock()
+		}
+
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
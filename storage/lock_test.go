@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blocks reports whether lock waits while held is locked. The waiting lock
+// has to be granted once held is released.
+func blocks(t *testing.T, held, lock func() func()) bool {
+	t.Helper()
+	unlockHeld := held()
+
+	acquired := make(chan func())
+	go func() { acquired <- lock() }()
+
+	select {
+	case unlock := <-acquired:
+		unlock()
+		unlockHeld()
+		return false
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlockHeld()
+	select {
+	case unlock := <-acquired:
+		unlock()
+	case <-time.After(time.Second):
+		t.Fatal("lock not granted after release")
+	}
+	return true
+}
+
+func TestLockManager(t *testing.T) {
+	m := NewLockManager()
+	collection := func(name string, shared bool) func() func() {
+		if shared {
+			return func() func() { return m.RLockCollection(name) }
+		}
+		return func() func() { return m.LockCollection(name) }
+	}
+	record := func(name, id string, shared bool) func() func() {
+		if shared {
+			return func() func() { return m.RLockRecord(name, id) }
+		}
+		return func() func() { return m.LockRecord(name, id) }
+	}
+
+	tests := []struct {
+		name       string
+		held, lock func() func()
+		blocks     bool
+	}{
+		{"collection readers", collection("notes", true), collection("notes", true), false},
+		{"collection writer after reader", collection("notes", true), collection("notes", false), true},
+		{"collection reader after writer", collection("notes", false), collection("notes", true), true},
+		{"collection writers", collection("notes", false), collection("notes", false), true},
+		{"other collections", collection("notes", false), collection("tags", false), false},
+		{"record readers", record("notes", "a", true), record("notes", "a", true), false},
+		{"record writer after reader", record("notes", "a", true), record("notes", "a", false), true},
+		{"record reader after writer", record("notes", "a", false), record("notes", "a", true), true},
+		{"record writers", record("notes", "a", false), record("notes", "a", false), true},
+		{"other records", record("notes", "a", false), record("notes", "b", false), false},
+		{"same id in other collection", record("notes", "a", false), record("tags", "a", false), false},
+		{"collection writer after record writer", record("notes", "a", false), collection("notes", false), true},
+		{"collection writer after record reader", record("notes", "a", true), collection("notes", false), true},
+		{"collection reader after record writer", record("notes", "a", false), collection("notes", true), false},
+		{"record writer after collection writer", collection("notes", false), record("notes", "a", false), true},
+		{"record reader after collection writer", collection("notes", false), record("notes", "a", true), true},
+		{"record writer after collection reader", collection("notes", true), record("notes", "a", false), false},
+		{"record after other collection writer", collection("tags", false), record("notes", "a", false), false},
+	}
+	for _, tt := range tests {
+		if got := blocks(t, tt.held, tt.lock); got != tt.blocks {
+			t.Errorf("%s: blocks %v, want %v", tt.name, got, tt.blocks)
+		}
+	}
+
+	// unused locks are dropped
+	if n := len(m.collections.locks) + len(m.records.locks); n != 0 {
+		t.Errorf("%d locks left", n)
+	}
+}
+
+func TestLockDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "database")
+
+	unlock, err := LockDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockDirectory(dir); !errors.Is(err, ErrDirectoryLocked) {
+		t.Fatalf("second lock: %v", err)
+	}
+
+	// other directories are independent
+	other, err := LockDirectory(filepath.Join(t.TempDir(), "database"))
+	if err != nil {
+		t.Fatalf("other directory: %v", err)
+	}
+	other()
+
+	unlock()
+	unlock, err = LockDirectory(dir)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// MemoryStorage keeps everything in memory, mainly for tests
+type MemoryStorage struct {
+	mu          sync.RWMutex
+	collections map[string]*memoryCollection
+}
+
+type memoryCollection struct {
+	config  map[string]interface{}
+	records map[string]map[string]interface{}
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{collections: make(map[string]*memoryCollection)}
+}
+
+func (s *MemoryStorage) GetRecord(collection, id string) (map[string]interface{}, error) {
+	if !validName(collection) || !validRecordID(id) {
+		return nil, ErrInvalidName
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	col, ok := s.collections[collection]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	data, ok := col.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(data)
+}
+
+func (s *MemoryStorage) PutRecord(collection, id string, data map[string]interface{}) error {
+	if !validName(collection) || !validRecordID(id) {
+		return ErrInvalidName
+	}
+
+	copied, err := clone(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	col, ok := s.collections[collection]
+	if !ok {
+		col = &memoryCollection{records: make(map[string]map[string]interface{})}
+		s.collections[collection] = col
+	}
+	col.records[id] = copied
+	return nil
+}
+
+func (s *MemoryStorage) DeleteRecord(collection, id string) error {
+	if !validName(collection) || !validRecordID(id) {
+		return ErrInvalidName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	col, ok := s.collections[collection]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := col.records[id]; !ok {
+		return ErrNotFound
+	}
+	delete(col.records, id)
+	return nil
+}
+
+func (s *MemoryStorage) ListRecords(collection string) ([]Record, error) {
+	if !validName(collection) {
+		return nil, ErrInvalidName
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	col, ok := s.collections[collection]
+	if !ok {
+		return nil, ErrCollectionNotFound
+	}
+
+	records := make([]Record, 0, len(col.records))
+	for id, data := range col.records {
+		copied, err := clone(data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record{ID: id, Data: copied})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records, nil
+}
+
+func (s *MemoryStorage) CreateCollection(id string, config map[string]interface{}) error {
+	if !validName(id) {
+		return ErrInvalidName
+	}
+
+	copied, err := clone(config)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.collections[id]; ok {
+		return ErrCollectionExists
+	}
+	s.collections[id] = &memoryCollection{config: copied, records: make(map[string]map[string]interface{})}
+	return nil
+}
+
+func (s *MemoryStorage) GetCollection(id string) (map[string]interface{}, error) {
+	if !validName(id) {
+		return nil, ErrInvalidName
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	col, ok := s.collections[id]
+	if !ok || col.config == nil {
+		return nil, ErrCollectionNotFound
+	}
+	return clone(col.config)
+}
+
+func (s *MemoryStorage) UpdateCollection(id string, config map[string]interface{}) error {
+	if !validName(id) {
+		return ErrInvalidName
+	}
+
+	copied, err := clone(config)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	col, ok := s.collections[id]
+	if !ok {
+		return ErrCollectionNotFound
+	}
+	col.config = copied
+	return nil
+}
+
+func (s *MemoryStorage) ListCollections() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	collections := make([]string, 0, len(s.collections))
+	for id := range s.collections {
+		collections = append(collections, id)
+	}
+	sort.Strings(collections)
+	return collections, nil
+}
+
+func (s *MemoryStorage) DropCollection(id string) error {
+	if !validName(id) {
+		return ErrInvalidName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.collections[id]; !ok {
+		return ErrCollectionNotFound
+	}
+	delete(s.collections, id)
+	return nil
+}
+
+// clone deep copies a document through JSON so callers see the same
+// value types as they would after a round trip through the file storage
+func clone(data map[string]interface{}) (map[string]interface{}, error) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var copied map[string]interface{}
+	if err := json.Unmarshal(bytes, &copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNotFound           = errors.New("record not found")
+	ErrCollectionNotFound = errors.New("collection not found")
+	ErrCollectionExists   = errors.New("collection already exists")
+	ErrInvalidName        = errors.New("invalid collection or record name")
+	ErrDirectoryLocked    = errors.New("data directory is in use by another process")
+)
+
+// SystemFields are maintained by the server on every record
+var SystemFields = []string{"id", "collectionId", "created", "updated", "createdBy", "updatedBy", "revision"}
+
+// Record is a stored document together with its id
+type Record struct {
+	ID   string
+	Data map[string]interface{}
+}
+
+// Storage is the engine the record and collection handlers persist through
+type Storage interface {
+	GetRecord(collection, id string) (map[string]interface{}, error)
+	// PutRecord creates or replaces a record, creating the collection if needed
+	PutRecord(collection, id string, data map[string]interface{}) error
+	DeleteRecord(collection, id string) error
+	ListRecords(collection string) ([]Record, error)
+
+	CreateCollection(id string, config map[string]interface{}) error
+	GetCollection(id string) (map[string]interface{}, error)
+	UpdateCollection(id string, config map[string]interface{}) error
+	ListCollections() ([]string, error)
+	DropCollection(id string) error
+}
+
+// Default is the storage used by the gin handlers
+var Default Storage = NewFileStorage("database")
+
+// validName rejects names that could escape the data directory
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// validRecordID also rejects the id that would address the collection
+// settings of a FileStorage, on case-insensitive file systems too
+func validRecordID(id string) bool {
+	return validName(id) && !strings.EqualFold(id+".json", configFile)
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// every Storage implementation has to pass the same tests
+func implementations(t *testing.T) map[string]Storage {
+	return map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"file":   NewFileStorage(filepath.Join(t.TempDir(), "database")),
+	}
+}
+
+func TestStorageRecords(t *testing.T) {
+	for name, s := range implementations(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.ListRecords("notes"); !errors.Is(err, ErrCollectionNotFound) {
+				t.Errorf("ListRecords of missing collection: %v", err)
+			}
+			if _, err := s.GetRecord("notes", "a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetRecord of missing record: %v", err)
+			}
+
+			// PutRecord creates the collection
+			record := map[string]interface{}{"title": "first", "count": 1, "tags": []interface{}{"x"}}
+			if err := s.PutRecord("notes", "a", record); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.PutRecord("notes", "b", map[string]interface{}{"title": "second"}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.GetRecord("notes", "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// numbers come back as float64, like after a JSON round trip
+			if got["title"] != "first" || got["count"] != float64(1) {
+				t.Errorf("GetRecord returned %v", got)
+			}
+
+			// returned records are copies
+			got["title"] = "changed"
+			record["title"] = "changed too"
+			if again, _ := s.GetRecord("notes", "a"); again["title"] != "first" {
+				t.Errorf("stored record was modified through a copy: %v", again)
+			}
+
+			if err := s.PutRecord("notes", "a", map[string]interface{}{"title": "replaced"}); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := s.GetRecord("notes", "a"); again["title"] != "replaced" || again["count"] != nil {
+				t.Errorf("PutRecord did not replace the record: %v", again)
+			}
+
+			records, err := s.ListRecords("notes")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 2 || records[0].ID != "a" || records[1].ID != "b" {
+				t.Errorf("ListRecords returned %v", records)
+			}
+
+			if err := s.DeleteRecord("notes", "a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteRecord("notes", "a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second DeleteRecord: %v", err)
+			}
+			if _, err := s.GetRecord("notes", "a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetRecord of deleted record: %v", err)
+			}
+		})
+	}
+}
+
+func TestStorageCollections(t *testing.T) {
+	for name, s := range implementations(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.GetCollection("people"); !errors.Is(err, ErrCollectionNotFound) {
+				t.Errorf("GetCollection of missing collection: %v", err)
+			}
+			if err := s.UpdateCollection("people", map[string]interface{}{}); !errors.Is(err, ErrCollectionNotFound) {
+				t.Errorf("UpdateCollection of missing collection: %v", err)
+			}
+			if err := s.DropCollection("people"); !errors.Is(err, ErrCollectionNotFound) {
+				t.Errorf("DropCollection of missing collection: %v", err)
+			}
+
+			if err := s.CreateCollection("people", map[string]interface{}{"name": "People"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CreateCollection("people", map[string]interface{}{"name": "Again"}); !errors.Is(err, ErrCollectionExists) {
+				t.Errorf("second CreateCollection: %v", err)
+			}
+			if err := s.CreateCollection("animals", map[string]interface{}{"name": "Animals"}); err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := s.ListRecords("people")
+			if err != nil || len(records) != 0 {
+				t.Errorf("ListRecords of new collection: %v %v", records, err)
+			}
+
+			if err := s.UpdateCollection("people", map[string]interface{}{"name": "Persons", "listRule": ""}); err != nil {
+				t.Fatal(err)
+			}
+			config, err := s.GetCollection("people")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config["name"] != "Persons" || config["listRule"] != "" {
+				t.Errorf("GetCollection returned %v", config)
+			}
+
+			collections, err := s.ListCollections()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(collections) != 2 || collections[0] != "animals" || collections[1] != "people" {
+				t.Errorf("ListCollections returned %v", collections)
+			}
+
+			s.PutRecord("people", "p1", map[string]interface{}{"name": "ann"})
+			if err := s.DropCollection("people"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.GetRecord("people", "p1"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("record survived DropCollection: %v", err)
+			}
+			if collections, _ := s.ListCollections(); len(collections) != 1 {
+				t.Errorf("ListCollections after drop returned %v", collections)
+			}
+		})
+	}
+}
+
+func TestStorageInvalidNames(t *testing.T) {
+	names := []string{"", ".", "..", "../escape", `a\b`, "a/b"}
+
+	for name, s := range implementations(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, bad := range names {
+				if err := s.PutRecord(bad, "id", map[string]interface{}{}); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("PutRecord(%q, id): %v", bad, err)
+				}
+				if err := s.PutRecord("notes", bad, map[string]interface{}{}); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("PutRecord(notes, %q): %v", bad, err)
+				}
+				if _, err := s.GetRecord("notes", bad); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("GetRecord(notes, %q): %v", bad, err)
+				}
+				if err := s.DeleteRecord("notes", bad); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("DeleteRecord(notes, %q): %v", bad, err)
+				}
+				if _, err := s.ListRecords(bad); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("ListRecords(%q): %v", bad, err)
+				}
+				if err := s.CreateCollection(bad, map[string]interface{}{}); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("CreateCollection(%q): %v", bad, err)
+				}
+				if _, err := s.GetCollection(bad); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("GetCollection(%q): %v", bad, err)
+				}
+				if err := s.DropCollection(bad); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("DropCollection(%q): %v", bad, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStorageConfigRecord(t *testing.T) {
+	for name, s := range implementations(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.CreateCollection("notes", map[string]interface{}{"deleteRule": ""}); err != nil {
+				t.Fatal(err)
+			}
+
+			// the collection settings can't be read, written or deleted as a record
+			for _, id := range []string{"config", "CONFIG", "Config"} {
+				if _, err := s.GetRecord("notes", id); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("GetRecord(notes, %s): %v", id, err)
+				}
+				if err := s.PutRecord("notes", id, map[string]interface{}{}); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("PutRecord(notes, %s): %v", id, err)
+				}
+				if err := s.DeleteRecord("notes", id); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("DeleteRecord(notes, %s): %v", id, err)
+				}
+			}
+
+			if config, err := s.GetCollection("notes"); err != nil || config["deleteRule"] != "" {
+				t.Errorf("collection settings after access as record: %v %v", config, err)
+			}
+			if records, err := s.ListRecords("notes"); err != nil || len(records) != 0 {
+				t.Errorf("ListRecords returned %v %v", records, err)
+			}
+		})
+	}
+}